@@ -0,0 +1,234 @@
+// Package admin serves a REST API to inspect and control the synchronizations of a running controller
+package admin
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/linksmart/hds-data-synchronizer/common"
+	sync "github.com/linksmart/hds-data-synchronizer/synchronizer"
+)
+
+// API exposes the controller over HTTP:
+//
+//	GET  /series                 status of all the synchronizations
+//	GET  /series/{name}          status of a synchronization
+//	POST /series/{name}/pause    pause a synchronization
+//	POST /series/{name}/resume   resume a paused synchronization
+//	POST /series/{name}/resync   copy the records in ?from=...&to=... (RFC3339) again, once at a time
+//	POST /discovery              read the source registry again
+//	GET  /config                 effective configuration
+//	GET  /reports                days with an SLA report, the latest first
+//	GET  /reports/{day}          SLA report of a UTC day (2006-01-02), as CSV with ?format=csv
+type API struct {
+	controller *sync.Controller
+}
+
+func NewAPI(controller *sync.Controller) *API {
+	return &API{controller: controller}
+}
+
+// Handler returns the router of the API. The series names may contain slashes
+func (a *API) Handler() http.Handler {
+	r := mux.NewRouter()
+	r.Methods(http.MethodGet).Path("/series").HandlerFunc(a.list)
+	r.Methods(http.MethodPost).Path("/series/{name:.+}/pause").HandlerFunc(a.pause)
+	r.Methods(http.MethodPost).Path("/series/{name:.+}/resume").HandlerFunc(a.resume)
+	r.Methods(http.MethodPost).Path("/series/{name:.+}/resync").HandlerFunc(a.resync)
+	r.Methods(http.MethodGet).Path("/series/{name:.+}").HandlerFunc(a.get)
+	r.Methods(http.MethodPost).Path("/discovery").HandlerFunc(a.discover)
+	r.Methods(http.MethodGet).Path("/config").HandlerFunc(a.config)
+	r.Methods(http.MethodGet).Path("/reports").HandlerFunc(a.reports)
+	r.Methods(http.MethodGet).Path("/reports/{day}").HandlerFunc(a.report)
+	return r
+}
+
+// NewServer returns the server of the admin API at the configured address. When enabled, the server uses the certificate and the key
+// of the TLS configuration, and accepts only the clients presenting a certificate signed by its CA
+func NewServer(conf *common.Config, controller *sync.Controller) (*http.Server, error) {
+	server := &http.Server{Addr: conf.Admin.Addr, Handler: NewAPI(controller).Handler()}
+	if !conf.Admin.TLS && !conf.Admin.ClientAuth {
+		return server, nil
+	}
+	certificate, err := conf.TLS.KeyPair()
+	if err != nil {
+		return nil, err
+	}
+	server.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if conf.Admin.ClientAuth {
+		// only the CA of the configuration is trusted, not the system pool
+		server.TLSConfig.ClientCAs, err = conf.TLS.CertPool(false)
+		if err != nil {
+			return nil, err
+		}
+		server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return server, nil
+}
+
+// ListenAndServe serves the API, over TLS if the server is configured for it
+func ListenAndServe(server *http.Server) error {
+	if server.TLSConfig != nil {
+		// the certificates are set in the TLS configuration already
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+// ListenSocket listens on the Unix socket at path, replacing a socket left over by an earlier run.
+// Only the user running the synchronizer may connect
+func ListenSocket(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on %s: %w", path, err)
+	}
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("error restricting access to %s: %w", path, err)
+	}
+	return listener, nil
+}
+
+func (a *API) list(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.controller.List())
+}
+
+func (a *API) get(w http.ResponseWriter, r *http.Request) {
+	status, err := a.controller.Get(mux.Vars(r)["name"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (a *API) pause(w http.ResponseWriter, r *http.Request) {
+	err := a.controller.Pause(mux.Vars(r)["name"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	a.get(w, r)
+}
+
+func (a *API) resume(w http.ResponseWriter, r *http.Request) {
+	err := a.controller.Resume(mux.Vars(r)["name"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	a.get(w, r)
+}
+
+func (a *API) resync(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from, err := time.Parse(time.RFC3339, query.Get("from"))
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, fmt.Sprintf("invalid from: %v", err))
+		return
+	}
+	to, err := time.Parse(time.RFC3339, query.Get("to"))
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, fmt.Sprintf("invalid to: %v", err))
+		return
+	}
+	if to.Before(from) {
+		writeProblem(w, http.StatusBadRequest, "to is before from")
+		return
+	}
+	err = a.controller.Resync(mux.Vars(r)["name"], from, to)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (a *API) discover(w http.ResponseWriter, r *http.Request) {
+	err := a.controller.Discover()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (a *API) config(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.controller.Config())
+}
+
+func (a *API) reports(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.controller.ReportDays())
+}
+
+func (a *API) report(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != sync.ReportJSON && format != sync.ReportCSV {
+		writeProblem(w, http.StatusBadRequest, fmt.Sprintf("unknown format %s", format))
+		return
+	}
+	report, err := a.controller.Report(mux.Vars(r)["day"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if format != sync.ReportCSV {
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.WriteHeader(http.StatusOK)
+	report.WriteCSV(w)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		writeProblem(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// writeError responds with the status matching the error of the controller
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, sync.ErrUnknownSeries), errors.Is(err, sync.ErrNoReport):
+		writeProblem(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, sync.ErrSeriesExists), errors.Is(err, sync.ErrResyncRunning):
+		writeProblem(w, http.StatusConflict, err.Error())
+	case errors.Is(err, sync.ErrStopping):
+		writeProblem(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		common.Log.Errorf("admin API: %v", err)
+		writeProblem(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// writeProblem responds with the problem details of RFC 7807, as the HDS APIs do
+func writeProblem(w http.ResponseWriter, status int, detail string) {
+	b, _ := json.Marshal(struct {
+		Title  string `json:"title"`
+		Status int    `json:"status"`
+		Detail string `json:"detail"`
+	}{http.StatusText(status), status, detail})
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/url"
+	"path"
 
 	"github.com/kelseyhightower/envconfig"
 )
@@ -16,6 +17,258 @@ type Config struct {
 	SyncInterval string    `json:"syncInterval"`
 	Source       string    `json:"source"`
 	TLS          TLSConfig `json:"tls"`
+	// DiscoveryInterval is the interval of the full reads of the source registry (e.g. "1m"). Defaults to "1m"
+	DiscoveryInterval string `json:"discoveryInterval"`
+	// DiscoveryPageSize is the number of registry entries fetched per request. Defaults to 100 when 0
+	DiscoveryPageSize int `json:"discoveryPageSize"`
+	// DiscoveryCheckInterval is the interval of the checks for changes of the source registry (e.g. "5s"). The check requests a single
+	// entry to compare the number of series, and runs a discovery when it changed. The series replaced by others are detected by the
+	// discovery every DiscoveryInterval. Defaults to "5s", disabled when "0"
+	DiscoveryCheckInterval string `json:"discoveryCheckInterval"`
+	// PeriodicInterval is the interval of the series set to periodic mode when SyncInterval is 0. Defaults to "1m"
+	PeriodicInterval string `json:"periodicInterval"`
+	// MetricsAddr is the address of the HTTP server exposing the Prometheus metrics at /metrics (e.g. ":9100"). Disabled when empty
+	MetricsAddr string `json:"metricsAddr"`
+	// Journal configures the audit journal of the records copied
+	Journal JournalConfig `json:"journal"`
+	// Alerts configures the alert rules and the webhooks notified
+	Alerts AlertsConfig `json:"alerts"`
+	// Report configures the daily replication SLA reports
+	Report ReportConfig `json:"report"`
+	// Events configures the publication of the series added to and removed from the source registry
+	Events EventsConfig `json:"events"`
+	// Log configures the level and the format of the logs
+	Log LogConfig `json:"log"`
+	// Tracing configures the export of the OpenTelemetry spans of the calls to the HDS instances
+	Tracing TracingConfig `json:"tracing"`
+	// Health configures the liveness and readiness endpoints
+	Health HealthConfig `json:"health"`
+	// Admin configures the REST API to inspect and control the synchronizations
+	Admin AdminConfig `json:"admin"`
+	// ShutdownTimeout is the time given to the synchronizations to submit the records in flight and to complete the running migrations
+	// when stopping (e.g. "30s"). Defaults to "30s"
+	ShutdownTimeout string `json:"shutdownTimeout"`
+	// DemoteAfter is the number of consecutive subscription failures after which a live series falls back to periodic mode.
+	// Disabled when 0
+	DemoteAfter int `json:"demoteAfter"`
+	// AdaptiveInterval adjusts the interval of the periodic synchronization of each series to its data rate
+	AdaptiveInterval AdaptiveIntervalConfig `json:"adaptiveInterval"`
+	// Schedule restricts the synchronization to the given windows, separated by ';' (e.g. "mon-fri 22:00-06:00; sat,sun 00:00-24:00").
+	// The synchronization runs all the time when empty.
+	Schedule string `json:"schedule"`
+	// Series contains per-series settings. The first entry matching a series name applies.
+	Series []SeriesConfig `json:"series"`
+	// MaxConcurrentBackfills limits the number of backfills running at the same time. Unlimited when 0
+	MaxConcurrentBackfills int `json:"maxConcurrentBackfills"`
+	// MaxMigrationsPerDestination limits the number of migrations running at the same time towards a destination. Unlimited when 0
+	MaxMigrationsPerDestination int `json:"maxMigrationsPerDestination"`
+	// StreamBatchSize is the maximum number of series sharing a source subscription or a backfill query. Defaults to 500 when 0
+	StreamBatchSize int `json:"streamBatchSize"`
+	// BackfillGroupSpan is the maximum distance between the starts of the backfill ranges grouped in a single query (e.g. "1h")
+	BackfillGroupSpan string `json:"backfillGroupSpan"`
+	// BackfillChunkSize is the number of records above which the backfill of a series is split into chunks of this size, copied concurrently.
+	// Disabled when 0
+	BackfillChunkSize int `json:"backfillChunkSize"`
+	// BackfillChunkParallelism is the number of chunks of a series copied concurrently. Defaults to 4 when 0
+	BackfillChunkParallelism int `json:"backfillChunkParallelism"`
+	// StateDir is the directory in which the synchronization state is persisted across restarts
+	StateDir string `json:"stateDir"`
+	// PriorityClasses defines the classes to which the series can be assigned
+	PriorityClasses []PriorityClass `json:"priorityClasses"`
+	// Retry configures the retries after errors
+	Retry RetryConfig `json:"retry"`
+	// ClockSkew configures the handling of the records dated in the future, e.g. by devices with drifting clocks
+	ClockSkew ClockSkewConfig `json:"clockSkew"`
+	// Connection configures the health monitoring of the gRPC connections
+	Connection ConnectionConfig `json:"connection"`
+}
+
+type EventsConfig struct {
+	// Webhooks are posted each event as JSON
+	Webhooks []WebhookConfig `json:"webhooks"`
+	// File is the path of a log to which the events are appended, one JSON object per line
+	File string `json:"file"`
+	// Initial publishes the series found by the first discovery as added too
+	Initial bool `json:"initial"`
+}
+
+type ReportConfig struct {
+	// Enabled turns on the sampling of the lag of the series for the reports
+	Enabled bool `json:"enabled"`
+	// LagSLA is the maximum lag of a series within the SLA (e.g. "5m"). Defaults to "5m"
+	LagSLA string `json:"lagSLA"`
+	// SampleInterval is the interval of the samples of the lag (e.g. "1m"). Defaults to "1m"
+	SampleInterval string `json:"sampleInterval"`
+	// Dir is the directory to which the report of each UTC day is written, as sla-<day>.json and sla-<day>.csv.
+	// The reports are only served by the admin API when empty
+	Dir string `json:"dir"`
+	// Formats are the formats of the files written, "json" and "csv". Defaults to both
+	Formats []string `json:"formats"`
+	// Days is the number of days of reports kept. Defaults to 31 when 0
+	Days int `json:"days"`
+}
+
+type AlertsConfig struct {
+	// Interval is the interval of the evaluation of the rules (e.g. "30s"). Defaults to "30s"
+	Interval string `json:"interval"`
+	// RepeatInterval is the time after which an alert still firing is notified again (e.g. "4h"). Notified once when empty
+	RepeatInterval string `json:"repeatInterval"`
+	// RateLimit is the maximum number of notifications per minute. The notifications beyond are postponed to the next evaluations.
+	// Defaults to 60 when 0
+	RateLimit int `json:"rateLimit"`
+	// Rules are the conditions notified
+	Rules []AlertRule `json:"rules"`
+	// Webhooks receive the notifications as JSON. The alerting is disabled when empty
+	Webhooks []WebhookConfig `json:"webhooks"`
+}
+
+type AlertRule struct {
+	// Name identifies the rule in the notifications
+	Name string `json:"name"`
+	// Kind is "lag" for the lag above Threshold, "errors" for Errors consecutive failures, "backfill" for a backfill running longer than
+	// Threshold, "added" or "removed" for the series added to or removed from the source registry
+	Kind string `json:"kind"`
+	// Match is a pattern matched against the series name, with the syntax of path.Match (e.g. "alarms/*"). All the series match when empty
+	Match string `json:"match"`
+	// Threshold is the lag or the duration of the backfill alerted (e.g. "10m"). The lag of a series which is not live, e.g. failing or paused,
+	// is at least the time since it was last live
+	Threshold string `json:"threshold"`
+	// Errors is the number of consecutive failed attempts alerted
+	Errors int `json:"errors"`
+	// Severity is passed on in the notifications (e.g. "critical")
+	Severity string `json:"severity"`
+}
+
+type WebhookConfig struct {
+	// URL receives the notifications with POST requests
+	URL string `json:"url"`
+	// Headers are added to the requests (e.g. Authorization)
+	Headers map[string]string `json:"headers"`
+	// Timeout is the timeout of the requests (e.g. "10s"). Defaults to "10s"
+	Timeout string `json:"timeout"`
+}
+
+type JournalConfig struct {
+	// Path is the file to which an entry is appended for every range of a series copied. Disabled when empty
+	Path string `json:"path"`
+	// Instance identifies this synchronizer in the journal. Defaults to the host name
+	Instance string `json:"instance"`
+	// FlushInterval is the interval at which the entries are written and synced to disk (e.g. "1s"). The live batches of a series
+	// within an interval are recorded as a single entry. Defaults to "1s"
+	FlushInterval string `json:"flushInterval"`
+}
+
+type LogConfig struct {
+	// Level is the minimum level of the logs: "debug", "info", "warn" or "error". The records received and submitted are logged
+	// at debug level. Defaults to "info"
+	Level string `json:"level"`
+	// Format is "logfmt" or "json". Defaults to "logfmt"
+	Format string `json:"format"`
+}
+
+type TracingConfig struct {
+	// Exporter is "otlp-grpc", "otlp-http" or "stdout". The tracing is disabled when empty
+	Exporter string `json:"exporter"`
+	// Endpoint is the address of the collector for the OTLP exporters (e.g. "localhost:4317"). Defaults to the default of the exporter
+	Endpoint string `json:"endpoint"`
+	// Insecure disables TLS towards the collector
+	Insecure bool `json:"insecure"`
+	// SampleRatio is the share of the traces recorded. Defaults to 1 when 0
+	SampleRatio float64 `json:"sampleRatio"`
+	// ServiceName identifies the synchronizer in the traces. Defaults to "hds-data-synchronizer"
+	ServiceName string `json:"serviceName"`
+}
+
+type HealthConfig struct {
+	// Addr is the address of the HTTP server exposing /healthz and /readyz (e.g. ":8080"). Disabled when empty
+	Addr string `json:"addr"`
+	// MinHealthyRatio is the share of the series which must be neither degraded nor stopped for the readiness. Defaults to 0.9 when 0
+	MinHealthyRatio float64 `json:"minHealthyRatio"`
+	// DiscoveryMaxAge is the maximum age of the last successful registry discovery for the readiness (e.g. "5m").
+	// Defaults to three discovery intervals
+	DiscoveryMaxAge string `json:"discoveryMaxAge"`
+	// StallTimeout is the time a registry call of the discovery may hang before the liveness fails (e.g. "5m"). Defaults to "5m"
+	StallTimeout string `json:"stallTimeout"`
+}
+
+type AdminConfig struct {
+	// Addr is the address of the admin API (e.g. ":8090"). Disabled when empty
+	Addr string `json:"addr"`
+	// TLS serves the API with the certificate and the key of the TLS configuration
+	TLS bool `json:"tls"`
+	// ClientAuth requires the clients to present a certificate signed by the CA of the TLS configuration. Implies TLS
+	ClientAuth bool `json:"clientAuth"`
+	// Socket is the path of a Unix socket serving the API to the local clients, such as the status command, without TLS.
+	// Disabled when empty
+	Socket string `json:"socket"`
+}
+
+type ClockSkewConfig struct {
+	// Tolerance is how far ahead of the clock of the host the records are copied as they are (e.g. "1m"). Defaults to "1m"
+	Tolerance string `json:"tolerance"`
+	// Policy applies to the records beyond the tolerance: "hold" keeps them back until the clock catches up, "forward" copies them
+	// as they are and "quarantine" stores them in StateDir instead of the destination. Defaults to "hold"
+	Policy string `json:"policy"`
+}
+
+type ConnectionConfig struct {
+	// KeepaliveTime is the interval of the keepalive pings when the connection is idle (e.g. "5m"). Disabled when empty.
+	// The HDS servers close the connections pinging more often than their enforcement policy permits, by default every 5 minutes
+	KeepaliveTime string `json:"keepaliveTime"`
+	// KeepaliveTimeout is the time to wait for the acknowledgement of a ping before closing the connection (e.g. "20s").
+	// Requires KeepaliveTime
+	KeepaliveTimeout string `json:"keepaliveTimeout"`
+	// StreamIdleTimeout is the time without any message after which a subscription stream is considered stalled (e.g. "10m").
+	// The stream is restarted and the connection is rebuilt if the endpoint does not respond. Disabled when empty
+	StreamIdleTimeout string `json:"streamIdleTimeout"`
+	// ReconnectAfter is the time a connection may stay in failure before it is rebuilt. Defaults to "1m"
+	ReconnectAfter string `json:"reconnectAfter"`
+}
+
+type RetryConfig struct {
+	// InitialBackoff is the delay before the first retry of a series (e.g. "1s"). The delay doubles with every failed attempt
+	InitialBackoff string `json:"initialBackoff"`
+	// MaxBackoff is the maximum delay between the retries of a series (e.g. "5m")
+	MaxBackoff string `json:"maxBackoff"`
+	// BreakerThreshold is the number of consecutive failures after which the circuit breaker of an endpoint opens. Defaults to 10 when 0
+	BreakerThreshold int `json:"breakerThreshold"`
+	// BreakerCooldown is the time the circuit breaker stays open before probing the endpoint again (e.g. "30s")
+	BreakerCooldown string `json:"breakerCooldown"`
+}
+
+type AdaptiveIntervalConfig struct {
+	// Enabled turns on the adaptation. The series start with SyncInterval
+	Enabled bool `json:"enabled"`
+	// Min is the shortest interval, for the series whose synchronizations consistently take longer than the interval (e.g. "10s").
+	// Defaults to a quarter of SyncInterval, or of PeriodicInterval when SyncInterval is 0
+	Min string `json:"min"`
+	// Max is the longest interval, for the series without new data (e.g. "1h"). Defaults to 16 times the same interval
+	Max string `json:"max"`
+}
+
+type PriorityClass struct {
+	// Name of the class. The class named "default" applies to the series without any class
+	Name string `json:"name"`
+	// Priority decides the order of the backfills. Classes with higher priority are served first. A queued backfill gains one level
+	// of priority every 30 seconds it waits, so that the lower classes are not starved
+	Priority int `json:"priority"`
+	// MaxBackfills limits the number of concurrent backfills of the class. Unlimited when 0
+	MaxBackfills int `json:"maxBackfills"`
+	// RecordsPerSecond limits the throughput of the backfills of the class. Unlimited when 0
+	RecordsPerSecond int `json:"recordsPerSecond"`
+}
+
+type SeriesConfig struct {
+	// Match is a pattern matched against the series name, with the syntax of path.Match (e.g. "alarms/*")
+	Match string `json:"match"`
+	// Schedule overrides the global schedule for the matching series. "always" disables the restriction
+	Schedule string `json:"schedule"`
+	// Priority is the name of the priority class of the matching series. It takes precedence over the registry meta
+	Priority string `json:"priority"`
+	// Mode is "live" or "periodic". It takes precedence over the registry meta. The mode follows SyncInterval when empty
+	Mode string `json:"mode"`
+	// Interval overrides the interval of the matching series in periodic mode (e.g. "10m")
+	Interval string `json:"interval"`
 }
 
 type TLSConfig struct {
@@ -65,5 +318,28 @@ func LoadConfig(confPath *string) (*Config, error) {
 		return nil, fmt.Errorf("missing schema or hostname from HDS destination")
 	}
 
+	classes := make(map[string]bool)
+	for _, class := range conf.PriorityClasses {
+		if class.Name == "" {
+			return nil, fmt.Errorf("priority classes should have a name")
+		}
+		if classes[class.Name] {
+			return nil, fmt.Errorf("duplicate priority class %s", class.Name)
+		}
+		classes[class.Name] = true
+	}
+
+	for _, series := range conf.Series {
+		if _, err := path.Match(series.Match, ""); err != nil {
+			return nil, fmt.Errorf("invalid series pattern %q: %v", series.Match, err)
+		}
+		if series.Mode != "" && series.Mode != "live" && series.Mode != "periodic" {
+			return nil, fmt.Errorf("invalid mode %q for series %s", series.Mode, series.Match)
+		}
+		if series.Priority != "" && series.Priority != "default" && !classes[series.Priority] {
+			return nil, fmt.Errorf("unknown priority class %s for series %s", series.Priority, series.Match)
+		}
+	}
+
 	return &conf, nil
 }
@@ -0,0 +1,234 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+const (
+	LogFormatLogfmt = "logfmt"
+	LogFormatJSON   = "json"
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// ParseLevel parses the name of a level: debug, info, warn or error
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %s", s)
+}
+
+// logSink writes the entries of all the loggers derived from the same root
+type logSink struct {
+	sync.Mutex
+	out    io.Writer
+	level  Level
+	format string
+	// time adds the time of the entries, and caller the file and line of the call
+	time   bool
+	caller bool
+}
+
+// Logger writes leveled entries, in logfmt or JSON, carrying a set of fields. It is safe for concurrent use
+type Logger struct {
+	sink *logSink
+	// fields are the key and value pairs added to every entry
+	fields []interface{}
+}
+
+// Log is the root logger of the application
+var Log = &Logger{sink: &logSink{out: os.Stdout, level: LevelInfo, format: LogFormatLogfmt, time: true}}
+
+// ConfigureLogging sets the level and the format of the root logger and of all the loggers derived from it
+func ConfigureLogging(conf LogConfig) error {
+	level, err := ParseLevel(conf.Level)
+	if err != nil {
+		return err
+	}
+	format := strings.ToLower(conf.Format)
+	switch format {
+	case "":
+		format = LogFormatLogfmt
+	case LogFormatLogfmt, LogFormatJSON:
+	default:
+		return fmt.Errorf("unknown log format %s", conf.Format)
+	}
+	Log.sink.Lock()
+	defer Log.sink.Unlock()
+	Log.sink.level = level
+	Log.sink.format = format
+	return nil
+}
+
+// SetLogFlags enables the time of the entries and the location of the calls
+func SetLogFlags(time, caller bool) {
+	Log.sink.Lock()
+	defer Log.sink.Unlock()
+	Log.sink.time = time
+	Log.sink.caller = caller
+}
+
+// With returns a logger adding the given key and value pairs to the fields of l
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	return &Logger{sink: l.sink, fields: fields}
+}
+
+// Enabled tells whether the entries of the level are written
+func (l *Logger) Enabled(level Level) bool {
+	l.sink.Lock()
+	defer l.sink.Unlock()
+	return level >= l.sink.level
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(LevelDebug, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(LevelInfo, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(LevelWarn, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(LevelError, format, args...)
+}
+
+// Fatalf writes an error entry and exits
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.logf(LevelError, format, args...)
+	os.Exit(1)
+}
+
+// Writer returns a writer logging every line at the given level, e.g. for the standard logger
+func (l *Logger) Writer(level Level) io.Writer {
+	return &lineWriter{logger: l, level: level}
+}
+
+type lineWriter struct {
+	logger *Logger
+	level  Level
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.logger.logf(w.level, "%s", line)
+	}
+	return len(p), nil
+}
+
+// logf formats the message only if the level is enabled, so that the debug entries cost little otherwise
+func (l *Logger) logf(level Level, format string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	l.write(level, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) write(level Level, msg string) {
+	l.sink.Lock()
+	defer l.sink.Unlock()
+	keyvals := make([]interface{}, 0, len(l.fields)+8)
+	if l.sink.time {
+		keyvals = append(keyvals, "time", time.Now().Format(time.RFC3339Nano))
+	}
+	keyvals = append(keyvals, "level", level.String())
+	if l.sink.caller {
+		// skip write, logf and the logging method
+		if _, file, line, ok := runtime.Caller(3); ok {
+			keyvals = append(keyvals, "caller", filepath.Base(file)+":"+strconv.Itoa(line))
+		}
+	}
+	keyvals = append(keyvals, "msg", msg)
+	keyvals = append(keyvals, l.fields...)
+
+	var buf bytes.Buffer
+	if l.sink.format == LogFormatJSON {
+		encodeJSON(&buf, keyvals)
+	} else {
+		encodeLogfmt(&buf, keyvals)
+	}
+	buf.WriteByte('\n')
+	l.sink.out.Write(buf.Bytes())
+}
+
+func encodeLogfmt(buf *bytes.Buffer, keyvals []interface{}) {
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(fmt.Sprint(keyvals[i]))
+		buf.WriteByte('=')
+		value := fmt.Sprint(keyvals[i+1])
+		if value == "" || strings.ContainsAny(value, " =\"\\\t\n") {
+			value = strconv.Quote(value)
+		}
+		buf.WriteString(value)
+	}
+}
+
+func encodeJSON(buf *bytes.Buffer, keyvals []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(keyvals[i]))
+		buf.Write(key)
+		buf.WriteByte(':')
+		var value interface{}
+		switch v := keyvals[i+1].(type) {
+		case bool, int, int64, float64:
+			value = v
+		default:
+			value = fmt.Sprint(v)
+		}
+		b, _ := json.Marshal(value)
+		buf.Write(b)
+	}
+	buf.WriteByte('}')
+}
@@ -0,0 +1,89 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLogger(format string) (*Logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	return &Logger{sink: &logSink{out: &buf, level: LevelInfo, format: format}}, &buf
+}
+
+func TestLogfmt(t *testing.T) {
+	logger, buf := newTestLogger(LogFormatLogfmt)
+	series := logger.With("series", "building/room 1", "count", 3)
+	series.Infof("copied %d records", 3)
+	series.With("error", `say "hi"`, "empty", "").Warnf("a=b")
+	logger.Debugf("not written")
+	logger.Writer(LevelError).Write([]byte("first\nsecond\n"))
+
+	want := []string{
+		`level=info msg="copied 3 records" series="building/room 1" count=3`,
+		`level=warn msg="a=b" series="building/room 1" count=3 error="say \"hi\"" empty=""`,
+		`level=error msg=first`,
+		`level=error msg=second`,
+	}
+	if got := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("expected\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	logger, buf := newTestLogger(LogFormatJSON)
+	logger.sink.time, logger.sink.caller = true, true
+	logger.With("series", "a", "count", 3, "live", true, "lag", time.Second).Errorf("failed: %s", "timeout")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expected a JSON entry, got %s: %v", buf.String(), err)
+	}
+	want := map[string]interface{}{"level": "error", "msg": "failed: timeout", "series": "a", "count": 3.0, "live": true, "lag": "1s"}
+	for key, value := range want {
+		if entry[key] != value {
+			t.Fatalf("expected %s to be %v, got %v", key, value, entry[key])
+		}
+	}
+	if _, err := time.Parse(time.RFC3339Nano, entry["time"].(string)); err != nil {
+		t.Fatalf("expected the time of the entry, got %v", entry["time"])
+	}
+	// the caller is the call of the logging method, not the logger itself
+	if caller, _ := entry["caller"].(string); !strings.HasPrefix(caller, "logger_test.go:") {
+		t.Fatalf("expected the caller in the test, got %v", entry["caller"])
+	}
+}
+
+func TestWithKeepsParentFields(t *testing.T) {
+	logger, buf := newTestLogger(LogFormatLogfmt)
+	parent := logger.With("pipeline", "live")
+	parent.With("series", "a")
+	parent.With("series", "b").Infof("child")
+	parent.Infof("parent")
+	want := "level=info msg=child pipeline=live series=b\nlevel=info msg=parent pipeline=live\n"
+	if buf.String() != want {
+		t.Fatalf("expected\n%s\ngot\n%s", want, buf.String())
+	}
+}
+
+func TestConfigureLogging(t *testing.T) {
+	defer func(level Level, format string) {
+		Log.sink.level, Log.sink.format = level, format
+	}(Log.sink.level, Log.sink.format)
+
+	if err := ConfigureLogging(LogConfig{Level: "warning", Format: "JSON"}); err != nil {
+		t.Fatal(err)
+	}
+	// the loggers derived before share the configuration
+	derived := Log.With("series", "a")
+	if derived.Enabled(LevelInfo) || !derived.Enabled(LevelWarn) || derived.sink.format != LogFormatJSON {
+		t.Fatalf("expected the derived logger to write warnings in JSON")
+	}
+	for _, conf := range []LogConfig{{Level: "verbose"}, {Format: "xml"}} {
+		if err := ConfigureLogging(conf); err == nil {
+			t.Fatalf("expected an error for %+v", conf)
+		}
+	}
+}
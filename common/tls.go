@@ -0,0 +1,37 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// KeyPair loads the certificate and the private key
+func (t TLSConfig) KeyPair() (tls.Certificate, error) {
+	certificate, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("could not load client key pair: %s", err)
+	}
+	return certificate, nil
+}
+
+// CertPool returns a pool holding the certificate of the CA. The pool extends the system pool when system is set
+func (t TLSConfig) CertPool(system bool) (*x509.CertPool, error) {
+	var certPool *x509.CertPool
+	if system {
+		// continue with an empty pool on error
+		certPool, _ = x509.SystemCertPool()
+	}
+	if certPool == nil {
+		certPool = x509.NewCertPool()
+	}
+	ca, err := ioutil.ReadFile(t.CA)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CA certificate: %s", err)
+	}
+	if ok := certPool.AppendCertsFromPEM(ca); !ok {
+		return nil, fmt.Errorf("failed to append client certs")
+	}
+	return certPool, nil
+}
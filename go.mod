@@ -3,17 +3,21 @@ module github.com/linksmart/hds-data-synchronizer
 go 1.16
 
 require (
-	github.com/farshidtz/senml-protobuf/go v0.0.0-20200511123537-7fed769c3279 // indirect
+	github.com/farshidtz/senml-protobuf/go v0.0.0-20200511123537-7fed769c3279
 	github.com/farshidtz/senml/v2 v2.0.1-0.20200510133550-09f0cc3f0378
-	github.com/golang/protobuf v1.4.2 // indirect
 	github.com/golang/snappy v0.0.2 // indirect
-	github.com/gorilla/mux v1.8.0 // indirect
+	github.com/gorilla/mux v1.8.0
 	github.com/kelseyhightower/envconfig v1.4.0
 	github.com/linksmart/historical-datastore v1.0.0-beta.11.0.20210326132732-1687cc947416
-	golang.org/x/net v0.0.0-20201010224723-4f7140c49acb // indirect
-	golang.org/x/sync v0.0.0-20200625203802-6e8e738ad208 // indirect
-	golang.org/x/sys v0.0.0-20201013081832-0aaa2718063a // indirect
+	github.com/prometheus/client_golang v1.11.1
+	github.com/prometheus/client_model v0.2.0
+	github.com/prometheus/common v0.26.0
+	go.opentelemetry.io/otel v1.3.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc v1.3.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.3.0
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.3.0
+	go.opentelemetry.io/otel/sdk v1.3.0
+	go.opentelemetry.io/otel/trace v1.3.0
 	google.golang.org/genproto v0.0.0-20201012135029-0c95dc0d88e8 // indirect
-	google.golang.org/grpc v1.33.0
-	google.golang.org/protobuf v1.25.0 // indirect
+	google.golang.org/grpc v1.42.0
 )
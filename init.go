@@ -4,9 +4,9 @@ package main
 
 import (
 	"log"
-	"os"
 
-	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/hds-data-synchronizer/common"
+	hdscommon "github.com/linksmart/historical-datastore/common"
 )
 
 const (
@@ -15,15 +15,8 @@ const (
 )
 
 func init() {
-	log.SetOutput(os.Stdout)
+	common.SetLogFlags(!hdscommon.EvalEnv(EnvDisableLogTime), hdscommon.EvalEnv(EnvVerbose))
+	// the logs of the libraries go through the structured logger
 	log.SetFlags(0)
-
-	logFlags := log.LstdFlags
-	if common.EvalEnv(EnvDisableLogTime) {
-		logFlags = 0
-	}
-	if common.EvalEnv(EnvVerbose) {
-		logFlags = logFlags | log.Lshortfile
-	}
-	log.SetFlags(logFlags)
+	log.SetOutput(common.Log.Writer(common.LevelInfo))
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/linksmart/hds-data-synchronizer/common"
+	sync "github.com/linksmart/hds-data-synchronizer/synchronizer"
+)
+
+// journalCommand exports the entries of the audit journal matching the flags as JSON lines. It returns the exit code
+func journalCommand(args []string) int {
+	flags := flag.NewFlagSet("journal", flag.ExitOnError)
+	var (
+		confPath = flags.String("conf", "conf/conf.json", "HDS Sync configuration file path, giving the journal path")
+		file     = flags.String("file", "", "Journal file path. Takes precedence over the configuration")
+		series   = flags.String("series", "", "Series name, or pattern such as \"alarms/*\"")
+		from     = flags.String("from", "", "Start of the time range, RFC3339")
+		to       = flags.String("to", "", "End of the time range, RFC3339")
+		out      = flags.String("out", "", "Export file. Defaults to the standard output")
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s journal [flags]\n\nExports the audit journal entries overlapping the time range as JSON lines.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	err := exportJournal(*confPath, *file, *series, *from, *to, *out)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "journal: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func exportJournal(confPath, file, series, from, to, out string) error {
+	if file == "" {
+		conf, err := common.LoadConfig(&confPath)
+		if err != nil {
+			return fmt.Errorf("cannot load configuration: %w", err)
+		}
+		if conf.Journal.Path == "" {
+			return fmt.Errorf("the journal is not enabled in %s", confPath)
+		}
+		file = conf.Journal.Path
+	}
+	query := sync.JournalQuery{Series: series}
+	var err error
+	if from != "" {
+		query.From, err = time.Parse(time.RFC3339, from)
+		if err != nil {
+			return fmt.Errorf("invalid from: %w", err)
+		}
+	}
+	if to != "" {
+		query.To, err = time.Parse(time.RFC3339, to)
+		if err != nil {
+			return fmt.Errorf("invalid to: %w", err)
+		}
+	}
+
+	r, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if out == "" {
+		return sync.QueryJournal(r, os.Stdout, query)
+	}
+	w, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	err = sync.QueryJournal(r, w, query)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
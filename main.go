@@ -2,10 +2,12 @@ package main
 
 import (
 	"flag"
-	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 
+	"github.com/linksmart/hds-data-synchronizer/admin"
 	"github.com/linksmart/hds-data-synchronizer/common"
 	sync "github.com/linksmart/hds-data-synchronizer/synchronizer"
 )
@@ -26,27 +28,112 @@ func main() {
 	var (
 		confPath = flag.String("conf", "conf/conf.json", "HDS Sync configuration file path")
 	)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "journal":
+			os.Exit(journalCommand(os.Args[2:]))
+		case "status":
+			os.Exit(statusCommand(os.Args[2:]))
+		}
+	}
 	flag.Parse()
 
 	conf, err := common.LoadConfig(confPath)
 	if err != nil {
-		log.Panicf("Cannot load configuration: %v", err)
+		common.Log.Fatalf("Cannot load configuration: %v", err)
+	}
+	err = common.ConfigureLogging(conf.Log)
+	if err != nil {
+		common.Log.Fatalf("Cannot configure logging: %v", err)
 	}
 
-	log.Println("starting synchronization")
+	common.Log.Infof("starting synchronization")
 	syncController, err := sync.NewController(conf)
 	if err != nil {
-		log.Panicf("Error initializing synchronization: %s", err)
+		common.Log.Fatalf("Error initializing synchronization: %s", err)
 	}
 
 	syncController.StartSyncForAll()
 
+	var metricsServer *http.Server
+	if conf.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", syncController.MetricsHandler())
+		metricsServer = &http.Server{Addr: conf.MetricsAddr, Handler: mux}
+		go func() {
+			common.Log.Infof("serving metrics on %s", conf.MetricsAddr)
+			err := metricsServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				common.Log.Fatalf("Error serving metrics: %s", err)
+			}
+		}()
+	}
+
+	var healthServer *http.Server
+	if conf.Health.Addr != "" {
+		healthServer = &http.Server{Addr: conf.Health.Addr, Handler: syncController.HealthHandler()}
+		go func() {
+			common.Log.Infof("serving health checks on %s", conf.Health.Addr)
+			err := healthServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				common.Log.Fatalf("Error serving health checks: %s", err)
+			}
+		}()
+	}
+
+	var adminServer *http.Server
+	if conf.Admin.Addr != "" {
+		adminServer, err = admin.NewServer(conf, syncController)
+		if err != nil {
+			common.Log.Fatalf("Error initializing admin API: %s", err)
+		}
+		go func() {
+			common.Log.Infof("serving admin API on %s", conf.Admin.Addr)
+			err := admin.ListenAndServe(adminServer)
+			if err != nil && err != http.ErrServerClosed {
+				common.Log.Fatalf("Error serving admin API: %s", err)
+			}
+		}()
+	}
+
+	var socketServer *http.Server
+	if conf.Admin.Socket != "" {
+		listener, err := admin.ListenSocket(conf.Admin.Socket)
+		if err != nil {
+			common.Log.Fatalf("Error initializing admin socket: %s", err)
+		}
+		socketServer = &http.Server{Handler: admin.NewAPI(syncController).Handler()}
+		go func() {
+			common.Log.Infof("serving admin API on %s", conf.Admin.Socket)
+			err := socketServer.Serve(listener)
+			if err != nil && err != http.ErrServerClosed {
+				common.Log.Fatalf("Error serving admin API: %s", err)
+			}
+		}()
+	}
+
 	handler := make(chan os.Signal, 1)
 	// Ctrl+C / Kill handling
-	signal.Notify(handler, os.Interrupt, os.Kill)
+	signal.Notify(handler, os.Interrupt, syscall.SIGTERM)
 	<-handler
-	log.Println("Shutting down...")
-	syncController.StopSyncForAll()
-	log.Println("Stopped.")
+	common.Log.Infof("Shutting down...")
+	report := syncController.Shutdown()
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
+	if adminServer != nil {
+		adminServer.Close()
+	}
+	if socketServer != nil {
+		socketServer.Close()
+	}
+	if healthServer != nil {
+		healthServer.Close()
+	}
+	if len(report.Unflushed) > 0 || len(report.Interrupted) > 0 || len(report.Running) > 0 {
+		common.Log.Warnf("Stopped. Some data could not be flushed.")
+		return
+	}
+	common.Log.Infof("Stopped.")
 
 }
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/linksmart/hds-data-synchronizer/common"
+	sync "github.com/linksmart/hds-data-synchronizer/synchronizer"
+)
+
+// maxErrorWidth truncates the last errors in the table
+const maxErrorWidth = 80
+
+// statusCommand prints the status of the synchronizations of a running instance, queried over its admin API. It returns the exit code
+func statusCommand(args []string) int {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	var (
+		confPath = flags.String("conf", "conf/conf.json", "HDS Sync configuration file path, giving the admin socket or address")
+		addr     = flags.String("addr", "", "Admin API: Unix socket path or URL such as https://localhost:8090. Takes precedence over the configuration")
+		sortBy   = flags.String("sort", "series", "Sort column: series, mode, state, source, destination, lag or error. The lag and the error sort the largest and the latest first")
+		reverse  = flags.Bool("reverse", false, "Reverse the order")
+		series   = flags.String("series", "", "Only the series matching a pattern such as \"alarms/*\"")
+		state    = flags.String("state", "", "Only the series in a lifecycle stage, e.g. degraded")
+		mode     = flags.String("mode", "", "Only the series in a mode: live or periodic")
+		watch    = flags.Bool("watch", false, "Refresh continuously")
+		interval = flags.Duration("interval", 2*time.Second, "Refresh interval with -watch")
+		jsonOut  = flags.Bool("json", false, "Print JSON, one array per refresh")
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s status [flags]\n\nPrints the replication status of the series of a running instance.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	less, ok := statusOrder[*sortBy]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "status: unknown sort column %s\n", *sortBy)
+		return 2
+	}
+	if _, err := path.Match(*series, ""); err != nil {
+		fmt.Fprintf(os.Stderr, "status: invalid series pattern %q: %v\n", *series, err)
+		return 2
+	}
+	client, err := newStatusClient(*confPath, *addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "status: %v\n", err)
+		return 1
+	}
+	filter := func(s sync.SeriesStatus) bool {
+		if ok, _ := path.Match(*series, s.Series); *series != "" && !ok {
+			return false
+		}
+		return (*state == "" || string(s.Lifecycle.Stage) == *state) && (*mode == "" || s.Mode == *mode)
+	}
+
+	for {
+		list, err := client.list()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "status: %v\n", err)
+			if !*watch {
+				return 1
+			}
+		} else {
+			selected := list[:0]
+			for _, s := range list {
+				if filter(s) {
+					selected = append(selected, s)
+				}
+			}
+			sort.SliceStable(selected, func(i, j int) bool {
+				if *reverse {
+					return less(selected[j], selected[i])
+				}
+				return less(selected[i], selected[j])
+			})
+			if *jsonOut {
+				err = json.NewEncoder(os.Stdout).Encode(selected)
+			} else {
+				if *watch {
+					// clear the terminal
+					fmt.Print("\033[H\033[2J")
+					fmt.Printf("Every %v: %s  %s\n\n", *interval, client.target, time.Now().Format(time.RFC3339))
+				}
+				err = writeStatusTable(os.Stdout, selected)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "status: %v\n", err)
+				return 1
+			}
+		}
+		if !*watch {
+			return 0
+		}
+		time.Sleep(*interval)
+	}
+}
+
+// statusOrder contains the comparisons of the sort columns. The lag and the error sort the largest and the latest first
+var statusOrder = map[string]func(a, b sync.SeriesStatus) bool{
+	"series": func(a, b sync.SeriesStatus) bool { return a.Series < b.Series },
+	"mode":   func(a, b sync.SeriesStatus) bool { return a.Mode < b.Mode },
+	"state":  func(a, b sync.SeriesStatus) bool { return a.Lifecycle.Stage < b.Lifecycle.Stage },
+	"source": func(a, b sync.SeriesStatus) bool { return a.SourceLatest.Before(b.SourceLatest) },
+	"destination": func(a, b sync.SeriesStatus) bool {
+		return a.DestinationLatest.Before(b.DestinationLatest)
+	},
+	"lag": func(a, b sync.SeriesStatus) bool { return a.Lag > b.Lag },
+	"error": func(a, b sync.SeriesStatus) bool {
+		return lastErrorTime(a).After(lastErrorTime(b))
+	},
+}
+
+func lastErrorTime(s sync.SeriesStatus) time.Time {
+	if s.LastError == nil {
+		return time.Time{}
+	}
+	return s.LastError.Time
+}
+
+func writeStatusTable(w io.Writer, list []sync.SeriesStatus) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERIES\tMODE\tSTATE\tSOURCE LATEST\tDESTINATION LATEST\tLAG\tLAST ERROR")
+	for _, s := range list {
+		lastError := "-"
+		if s.LastError != nil {
+			lastError = s.LastError.Time.Format(time.RFC3339) + " " + strings.ReplaceAll(s.LastError.Message, "\n", " ")
+			if r := []rune(lastError); len(r) > maxErrorWidth {
+				lastError = string(r[:maxErrorWidth-3]) + "..."
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%v\t%s\n", s.Series, s.Mode, s.Lifecycle.Stage,
+			formatLatest(s.SourceLatest), formatLatest(s.DestinationLatest), s.Lag.Round(time.Millisecond), lastError)
+	}
+	return tw.Flush()
+}
+
+func formatLatest(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// statusClient queries the admin API of a running instance
+type statusClient struct {
+	client *http.Client
+	// base is the URL of the API, and target describes it to the user
+	base   string
+	target string
+}
+
+// newStatusClient connects to the given address, or else to the admin socket or the admin address of the configuration
+func newStatusClient(confPath, addr string) (*statusClient, error) {
+	var conf *common.Config
+	if addr == "" || strings.HasPrefix(addr, "https://") {
+		var err error
+		conf, err = common.LoadConfig(&confPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load configuration: %w", err)
+		}
+	}
+	if addr == "" {
+		switch {
+		case conf.Admin.Socket != "":
+			addr = conf.Admin.Socket
+		case conf.Admin.Addr != "":
+			host, port, err := net.SplitHostPort(conf.Admin.Addr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid admin address %s: %w", conf.Admin.Addr, err)
+			}
+			if host == "" {
+				host = "localhost"
+			}
+			scheme := "http"
+			if conf.Admin.TLS || conf.Admin.ClientAuth {
+				scheme = "https"
+			}
+			addr = scheme + "://" + net.JoinHostPort(host, port)
+		default:
+			return nil, fmt.Errorf("the admin API is not enabled in %s", confPath)
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(addr, "http://"):
+		return &statusClient{client: &http.Client{Timeout: 10 * time.Second}, base: strings.TrimSuffix(addr, "/"), target: addr}, nil
+	case strings.HasPrefix(addr, "https://"):
+		// the client presents the certificate of the configuration, in case the API requires it
+		certificate, err := conf.TLS.KeyPair()
+		if err != nil {
+			return nil, err
+		}
+		pool, err := conf.TLS.CertPool(true)
+		if err != nil {
+			return nil, err
+		}
+		transport := &http.Transport{TLSClientConfig: &tls.Config{Certificates: []tls.Certificate{certificate}, RootCAs: pool}}
+		return &statusClient{client: &http.Client{Transport: transport, Timeout: 10 * time.Second}, base: strings.TrimSuffix(addr, "/"), target: addr}, nil
+	default:
+		socket := addr
+		transport := &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		}}
+		return &statusClient{client: &http.Client{Transport: transport, Timeout: 10 * time.Second}, base: "http://localhost", target: socket}, nil
+	}
+}
+
+func (c *statusClient) list() ([]sync.SeriesStatus, error) {
+	res, err := c.client.Get(c.base + "/series")
+	if err != nil {
+		return nil, fmt.Errorf("error querying %s: %w", c.target, err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the response of %s: %w", c.target, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error querying %s: %s: %s", c.target, res.Status, body)
+	}
+	var list []sync.SeriesStatus
+	err = json.Unmarshal(body, &list)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding the response of %s: %w", c.target, err)
+	}
+	return list, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	sync "github.com/linksmart/hds-data-synchronizer/synchronizer"
+)
+
+func TestWriteStatusTable(t *testing.T) {
+	errTime := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	list := []sync.SeriesStatus{
+		{Series: "a", Mode: "live"},
+		{Series: "b", Mode: "live", LastError: &sync.SeriesError{Time: errTime, Message: "näyttö\n" + strings.Repeat("ä", 100)}},
+		{Series: "c", Mode: "periodic", LastError: &sync.SeriesError{Time: errTime, Message: "timeout"}},
+	}
+	var buf bytes.Buffer
+	if err := writeStatusTable(&buf, list); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected a header and 3 rows, got\n%s", buf.String())
+	}
+	if !strings.HasSuffix(lines[1], " -") {
+		t.Fatalf("expected no error for a, got %q", lines[1])
+	}
+
+	// the long errors are truncated to the width of the column without splitting the characters
+	i := strings.Index(lines[2], "2021-01-01T00:00:00Z")
+	if i < 0 {
+		t.Fatalf("expected the time of the error of b, got %q", lines[2])
+	}
+	lastError := lines[2][i:]
+	if !utf8.ValidString(lastError) {
+		t.Fatalf("expected a valid error, got %q", lastError)
+	}
+	if n := utf8.RuneCountInString(lastError); n != maxErrorWidth || !strings.HasSuffix(lastError, "ää...") {
+		t.Fatalf("expected the error truncated to %d characters, got %d: %q", maxErrorWidth, n, lastError)
+	}
+	if !strings.Contains(lastError, "näyttö ä") {
+		t.Fatalf("expected the lines of the error joined, got %q", lastError)
+	}
+	if !strings.HasSuffix(lines[3], "2021-01-01T00:00:00Z timeout") {
+		t.Fatalf("expected the short error of c in full, got %q", lines[3])
+	}
+}
@@ -0,0 +1,59 @@
+package sync
+
+import "time"
+
+// backlogStreak is the number of consecutive synchronizations with or without a backlog after which the interval is changed
+const backlogStreak = 3
+
+// adaptiveInterval adjusts the interval of a periodic synchronization to the data rate of the series. The interval doubles after
+// every synchronization without new data, up to max. It returns to base as soon as new data is found. A synchronization has a backlog
+// when it takes longer than the interval: the records written at the source meanwhile are left to the next one, which then has more to
+// copy. The interval halves when the series consistently has a backlog, down to min, and doubles back to base when the series
+// consistently keeps up.
+type adaptiveInterval struct {
+	min, base, max time.Duration
+	// backlogs is the number of consecutive synchronizations with a backlog, and caughtUp the number of those without
+	backlogs, caughtUp int
+}
+
+// next returns the interval following a synchronization, given the current interval and the duration of the synchronization
+func (a *adaptiveInterval) next(current time.Duration, newData bool, duration time.Duration) time.Duration {
+	if !newData {
+		a.backlogs, a.caughtUp = 0, 0
+		current *= 2
+		if current > a.max {
+			current = a.max
+		}
+		return current
+	}
+	if current > a.base {
+		// the series woke up
+		a.backlogs, a.caughtUp = 0, 0
+		return a.base
+	}
+	if duration <= current {
+		a.backlogs = 0
+		if current == a.base {
+			return current
+		}
+		a.caughtUp++
+		if a.caughtUp >= backlogStreak {
+			a.caughtUp = 0
+			current *= 2
+			if current > a.base {
+				current = a.base
+			}
+		}
+		return current
+	}
+	a.caughtUp = 0
+	a.backlogs++
+	if a.backlogs >= backlogStreak {
+		a.backlogs = 0
+		current /= 2
+		if current < a.min {
+			current = a.min
+		}
+	}
+	return current
+}
@@ -0,0 +1,66 @@
+package sync
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdaptiveInterval(t *testing.T) {
+	// round is a synchronization finding new data or not, and its duration
+	type round struct {
+		newData  bool
+		duration time.Duration
+	}
+	steady := round{true, time.Second}
+	backlog := round{true, 2 * time.Minute}
+	idle := round{false, 0}
+	tests := []struct {
+		name  string
+		syncs []round
+		want  []time.Duration
+	}{
+		{
+			name:  "steady series keeps the base interval",
+			syncs: []round{steady, steady, steady, steady, steady},
+			want:  []time.Duration{time.Minute, time.Minute, time.Minute, time.Minute, time.Minute},
+		},
+		{
+			name:  "idle series backs off up to max",
+			syncs: []round{idle, idle, idle, idle, idle},
+			want:  []time.Duration{2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 16 * time.Minute, 16 * time.Minute},
+		},
+		{
+			name:  "idle series wakes up",
+			syncs: []round{idle, idle, steady},
+			want:  []time.Duration{2 * time.Minute, 4 * time.Minute, time.Minute},
+		},
+		{
+			name:  "consistent backlog shortens down to min",
+			syncs: []round{backlog, backlog, backlog, backlog, backlog, backlog, backlog, backlog, backlog},
+			want: []time.Duration{time.Minute, time.Minute, 30 * time.Second, 30 * time.Second, 30 * time.Second, 15 * time.Second,
+				15 * time.Second, 15 * time.Second, 15 * time.Second},
+		},
+		{
+			name:  "occasional backlog is ignored",
+			syncs: []round{backlog, backlog, steady, backlog, backlog, steady},
+			want:  []time.Duration{time.Minute, time.Minute, time.Minute, time.Minute, time.Minute, time.Minute},
+		},
+		{
+			name:  "series keeping up again returns to base",
+			syncs: []round{backlog, backlog, backlog, steady, steady, steady},
+			want:  []time.Duration{time.Minute, time.Minute, 30 * time.Second, 30 * time.Second, 30 * time.Second, time.Minute},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := &adaptiveInterval{min: 15 * time.Second, base: time.Minute, max: 16 * time.Minute}
+			interval := a.base
+			for i, s := range test.syncs {
+				interval = a.next(interval, s.newData, s.duration)
+				if interval != test.want[i] {
+					t.Fatalf("synchronization %d: expected %v, got %v", i, test.want[i], interval)
+				}
+			}
+		})
+	}
+}
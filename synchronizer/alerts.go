@@ -0,0 +1,502 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/linksmart/hds-data-synchronizer/common"
+)
+
+// the kinds of the alert rules
+const (
+	AlertLag      = "lag"
+	AlertErrors   = "errors"
+	AlertBackfill = "backfill"
+	AlertAdded    = "added"
+	AlertRemoved  = "removed"
+)
+
+// the statuses of the notifications
+const (
+	// AlertFiring is notified when the condition of a rule starts to hold, and again every repeat interval
+	AlertFiring = "firing"
+	// AlertResolved is notified when the condition of a firing alert does not hold anymore
+	AlertResolved = "resolved"
+	// AlertEvent is notified once for the series added and removed, which are not resolved
+	AlertEvent = "event"
+)
+
+const (
+	defaultAlertInterval  = 30 * time.Second
+	defaultAlertRateLimit = 60
+	defaultWebhookTimeout = 10 * time.Second
+	// webhookAttempts is the number of attempts to deliver a notification to a webhook
+	webhookAttempts = 3
+	// alertQueueSize bounds the notifications waiting for the webhooks
+	alertQueueSize = 256
+)
+
+// Alert is the JSON payload posted to the webhooks
+type Alert struct {
+	Rule        string `json:"rule"`
+	Kind        string `json:"kind"`
+	Severity    string `json:"severity,omitempty"`
+	Status      string `json:"status"`
+	Series      string `json:"series"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Message     string `json:"message"`
+	// StartsAt is when the condition was first detected, and EndsAt when it was resolved
+	StartsAt time.Time  `json:"startsAt"`
+	EndsAt   *time.Time `json:"endsAt,omitempty"`
+}
+
+// alertRule holds the parsed settings of a common.AlertRule
+type alertRule struct {
+	name     string
+	kind     string
+	match    string
+	severity string
+	// threshold is the lag or the duration of the backfill alerted
+	threshold time.Duration
+	// errors is the number of consecutive failures alerted
+	errors int
+}
+
+func (r *alertRule) matches(series string) bool {
+	if r.match == "" {
+		return true
+	}
+	ok, _ := path.Match(r.match, series)
+	return ok
+}
+
+// alertLag returns the lag of the series, or the time since it was last live if longer. The latest records known are not
+// updated while the synchronization fails, e.g. when the source is unreachable, so that their lag alone would not grow
+func alertLag(status SeriesStatus, now time.Time) time.Duration {
+	lag := status.Lag
+	if !status.LastLive.IsZero() && now.Sub(status.LastLive) > lag {
+		lag = now.Sub(status.LastLive)
+	}
+	return lag
+}
+
+// check tells whether the condition of the rule holds for the series, and describes it
+func (r *alertRule) check(status SeriesStatus, now time.Time) (bool, string) {
+	switch r.kind {
+	case AlertLag:
+		if lag := alertLag(status, now); lag > r.threshold {
+			return true, fmt.Sprintf("lag of %v exceeds %v", lag.Round(time.Second), r.threshold)
+		}
+	case AlertErrors:
+		if status.ErrorStreak >= r.errors {
+			message := fmt.Sprintf("%d consecutive failures", status.ErrorStreak)
+			if status.LastError != nil {
+				message += ": " + status.LastError.Message
+			}
+			return true, message
+		}
+	case AlertBackfill:
+		if status.Lifecycle.Stage == LifecycleBackfilling && now.Sub(status.Lifecycle.Since) > r.threshold {
+			return true, fmt.Sprintf("backfilling for %v", now.Sub(status.Lifecycle.Since).Round(time.Second))
+		}
+	}
+	return false, ""
+}
+
+// activeAlert is an alert whose condition holds
+type activeAlert struct {
+	alert Alert
+	// notified is when the alert was last notified as firing. Zero while postponed by the rate limit
+	notified time.Time
+	// seen is set when the condition holds at the current evaluation
+	seen bool
+}
+
+type webhook struct {
+	url string
+	// redacted is the URL without the parts which may hold credentials, for the logs
+	redacted string
+	headers  map[string]string
+	client   *http.Client
+}
+
+// redactURL returns the scheme and the host of the URL. The user information, the path and the query may hold credentials,
+// and are replaced by a placeholder
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return "<redacted>"
+	}
+	redacted := u.Scheme + "://" + u.Host
+	if u.User != nil || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		redacted += "/<redacted>"
+	}
+	return redacted
+}
+
+// alerter evaluates the alert rules periodically and notifies the webhooks of the changes. A nil alerter notifies nothing
+type alerter struct {
+	rules    []alertRule
+	webhooks []webhook
+	interval time.Duration
+	// repeat is the interval of the notifications of the alerts still firing. Notified once when 0
+	repeat time.Duration
+	// rateLimit is the maximum number of notifications per minute, and sent holds the times of the notifications of the last minute
+	rateLimit int
+	sent      []time.Time
+	// active contains the alerts whose condition holds, by rule and series. Only used by the evaluation goroutine
+	active      map[string]*activeAlert
+	source      string
+	destination string
+	log         *common.Logger
+
+	// mutex guards pending
+	mutex sync.Mutex
+	// pending are the events and the resolutions waiting for the rate limit
+	pending []Alert
+	// queue holds the notifications waiting to be posted, so that slow webhooks do not delay the evaluations
+	queue chan Alert
+	// running tracks the evaluation and the delivery goroutines
+	running sync.WaitGroup
+}
+
+func newAlerter(conf common.AlertsConfig, source, destination string, logger *common.Logger) (*alerter, error) {
+	if len(conf.Webhooks) == 0 {
+		return nil, nil
+	}
+	a := &alerter{
+		interval:    defaultAlertInterval,
+		rateLimit:   defaultAlertRateLimit,
+		active:      make(map[string]*activeAlert),
+		queue:       make(chan Alert, alertQueueSize),
+		source:      source,
+		destination: destination,
+		log:         logger,
+	}
+	var err error
+	if conf.Interval != "" {
+		a.interval, err = time.ParseDuration(conf.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse alert interval:%w", err)
+		}
+		if a.interval <= 0 {
+			return nil, fmt.Errorf("alert interval should be positive")
+		}
+	}
+	if conf.RepeatInterval != "" {
+		a.repeat, err = time.ParseDuration(conf.RepeatInterval)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse alert repeat interval:%w", err)
+		}
+	}
+	if conf.RateLimit > 0 {
+		a.rateLimit = conf.RateLimit
+	}
+	names := make(map[string]bool)
+	for _, ruleConf := range conf.Rules {
+		if ruleConf.Name == "" {
+			return nil, fmt.Errorf("alert rules should have a name")
+		}
+		if names[ruleConf.Name] {
+			return nil, fmt.Errorf("duplicate alert rule %s", ruleConf.Name)
+		}
+		names[ruleConf.Name] = true
+		if _, err := path.Match(ruleConf.Match, ""); err != nil {
+			return nil, fmt.Errorf("invalid series pattern %q for alert rule %s: %v", ruleConf.Match, ruleConf.Name, err)
+		}
+		rule := alertRule{name: ruleConf.Name, kind: ruleConf.Kind, match: ruleConf.Match, severity: ruleConf.Severity, errors: ruleConf.Errors}
+		switch ruleConf.Kind {
+		case AlertLag, AlertBackfill:
+			rule.threshold, err = time.ParseDuration(ruleConf.Threshold)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse threshold of alert rule %s:%w", ruleConf.Name, err)
+			}
+		case AlertErrors:
+			if rule.errors <= 0 {
+				return nil, fmt.Errorf("alert rule %s should have a positive number of errors", ruleConf.Name)
+			}
+		case AlertAdded, AlertRemoved:
+		default:
+			return nil, fmt.Errorf("unknown kind %s of alert rule %s", ruleConf.Kind, ruleConf.Name)
+		}
+		a.rules = append(a.rules, rule)
+	}
+	a.webhooks, err = newWebhooks(conf.Webhooks)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// run evaluates the rules against the status of the series returned by list, and posts the notifications, until stop is closed.
+// The notifications queued then are posted within the shutdown grace
+func (a *alerter) run(stop <-chan bool, list func() []SeriesStatus) {
+	if a == nil {
+		return
+	}
+	a.running.Add(2)
+	go func() {
+		defer a.running.Done()
+		ticker := time.NewTicker(a.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				a.evaluate(time.Now(), list())
+			}
+		}
+	}()
+	go func() {
+		defer a.running.Done()
+		for {
+			select {
+			case alert := <-a.queue:
+				a.deliver(context.Background(), alert)
+			case <-stop:
+				ctx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+				defer cancel()
+				for {
+					select {
+					case alert := <-a.queue:
+						a.deliver(ctx, alert)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+// wait blocks until the evaluation and the delivery goroutines returned
+func (a *alerter) wait() {
+	if a == nil {
+		return
+	}
+	a.running.Wait()
+}
+
+// seriesChanged queues the events of the rules matching a series added to or removed from the source registry
+func (a *alerter) seriesChanged(kind, series string) {
+	if a == nil {
+		return
+	}
+	message := fmt.Sprintf("added to the registry of %s", a.source)
+	if kind == AlertRemoved {
+		message = fmt.Sprintf("removed from the registry of %s", a.source)
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, rule := range a.rules {
+		if rule.kind == kind && rule.matches(series) {
+			alert := a.newAlert(rule, series, time.Now())
+			alert.Status = AlertEvent
+			alert.Message = message
+			a.pending = append(a.pending, alert)
+		}
+	}
+}
+
+func (a *alerter) newAlert(rule alertRule, series string, now time.Time) Alert {
+	return Alert{
+		Rule:        rule.name,
+		Kind:        rule.kind,
+		Severity:    rule.severity,
+		Series:      series,
+		Source:      a.source,
+		Destination: a.destination,
+		StartsAt:    now,
+	}
+}
+
+// evaluate updates the active alerts and sends the notifications allowed by the rate limit: the events and the resolutions first,
+// then the alerts firing. The alerts resolved before being notified are not notified at all
+func (a *alerter) evaluate(now time.Time, statuses []SeriesStatus) {
+	for _, status := range statuses {
+		for _, rule := range a.rules {
+			if !rule.matches(status.Series) {
+				continue
+			}
+			holds, message := rule.check(status, now)
+			if !holds {
+				continue
+			}
+			key := rule.name + "\x00" + status.Series
+			active, ok := a.active[key]
+			if !ok {
+				active = &activeAlert{alert: a.newAlert(rule, status.Series, now)}
+				active.alert.Status = AlertFiring
+				a.active[key] = active
+			}
+			active.alert.Message = message
+			active.seen = true
+		}
+	}
+
+	keys := make([]string, 0, len(a.active))
+	for key := range a.active {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var firing []*activeAlert
+	a.mutex.Lock()
+	for _, key := range keys {
+		active := a.active[key]
+		switch {
+		case !active.seen:
+			delete(a.active, key)
+			if !active.notified.IsZero() {
+				resolved := active.alert
+				resolved.Status = AlertResolved
+				resolved.EndsAt = &now
+				a.pending = append(a.pending, resolved)
+			}
+		case active.notified.IsZero() || (a.repeat > 0 && now.Sub(active.notified) >= a.repeat):
+			firing = append(firing, active)
+		}
+		active.seen = false
+	}
+	pending := a.pending
+	a.pending = nil
+	a.mutex.Unlock()
+
+	for i, alert := range pending {
+		if !a.allow(now) {
+			a.postpone(pending[i:])
+			return
+		}
+		a.notify(alert)
+	}
+	for i, active := range firing {
+		if !a.allow(now) {
+			a.log.Warnf("%d alerts postponed by the rate limit of %d notifications per minute", len(firing)-i, a.rateLimit)
+			return
+		}
+		active.notified = now
+		a.notify(active.alert)
+	}
+}
+
+// postpone puts back the notifications not sent, before those queued meanwhile
+func (a *alerter) postpone(alerts []Alert) {
+	a.log.Warnf("%d notifications postponed by the rate limit of %d notifications per minute", len(alerts), a.rateLimit)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.pending = append(append([]Alert(nil), alerts...), a.pending...)
+}
+
+// allow tells whether a notification may be sent now, and counts it
+func (a *alerter) allow(now time.Time) bool {
+	recent := a.sent[:0]
+	for _, t := range a.sent {
+		if now.Sub(t) < time.Minute {
+			recent = append(recent, t)
+		}
+	}
+	a.sent = recent
+	if len(a.sent) >= a.rateLimit {
+		return false
+	}
+	a.sent = append(a.sent, now)
+	return true
+}
+
+// notify queues the alert for the webhooks. The alert is dropped when the queue is full
+func (a *alerter) notify(alert Alert) {
+	logger := a.log.With("series", alert.Series)
+	logger.Infof("alert %s %s: %s", alert.Rule, alert.Status, alert.Message)
+	select {
+	case a.queue <- alert:
+	default:
+		logger.Warnf("alert %s dropped for the webhooks: %d notifications queued", alert.Rule, alertQueueSize)
+	}
+}
+
+// deliver posts the alert to every webhook. The failures are retried a few times and then logged
+func (a *alerter) deliver(ctx context.Context, alert Alert) {
+	logger := a.log.With("series", alert.Series)
+	body, err := json.Marshal(alert)
+	if err != nil {
+		logger.Errorf("error encoding alert: %v", err)
+		return
+	}
+	for _, hook := range a.webhooks {
+		err = hook.send(ctx, body)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Errorf("error notifying alert %s to %s: %v", alert.Rule, hook.redacted, err)
+		}
+	}
+}
+
+func newWebhooks(confs []common.WebhookConfig) ([]webhook, error) {
+	var webhooks []webhook
+	for _, hookConf := range confs {
+		if hookConf.URL == "" {
+			return nil, fmt.Errorf("webhooks should have a URL")
+		}
+		timeout := defaultWebhookTimeout
+		if hookConf.Timeout != "" {
+			var err error
+			timeout, err = time.ParseDuration(hookConf.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse timeout of webhook %s:%w", redactURL(hookConf.URL), err)
+			}
+		}
+		webhooks = append(webhooks, webhook{url: hookConf.URL, redacted: redactURL(hookConf.URL), headers: hookConf.Headers, client: &http.Client{Timeout: timeout}})
+	}
+	return webhooks, nil
+}
+
+// send posts the body to the webhook, with a few attempts. It returns the last error
+func (h webhook) send(ctx context.Context, body []byte) error {
+	retry := backoff{initial: time.Second, max: 10 * time.Second}
+	for attempt := 1; ; attempt++ {
+		err := h.post(ctx, body)
+		if err == nil || attempt == webhookAttempts {
+			return err
+		}
+		if sleepContext(ctx, retry.next()) {
+			return ctx.Err()
+		}
+	}
+}
+
+func (h webhook) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("invalid webhook %s", h.redacted)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range h.headers {
+		req.Header.Set(name, value)
+	}
+	res, err := h.client.Do(req)
+	if err != nil {
+		// the errors of the client quote the full URL
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = h.redacted
+		}
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
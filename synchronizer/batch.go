@@ -0,0 +1,434 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/farshidtz/senml/v2"
+	"github.com/linksmart/hds-data-synchronizer/common"
+	"github.com/linksmart/historical-datastore/data"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// defaultBackfillGroupSpan is the default maximum distance between the starts of the ranges grouped in one query
+	defaultBackfillGroupSpan = time.Hour
+	// batchCollectDelay is the time to collect further migration requests before grouping them
+	batchCollectDelay = 500 * time.Millisecond
+)
+
+// migrationBatcher groups the migrations of several series into a single source query and destination stream.
+// The requests are grouped by priority class and by the start of their range, so that a group does not
+// fetch much more than the requested records. Each group is a single job of the migration pool.
+type migrationBatcher struct {
+	sync.Mutex
+	srcConn     *connection
+	dstConn     *connection
+	destination string
+	pool        *migrationPool
+	// batchSize is the maximum number of series in a group
+	batchSize int
+	// groupSpan is the maximum distance between the starts of the ranges in a group
+	groupSpan time.Duration
+	// srcBreaker and dstBreaker receive the outcome of the calls to the source and the destination
+	srcBreaker *circuitBreaker
+	dstBreaker *circuitBreaker
+	// quarantine holds the records which are not copied. nil when unused
+	quarantine *quarantine
+	log        *common.Logger
+
+	pending []*migrationRequest
+	// flushTimer is set while pending requests wait to be grouped
+	flushTimer *time.Timer
+}
+
+type migrationRequest struct {
+	ctx    context.Context
+	series string
+	class  *priorityClass
+	// from is the position of the series at the destination
+	from cursor
+	to   time.Time
+	// onStart is called when the group of the request starts running
+	onStart func()
+	// onSubmit is called with the records of the request submitted to the destination stream
+	onSubmit func(senml.Pack)
+	// onCallFailed is called for each failed call of the group to the source, with source set, or to the destination
+	onCallFailed func(source bool)
+	// abandoned is set when the requester stopped waiting. Guarded by the lock of the batcher
+	abandoned bool
+	done      chan struct{}
+	result    migrationResult
+}
+
+// migrationResult is the outcome of a migration request
+type migrationResult struct {
+	// count is the number of records copied
+	count int
+	// lastTS is the time of the latest record copied, or the start of the range if none
+	lastTS time.Time
+	// seen is the number of records at lastTS which are copied, as in cursor
+	seen int
+	err  error
+}
+
+func newMigrationBatcher(srcConn, dstConn *connection, destination string, pool *migrationPool, batchSize int, groupSpan time.Duration) *migrationBatcher {
+	if batchSize <= 0 {
+		batchSize = defaultStreamBatchSize
+	}
+	if groupSpan <= 0 {
+		groupSpan = defaultBackfillGroupSpan
+	}
+	return &migrationBatcher{
+		srcConn:     srcConn,
+		dstConn:     dstConn,
+		destination: destination,
+		pool:        pool,
+		batchSize:   batchSize,
+		groupSpan:   groupSpan,
+		log:         common.Log.With("pipeline", pipelineMigration),
+	}
+}
+
+// migrate copies the records of the series after from up to to, and blocks until done or until ctx ends
+func (b *migrationBatcher) migrate(ctx context.Context, series string, class *priorityClass, from cursor, to time.Time, onStart func(), onSubmit func(senml.Pack), onCallFailed func(source bool)) (result migrationResult) {
+	ctx, span := startSpan(ctx, "migrate", attrSeries.String(series))
+	defer func() {
+		span.SetAttributes(attrRecords.Int(result.count))
+		endSpan(span, result.err)
+	}()
+	req := &migrationRequest{
+		ctx:          ctx,
+		series:       series,
+		class:        class,
+		from:         from,
+		to:           to,
+		onStart:      onStart,
+		onSubmit:     onSubmit,
+		onCallFailed: onCallFailed,
+		done:         make(chan struct{}),
+		result:       migrationResult{lastTS: from.ts, seen: from.seen},
+	}
+	b.Lock()
+	b.pending = append(b.pending, req)
+	if len(b.pending) >= b.batchSize {
+		b.flushLocked()
+	} else if b.flushTimer == nil {
+		b.flushTimer = time.AfterFunc(batchCollectDelay, b.flush)
+	}
+	b.Unlock()
+
+	select {
+	case <-req.done:
+		return req.result
+	case <-ctx.Done():
+		b.Lock()
+		req.abandoned = true
+		b.Unlock()
+		return migrationResult{lastTS: from.ts, seen: from.seen, err: ctx.Err()}
+	}
+}
+
+// copyRange copies the records of the series after from up to to as a separate job of the pool, without grouping it with other requests
+func (b *migrationBatcher) copyRange(ctx context.Context, series string, class *priorityClass, from cursor, to time.Time, onStart func(), onSubmit func(senml.Pack), onCallFailed func(source bool)) (result migrationResult) {
+	ctx, span := startSpan(ctx, "migrate", attrSeries.String(series))
+	defer func() {
+		span.SetAttributes(attrRecords.Int(result.count))
+		endSpan(span, result.err)
+	}()
+	req := &migrationRequest{
+		ctx:          ctx,
+		series:       series,
+		class:        class,
+		from:         from,
+		to:           to,
+		onSubmit:     onSubmit,
+		onCallFailed: onCallFailed,
+		result:       migrationResult{lastTS: from.ts, seen: from.seen},
+	}
+	err := b.waitForEndpoints(ctx)
+	if err != nil {
+		return migrationResult{lastTS: from.ts, seen: from.seen, err: err}
+	}
+	err = b.pool.run(ctx, b.destination, class, func() {
+		onStart()
+		b.copyGroup(ctx, []*migrationRequest{req})
+	})
+	if err != nil {
+		return migrationResult{lastTS: from.ts, seen: from.seen, err: err}
+	}
+	return req.result
+}
+
+func (b *migrationBatcher) flush() {
+	b.Lock()
+	defer b.Unlock()
+	b.flushLocked()
+}
+
+// flushLocked groups the pending requests and runs the groups. Must be called with the lock held
+func (b *migrationBatcher) flushLocked() {
+	if b.flushTimer != nil {
+		b.flushTimer.Stop()
+		b.flushTimer = nil
+	}
+	pending := b.pending
+	b.pending = nil
+
+	sort.SliceStable(pending, func(i, j int) bool {
+		if pending[i].class != pending[j].class {
+			return pending[i].class.priority > pending[j].class.priority
+		}
+		return pending[i].from.ts.Before(pending[j].from.ts)
+	})
+	var group []*migrationRequest
+	for _, req := range pending {
+		if len(group) > 0 && (req.class != group[0].class || len(group) >= b.batchSize || req.from.ts.Sub(group[0].from.ts) > b.groupSpan) {
+			go b.runGroup(group)
+			group = nil
+		}
+		group = append(group, req)
+	}
+	if len(group) > 0 {
+		go b.runGroup(group)
+	}
+}
+
+// runGroup executes the group as a job of the migration pool
+func (b *migrationBatcher) runGroup(group []*migrationRequest) {
+	// the group is cancelled once all of its requests are cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	remaining := len(group)
+	var remainingMutex sync.Mutex
+	for _, req := range group {
+		go func(req *migrationRequest) {
+			select {
+			case <-req.ctx.Done():
+				remainingMutex.Lock()
+				remaining--
+				if remaining == 0 {
+					cancel()
+				}
+				remainingMutex.Unlock()
+			case <-ctx.Done():
+			}
+		}(req)
+	}
+
+	// the slot of the pool is only taken once the endpoints are available
+	err := b.waitForEndpoints(ctx)
+	if err == nil {
+		err = b.pool.run(ctx, b.destination, group[0].class, func() {
+			b.Lock()
+			for _, req := range group {
+				if !req.abandoned {
+					req.onStart()
+				}
+			}
+			b.Unlock()
+			b.copyGroup(ctx, group)
+		})
+	}
+	for _, req := range group {
+		if err != nil {
+			req.result.err = err
+		}
+		close(req.done)
+	}
+}
+
+// recordSrc passes the outcome of a call to the source to its circuit breaker, and counts a failure for each series of the group
+func (b *migrationBatcher) recordSrc(ctx context.Context, group []*migrationRequest, err error) {
+	b.srcBreaker.record(ctx, err)
+	b.callFailed(ctx, group, err, true)
+}
+
+// recordDst passes the outcome of a call to the destination to its circuit breaker, and counts a failure for each series of the group
+func (b *migrationBatcher) recordDst(ctx context.Context, group []*migrationRequest, err error) {
+	b.dstBreaker.record(ctx, err)
+	b.callFailed(ctx, group, err, false)
+}
+
+// callFailed reports the failed call to the requests of the group. The calls ended by ctx are not failures, as for the breakers
+func (b *migrationBatcher) callFailed(ctx context.Context, group []*migrationRequest, err error, source bool) {
+	if err == nil || ctx.Err() != nil {
+		return
+	}
+	for _, req := range group {
+		if req.onCallFailed != nil {
+			req.onCallFailed(source)
+		}
+	}
+}
+
+// waitForEndpoints blocks while the circuit breaker of the source or the destination is open
+func (b *migrationBatcher) waitForEndpoints(ctx context.Context) error {
+	err := b.srcBreaker.wait(ctx)
+	if err != nil {
+		return err
+	}
+	return b.dstBreaker.wait(ctx)
+}
+
+// copyGroup copies the ranges of all the requests of the group with a single query. The records are filtered by the range of their series.
+// The destination stream is closed after the query ends, so that the records received before a request is cancelled are still submitted
+func (b *migrationBatcher) copyGroup(ctx context.Context, group []*migrationRequest) {
+	byName := make(map[string]*migrationRequest, len(group))
+	names := make([]string, 0, len(group))
+	from, to := group[0].from.ts, group[0].to
+	for _, req := range group {
+		byName[req.series] = req
+		names = append(names, req.series)
+		if req.from.ts.Before(from) {
+			from = req.from.ts
+		}
+		if req.to.After(to) {
+			to = req.to
+		}
+	}
+	fail := func(err error) {
+		for _, req := range group {
+			if req.result.err == nil {
+				req.result.err = err
+			}
+		}
+	}
+
+	// the span of the group is linked to the spans of the migrations of its series
+	links := make([]trace.Link, 0, len(group))
+	for _, req := range group {
+		links = append(links, trace.Link{SpanContext: trace.SpanContextFromContext(req.ctx)})
+	}
+	ctx, span := tracer().Start(ctx, "migrate group", trace.WithLinks(links...), trace.WithAttributes(attrSeries.StringSlice(names)))
+	defer func() {
+		var err error
+		for _, req := range group {
+			if req.result.err != nil {
+				err = req.result.err
+				break
+			}
+		}
+		endSpan(span, err)
+	}()
+
+	b.log.Infof("starting migrate of %d series from %v to %v", len(group), from, to)
+	srcClient, dstClient := b.srcConn.data(), b.dstConn.data()
+	streamCtx, cancelStream := context.WithCancel(trace.ContextWithSpan(context.Background(), span))
+	defer cancelStream()
+	destStream, err := dstClient.CreateSubmitStream(streamCtx)
+	b.recordDst(ctx, group, err)
+	if err != nil {
+		fail(fmt.Errorf("error getting the stream: %w", err))
+		return
+	}
+	defer func() {
+		err := dstClient.CloseSubmitStream(destStream)
+		b.recordDst(streamCtx, group, err)
+		if err != nil {
+			fail(fmt.Errorf("error closing the stream: %w", err))
+		}
+	}()
+
+	q := data.Query{
+		Denormalize: data.DenormMaskName | data.DenormMaskTime | data.DenormMaskUnit,
+		SortAsc:     true,
+		From:        from.Add(-queryPadding),
+		To:          to.Add(queryPadding),
+	}
+	queryCtx, cancelQuery := context.WithCancel(ctx)
+	queryCtx, querySpan := startSpan(queryCtx, "QueryStream", attrEndpoint.String(b.srcConn.endpoint), attrSeries.StringSlice(names))
+	sourceChannel, err := queryStream(queryCtx, srcClient, names, q)
+	b.recordSrc(ctx, group, err)
+	if err != nil {
+		endSpan(querySpan, err)
+		cancelQuery()
+		fail(fmt.Errorf("error querying the source: %w", err))
+		return
+	}
+	defer func() {
+		// stop the query and drain the channel so that the receiving goroutine can exit
+		cancelQuery()
+		for range sourceChannel {
+		}
+		querySpan.End()
+	}()
+
+	for page := 1; ; page++ {
+		// the span of a page covers the wait for it
+		waitStart := time.Now()
+		response, ok := <-sourceChannel
+		if !ok {
+			break
+		}
+		_, pageSpan := tracer().Start(queryCtx, "QueryStream page", trace.WithTimestamp(waitStart), trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attrEndpoint.String(b.srcConn.endpoint), attrPage.Int(page), attrRecords.Int(len(response.Pack))))
+		endSpan(pageSpan, response.Err)
+		if response.Err != nil {
+			querySpan.RecordError(response.Err)
+			b.recordSrc(ctx, group, response.Err)
+			fail(fmt.Errorf("error receiving stream: %w", response.Err))
+			return
+		}
+		var pack senml.Pack
+		// submitted holds the records of each request in the pack
+		submitted := make(map[*migrationRequest]senml.Pack)
+		for name, records := range splitByName(response.Pack) {
+			req, ok := byName[name]
+			if !ok || req.ctx.Err() != nil {
+				continue
+			}
+			for _, r := range records {
+				t := data.FromSenmlTime(r.Time)
+				if t.After(req.to) || req.from.skip(t) {
+					continue
+				}
+				if b.quarantine != nil && b.quarantine.contains(name, t) {
+					continue
+				}
+				pack = append(pack, r)
+				submitted[req] = append(submitted[req], r)
+				req.result.count++
+				if t.After(req.result.lastTS) {
+					req.result.lastTS = t
+					req.result.seen = 1
+				} else if t.Equal(req.result.lastTS) && req.result.seen != seenAll {
+					req.result.seen++
+				}
+			}
+		}
+		if len(pack) == 0 {
+			continue
+		}
+		err = group[0].class.limiter.wait(ctx, len(pack))
+		if err != nil {
+			fail(err)
+			return
+		}
+		series := make([]string, 0, len(submitted))
+		for req := range submitted {
+			series = append(series, req.series)
+		}
+		err = b.dstBreaker.wait(ctx)
+		if err != nil {
+			fail(err)
+			return
+		}
+		_, submitSpan := startSpan(ctx, "SubmitToStream", attrEndpoint.String(b.dstConn.endpoint), attrSeries.StringSlice(series), attrRecords.Int(len(pack)))
+		err = dstClient.SubmitToStream(destStream, pack)
+		endSpan(submitSpan, err)
+		b.recordDst(streamCtx, group, err)
+		if err != nil {
+			fail(fmt.Errorf("error submitting stream: %w", err))
+			return
+		}
+		for req, records := range submitted {
+			if req.onSubmit != nil {
+				req.onSubmit(records)
+			}
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMigrationWaitsForBreaker(t *testing.T) {
+	for _, endpoint := range []string{"source", "destination"} {
+		t.Run(endpoint, func(t *testing.T) {
+			b := newMigrationBatcher(nil, nil, "dst", newMigrationPool(0, 0), 0, 0)
+			b.srcBreaker = newCircuitBreaker("src", 1, time.Minute)
+			b.dstBreaker = newCircuitBreaker("dst", 1, time.Minute)
+			breaker := b.srcBreaker
+			if endpoint == "destination" {
+				breaker = b.dstBreaker
+			}
+			breaker.record(context.Background(), status.Error(codes.Unavailable, "unavailable"))
+
+			// neither a single range nor a group is started while the breaker is open
+			start := func() { t.Errorf("migration started while the breaker of the %s is open", endpoint) }
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			result := b.copyRange(ctx, "a", &priorityClass{}, cursor{}, time.Now(), start, nil, nil)
+			if !errors.Is(result.err, context.DeadlineExceeded) {
+				t.Fatalf("expected the range to wait for the breaker, got %v", result.err)
+			}
+			ctx, cancel = context.WithTimeout(context.Background(), batchCollectDelay+50*time.Millisecond)
+			defer cancel()
+			result = b.migrate(ctx, "a", &priorityClass{}, cursor{}, time.Now(), start, nil, nil)
+			if !errors.Is(result.err, context.DeadlineExceeded) {
+				t.Fatalf("expected the group to wait for the breaker, got %v", result.err)
+			}
+			if stats := b.pool.Stats(); stats != (PoolStats{}) {
+				t.Fatalf("expected no migration in the pool, got %+v", stats)
+			}
+		})
+	}
+}
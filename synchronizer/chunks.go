@@ -0,0 +1,230 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/linksmart/historical-datastore/data"
+)
+
+// defaultChunkParallelism is the number of chunks of a series copied concurrently when not configured
+const defaultChunkParallelism = 4
+
+// chunker splits the backfills of large series into chunks which are copied concurrently.
+// The plans are persisted, so that after a restart only the unfinished chunks are copied.
+type chunker struct {
+	// chunkSize is the number of records per chunk
+	chunkSize int
+	// parallelism is the number of chunks of a series copied concurrently
+	parallelism int
+	// dir is where the plans are persisted. The plans are only kept in memory when empty
+	dir string
+
+	sync.Mutex
+	// plans holds the unfinished plans by series
+	plans map[string]*chunkPlan
+}
+
+// chunkPlan is the split of the backfill range of a series
+type chunkPlan struct {
+	Series string  `json:"series"`
+	Chunks []chunk `json:"chunks"`
+}
+
+// chunk covers the records after From up to To
+type chunk struct {
+	From time.Time `json:"from"`
+	// Seen is the number of records at From which are copied already. -1 when all of them are
+	Seen int       `json:"seen"`
+	To   time.Time `json:"to"`
+	Done bool      `json:"done"`
+}
+
+func newChunker(chunkSize, parallelism int, stateDir string) (*chunker, error) {
+	if chunkSize <= 0 {
+		return nil, nil
+	}
+	if parallelism <= 0 {
+		parallelism = defaultChunkParallelism
+	}
+	c := &chunker{
+		chunkSize:   chunkSize,
+		parallelism: parallelism,
+		plans:       make(map[string]*chunkPlan),
+	}
+	if stateDir != "" {
+		c.dir = filepath.Join(stateDir, "chunks")
+		err := os.MkdirAll(c.dir, 0755)
+		if err != nil {
+			return nil, fmt.Errorf("error creating chunks directory: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// end returns the end of the range covered by the plan
+func (p *chunkPlan) end() time.Time {
+	return p.Chunks[len(p.Chunks)-1].To
+}
+
+// plan returns the unfinished plan of the series, if any. Otherwise, it splits the range after from up to to if it holds more than a chunk
+// of records. A nil plan means that the range does not need to be split
+func (c *chunker) plan(ctx context.Context, client *data.GrpcClient, series string, from cursor, to time.Time) (*chunkPlan, error) {
+	plan, err := c.load(series)
+	if err != nil || plan != nil {
+		return plan, err
+	}
+
+	total, err := count(ctx, client, []string{series}, data.Query{From: from.ts.Add(-queryPadding), To: to.Add(queryPadding)})
+	if err != nil {
+		return nil, fmt.Errorf("error counting records: %w", err)
+	}
+	if total <= c.chunkSize {
+		return nil, nil
+	}
+
+	// split the range between the first record and to evenly in time, so that each chunk holds around chunkSize records
+	first, err := query(ctx, client, []string{series}, data.Query{From: from.ts.Add(-queryPadding), To: to.Add(queryPadding), Limit: 1, SortAsc: true})
+	if err != nil {
+		return nil, fmt.Errorf("error getting the first record: %w", err)
+	}
+	splitFrom := from.ts
+	if len(first) == 1 {
+		first.Normalize()
+		splitFrom = data.FromSenmlTime(first[0].Time)
+	}
+	n := (total + c.chunkSize - 1) / c.chunkSize
+	step := to.Sub(splitFrom) / time.Duration(n)
+	plan = &chunkPlan{Series: series}
+	start := from
+	for i := 1; i <= n; i++ {
+		end := splitFrom.Add(step * time.Duration(i))
+		if i == n {
+			end = to
+		}
+		if !end.After(start.ts) {
+			continue
+		}
+		plan.Chunks = append(plan.Chunks, chunk{From: start.ts, Seen: start.seen, To: end})
+		// the records at the end of a chunk are copied by that chunk
+		start = cursor{ts: end, seen: seenAll}
+	}
+	err = c.save(plan)
+	if err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// markDone records the completion of a chunk. The plan is removed once all the chunks are done
+func (c *chunker) markDone(plan *chunkPlan, i int) error {
+	c.Lock()
+	plan.Chunks[i].Done = true
+	finished := true
+	for _, ch := range plan.Chunks {
+		finished = finished && ch.Done
+	}
+	c.Unlock()
+	if finished {
+		return c.remove(plan.Series)
+	}
+	return c.save(plan)
+}
+
+// progress returns the number of done chunks and the number of chunks of the unfinished plan of the series, if any
+func (c *chunker) progress(series string) (done int, total int) {
+	c.Lock()
+	defer c.Unlock()
+	plan, ok := c.plans[series]
+	if !ok {
+		return 0, 0
+	}
+	for _, ch := range plan.Chunks {
+		if ch.Done {
+			done++
+		}
+	}
+	return done, len(plan.Chunks)
+}
+
+// advance records the position reached in an unfinished chunk, so that the chunk is resumed from there
+func (c *chunker) advance(plan *chunkPlan, i int, position cursor) error {
+	c.Lock()
+	plan.Chunks[i].From = position.ts
+	plan.Chunks[i].Seen = position.seen
+	c.Unlock()
+	return c.save(plan)
+}
+
+func (c *chunker) load(series string) (*chunkPlan, error) {
+	c.Lock()
+	defer c.Unlock()
+	if plan, ok := c.plans[series]; ok {
+		return plan, nil
+	}
+	if c.dir == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(c.file(series))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading chunk plan: %w", err)
+	}
+	var plan chunkPlan
+	err = json.Unmarshal(b, &plan)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing chunk plan: %w", err)
+	}
+	if len(plan.Chunks) == 0 {
+		return nil, nil
+	}
+	c.plans[series] = &plan
+	return &plan, nil
+}
+
+func (c *chunker) save(plan *chunkPlan) error {
+	c.Lock()
+	defer c.Unlock()
+	c.plans[plan.Series] = plan
+	if c.dir == "" {
+		return nil
+	}
+	b, err := json.Marshal(plan)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first, so that a crash does not leave a truncated plan behind
+	tmp := c.file(plan.Series) + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return fmt.Errorf("error writing chunk plan: %w", err)
+	}
+	return os.Rename(tmp, c.file(plan.Series))
+}
+
+func (c *chunker) remove(series string) error {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.plans, series)
+	if c.dir == "" {
+		return nil
+	}
+	err := os.Remove(c.file(series))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing chunk plan: %w", err)
+	}
+	return nil
+}
+
+func (c *chunker) file(series string) string {
+	return filepath.Join(c.dir, url.PathEscape(series)+".json")
+}
@@ -0,0 +1,143 @@
+package sync
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/linksmart/historical-datastore/data"
+)
+
+func TestChunkPlanPersisted(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newChunker(10, 2, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	series := "building/room 1"
+	plan := &chunkPlan{Series: series, Chunks: []chunk{
+		{From: start, To: start.Add(time.Hour)},
+		{From: start.Add(time.Hour), Seen: seenAll, To: start.Add(2 * time.Hour)},
+	}}
+	if err := c.save(plan); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.advance(plan, 0, cursor{ts: start.Add(time.Minute), seen: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.markDone(plan, 1); err != nil {
+		t.Fatal(err)
+	}
+	// a truncated plan left behind by a crash while writing is not picked up
+	if err := ioutil.WriteFile(c.file(series)+".tmp", []byte(`{"series":`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// after a restart, the plan is resumed from the persisted progress
+	restarted, err := newChunker(10, 2, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := restarted.load(series)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded == nil || len(loaded.Chunks) != 2 {
+		t.Fatalf("expected the persisted plan, got %+v", loaded)
+	}
+	if first := loaded.Chunks[0]; !first.From.Equal(start.Add(time.Minute)) || first.Seen != 2 || first.Done {
+		t.Fatalf("expected the first chunk to resume after 2 records at %v, got %+v", start.Add(time.Minute), first)
+	}
+	if !loaded.Chunks[1].Done {
+		t.Fatalf("expected the second chunk to be done")
+	}
+	if done, total := restarted.progress(series); done != 1 || total != 2 {
+		t.Fatalf("expected 1 of 2 chunks done, got %d of %d", done, total)
+	}
+
+	// the plan is removed once all the chunks are done
+	if err := restarted.markDone(loaded, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(restarted.file(series)); !os.IsNotExist(err) {
+		t.Fatalf("expected the finished plan to be removed, got %v", err)
+	}
+	again, err := newChunker(10, 2, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := again.load(series); err != nil || loaded != nil {
+		t.Fatalf("expected no plan after completion, got %+v, %v", loaded, err)
+	}
+}
+
+func TestChunkPlanWrittenAtomically(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newChunker(10, 2, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	plan := &chunkPlan{Series: "a", Chunks: []chunk{{From: start, To: start.Add(time.Hour)}}}
+	for i := 0; i < 3; i++ {
+		if err := c.advance(plan, 0, cursor{ts: start.Add(time.Duration(i) * time.Minute)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// only the complete plan is left, without temporary files
+	files, err := filepath.Glob(filepath.Join(dir, "chunks", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0] != c.file("a") {
+		t.Fatalf("expected only %s, got %v", c.file("a"), files)
+	}
+}
+
+func TestChunkPlanSplitsRange(t *testing.T) {
+	c, src, _ := newTestController(t, nil)
+	defer c.Shutdown()
+	// 100 records, one per second
+	times := make([]float64, 100)
+	for i := range times {
+		times[i] = float64(i)
+	}
+	src.data.serve(testPack("a", times...))
+	first := data.FromSenmlTime(testEpoch)
+	to := first.Add(99 * time.Second)
+
+	chunks, err := newChunker(30, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := cursor{ts: first.Add(-time.Hour), seen: seenAll}
+	plan, err := chunks.plan(context.Background(), c.srcConn.data(), "a", from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan == nil || len(plan.Chunks) != 4 {
+		t.Fatalf("expected 4 chunks, got %+v", plan)
+	}
+	// the chunks cover the range without gaps, and split the records evenly
+	if !plan.Chunks[0].From.Equal(from.ts) || !plan.end().Equal(to) {
+		t.Fatalf("expected the chunks to cover %v to %v, got %+v", from.ts, to, plan.Chunks)
+	}
+	for i := 1; i < len(plan.Chunks); i++ {
+		if !plan.Chunks[i].From.Equal(plan.Chunks[i-1].To) || plan.Chunks[i].Seen != seenAll {
+			t.Fatalf("expected chunk %d to start after the end of the previous one, got %+v", i, plan.Chunks)
+		}
+		if n := plan.Chunks[i].To.Sub(plan.Chunks[i].From); n > 25*time.Second || n < 24*time.Second {
+			t.Fatalf("expected chunks of about 25 records, got %+v", plan.Chunks)
+		}
+	}
+
+	// a range holding no more than a chunk is not split
+	plan, err = chunks.plan(context.Background(), c.srcConn.data(), "b", from, to)
+	if err != nil || plan != nil {
+		t.Fatalf("expected no plan for a small range, got %+v, %v", plan, err)
+	}
+}
@@ -0,0 +1,218 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/linksmart/hds-data-synchronizer/common"
+	"github.com/linksmart/historical-datastore/data"
+	_go "github.com/linksmart/historical-datastore/protobuf/go"
+	"github.com/linksmart/historical-datastore/registry"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+const (
+	// defaultReconnectAfter is the time a connection may fail before it is rebuilt, when not configured
+	defaultReconnectAfter = time.Minute
+	// defaultProbeTimeout bounds the call checking the connection after a stalled stream
+	defaultProbeTimeout = 10 * time.Second
+	// probeSeries is the series queried to check the connection. Any response of the endpoint, including an error, proves the connection alive
+	probeSeries = "hds-data-synchronizer/probe"
+)
+
+// connection is the gRPC connection to an HDS endpoint, shared by its data and registry clients. The connection is rebuilt when it
+// stays in failure for too long or when a stalled stream is detected and the endpoint does not respond. The clients are looked up
+// on every use, so that the new connection is picked up after a rebuild.
+type connection struct {
+	endpoint string
+	dial     func() (*grpc.ClientConn, error)
+	// reconnectAfter is the time the connection may stay in failure before it is rebuilt
+	reconnectAfter time.Duration
+	// probeTimeout is the time the endpoint has to respond after a stalled stream
+	probeTimeout time.Duration
+
+	sync.RWMutex
+	conn           *grpc.ClientConn
+	dataClient     *data.GrpcClient
+	registryClient *registry.GrpcClient
+	// rebuilt is closed and replaced when the connection is rebuilt
+	rebuilt chan struct{}
+	// probing is set while the endpoint is checked after a stalled stream
+	probing bool
+	// closed is set once the connection is closed for good
+	closed bool
+}
+
+func newConnection(endpoint string, dial func() (*grpc.ClientConn, error), reconnectAfter time.Duration) (*connection, error) {
+	if reconnectAfter <= 0 {
+		reconnectAfter = defaultReconnectAfter
+	}
+	c := &connection{
+		endpoint:       endpoint,
+		dial:           dial,
+		reconnectAfter: reconnectAfter,
+		probeTimeout:   defaultProbeTimeout,
+		rebuilt:        make(chan struct{}),
+	}
+	conn, err := dial()
+	if err != nil {
+		return nil, fmt.Errorf("error dialing %s: %w", endpoint, err)
+	}
+	c.set(conn)
+	go c.watch()
+	return c, nil
+}
+
+// set replaces the connection and its clients. Must be called with the lock held, or before the connection is shared
+func (c *connection) set(conn *grpc.ClientConn) {
+	c.conn = conn
+	c.dataClient = data.NewGrpcClientFromConnection(conn)
+	c.registryClient = &registry.GrpcClient{Client: _go.NewRegistryClient(conn)}
+}
+
+// data returns the current data client
+func (c *connection) data() *data.GrpcClient {
+	c.RLock()
+	defer c.RUnlock()
+	return c.dataClient
+}
+
+// registry returns the current registry client
+func (c *connection) registry() *registry.GrpcClient {
+	c.RLock()
+	defer c.RUnlock()
+	return c.registryClient
+}
+
+// context returns a copy of ctx which is cancelled when the connection is rebuilt, so that the calls on the old connection are restarted
+func (c *connection) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	c.RLock()
+	rebuilt := c.rebuilt
+	c.RUnlock()
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-rebuilt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// state returns the connectivity state of the current connection
+func (c *connection) state() connectivity.State {
+	c.RLock()
+	defer c.RUnlock()
+	return c.conn.GetState()
+}
+
+// watch follows the connectivity state and rebuilds the connection if it does not recover from a failure within reconnectAfter
+func (c *connection) watch() {
+	var failingSince time.Time
+	for {
+		c.RLock()
+		conn := c.conn
+		c.RUnlock()
+
+		state := conn.GetState()
+		switch state {
+		case connectivity.Ready, connectivity.Idle:
+			failingSince = time.Time{}
+		case connectivity.Shutdown:
+			c.RLock()
+			replaced := c.conn != conn
+			c.RUnlock()
+			if !replaced {
+				return
+			}
+			failingSince = time.Time{}
+			continue
+		default:
+			if failingSince.IsZero() {
+				failingSince = time.Now()
+			}
+		}
+
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if !failingSince.IsZero() {
+			ctx, cancel = context.WithDeadline(ctx, failingSince.Add(c.reconnectAfter))
+		}
+		changed := conn.WaitForStateChange(ctx, state)
+		cancel()
+		if !changed {
+			c.rebuild(conn, fmt.Sprintf("no connection for %v", c.reconnectAfter))
+			failingSince = time.Time{}
+			continue
+		}
+		if newState := conn.GetState(); newState != connectivity.Shutdown {
+			common.Log.Infof("connection to %s: %v", c.endpoint, newState)
+		}
+	}
+}
+
+// stalled is called when a stream did not receive anything for a while. The endpoint is probed and the connection is rebuilt if it does not respond
+func (c *connection) stalled() {
+	c.Lock()
+	if c.probing {
+		c.Unlock()
+		return
+	}
+	c.probing = true
+	conn, client := c.conn, c.dataClient
+	c.Unlock()
+
+	go func() {
+		defer func() {
+			c.Lock()
+			c.probing = false
+			c.Unlock()
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), c.probeTimeout)
+		defer cancel()
+		// the query of the data client drops the errors of the stream
+		_, err := query(ctx, client, []string{probeSeries}, data.Query{Limit: 1})
+		if err != nil && isEndpointFailure(err) {
+			c.rebuild(conn, fmt.Sprintf("endpoint not responding: %v", err))
+		}
+	}()
+}
+
+// close closes the connection for good, which also ends its watcher
+func (c *connection) close() error {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.conn.Close()
+}
+
+// rebuild replaces the connection, unless it was already replaced or closed, and closes the old one
+func (c *connection) rebuild(old *grpc.ClientConn, reason string) {
+	c.Lock()
+	if c.conn != old || c.closed {
+		c.Unlock()
+		return
+	}
+	conn, err := c.dial()
+	if err != nil {
+		c.Unlock()
+		common.Log.Errorf("error rebuilding the connection to %s: %v", c.endpoint, err)
+		return
+	}
+	common.Log.Warnf("rebuilding the connection to %s: %s", c.endpoint, reason)
+	c.set(conn)
+	close(c.rebuilt)
+	c.rebuilt = make(chan struct{})
+	c.Unlock()
+
+	err = old.Close()
+	if err != nil {
+		common.Log.Errorf("error closing the connection to %s: %v", c.endpoint, err)
+	}
+}
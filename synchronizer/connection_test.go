@@ -0,0 +1,96 @@
+package sync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/linksmart/hds-data-synchronizer/common"
+	"github.com/linksmart/historical-datastore/data"
+)
+
+func TestConnectionRebuiltWhenFailing(t *testing.T) {
+	c, src, _ := newTestController(t, func(conf *common.Config) {
+		conf.Connection.ReconnectAfter = "100ms"
+	})
+	defer c.Shutdown()
+	conn := c.srcConn
+	ctx, cancel := conn.context(context.Background())
+	defer cancel()
+	old := conn.data()
+
+	// the calls fail once the endpoint is gone, and the connection does not recover
+	src.server.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for ctx.Err() == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("connection not rebuilt after %v in failure", conn.reconnectAfter)
+		}
+		callCtx, cancelCall := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		old.Query(callCtx, []string{"a"}, data.Query{Limit: 1})
+		cancelCall()
+	}
+	if conn.data() == old {
+		t.Fatalf("expected the clients of the new connection")
+	}
+}
+
+func TestStalledStream(t *testing.T) {
+	tests := []struct {
+		name string
+		// hold makes the endpoint unresponsive
+		hold bool
+	}{
+		{name: "responding endpoint"},
+		{name: "unresponsive endpoint", hold: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, src, _ := newTestController(t, nil)
+			defer c.Shutdown()
+			conn := c.srcConn
+			conn.probeTimeout = 100 * time.Millisecond
+			ctx, cancel := conn.context(context.Background())
+			defer cancel()
+			if test.hold {
+				src.data.hold()
+			}
+			mux := newSubscriptionMux(conn, 0, 200*time.Millisecond)
+			sub, err := mux.subscribe(context.Background(), "a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mux.unsubscribe(sub)
+
+			if !test.hold {
+				// the stream without any message is restarted
+				deadline := time.Now().Add(5 * time.Second)
+				for src.data.subscribeCount() < 2 {
+					if time.Now().After(deadline) {
+						t.Fatalf("stalled stream not restarted")
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+				// the connection is kept, and the records keep flowing on the new stream
+				waitSubscriptions(t, src, [][]string{{"a"}})
+				src.data.publish(testPack("a", 10))
+				receivePack(t, sub, 10)
+				if ctx.Err() != nil {
+					t.Fatalf("connection rebuilt although the endpoint responds")
+				}
+				return
+			}
+			// the connection is rebuilt, which ends the stream on the old one, so that the synchronization restarts
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatalf("connection not rebuilt although the endpoint does not respond")
+			}
+			select {
+			case <-sub.failed:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("subscription on the old connection not failed")
+			}
+		})
+	}
+}
@@ -1,44 +1,185 @@
 package sync
 
 import (
+	"context"
 	"crypto/tls"
-	"crypto/x509"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"hash/fnv"
 	"net"
 	"net/url"
+	"path"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/linksmart/hds-data-synchronizer/common"
-	"github.com/linksmart/historical-datastore/data"
 	"github.com/linksmart/historical-datastore/registry"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/status"
 )
 
+const (
+	defaultDiscoveryInterval      = time.Minute
+	defaultDiscoveryPageSize      = 100
+	defaultDiscoveryCheckInterval = 5 * time.Second
+	defaultPeriodicInterval       = time.Minute
+	defaultShutdownTimeout        = 30 * time.Second
+)
+
+// Controller manages the synchronizations of all the series. It is safe for concurrent use
 type Controller struct {
-	// SyncMap contains the map of series with active synchronization
-	SyncMap map[string]*Synchronizer
-
-	// srcDataClient is the connection to the source host
-	srcDataClient *data.GrpcClient
-	// dstDataClient is the connection to the destination host
-	dstDataClient *data.GrpcClient
-	// srcRegistryClient
-	srcRegistryClient *registry.GrpcClient
-	// dstRegistryClient
-	dstRegistryClient *registry.GrpcClient
-
-	syncInterval   time.Duration
-	destinationURL string
-	sourceURL      string
-
-	//stopSync is set when the sync application stops
+	// mutex guards syncMap, excluded, resyncing and stopping
+	mutex sync.RWMutex
+	// syncMap contains the synchronizations by series name
+	syncMap map[string]*Synchronizer
+	// excluded contains the series removed explicitly, which the discovery does not start again
+	excluded map[string]bool
+	// resyncing contains the series with a resync running
+	resyncing map[string]bool
+	// resyncs tracks the resync goroutines
+	resyncs sync.WaitGroup
+	// stopping is set once the shutdown started
+	stopping bool
+	// updateMutex serializes the changes of the set of synchronizations, and guards announced
+	updateMutex sync.Mutex
+	// announced contains the series seen in the source registry, which are notified as added only once
+	announced map[string]bool
+
+	// srcConn is the connection to the source host
+	srcConn *connection
+	// dstConn is the connection to the destination host
+	dstConn *connection
+
+	syncInterval time.Duration
+	// periodicInterval is the interval of the periodic series when syncInterval is 0
+	periodicInterval time.Duration
+	destinationURL   string
+	sourceURL        string
+
+	// discoveryInterval is the interval of the full reads of the source registry
+	discoveryInterval time.Duration
+	// discoveryPageSize is the number of registry entries fetched per request
+	discoveryPageSize int
+	// discoveryCheckInterval is the interval of the checks for changes of the registry. Disabled when 0
+	discoveryCheckInterval time.Duration
+
+	// schedule is the default schedule of the synchronizations
+	schedule Schedule
+	// seriesRules contains the per-series settings in the order of the configuration
+	seriesRules []seriesRule
+	// priorityClasses maps the class names to the classes
+	priorityClasses map[string]*priorityClass
+	// migrations is the work queue executing the migrations of all the series by priority
+	migrations *migrationPool
+	// resources are shared by all the synchronizers
+	resources *resources
+
+	// shutdownTimeout is the time given to the graceful shutdown
+	shutdownTimeout time.Duration
+	// config is the configuration with the defaults resolved
+	config common.Config
+
+	// rediscover requests a full read of the source registry from the discovery
+	rediscover chan struct{}
+	// health holds the thresholds of the health checks
+	health healthThresholds
+	// discoveryHealth tracks the discoveries for the health checks
+	discoveryHealth discoveryHealth
+	// alerts notifies the webhooks of the alert rules. nil when disabled
+	alerts *alerter
+	// events publishes the series added to and removed from the source registry
+	events *eventPublisher
+	// reports aggregates the lag of the series into daily reports. nil when disabled
+	reports *reporter
+	// tracing exports the spans. nil when disabled
+	tracing *sdktrace.TracerProvider
+	// log carries the source and the destination
+	log *common.Logger
+
+	//stopSync is closed when the sync application stops
 	stopSync chan bool
+	// stopOnce guards the closing of stopSync
+	stopOnce sync.Once
+	// discovery tracks the discovery goroutine
+	discovery sync.WaitGroup
+}
+
+var (
+	// ErrUnknownSeries is returned for a series without synchronization
+	ErrUnknownSeries = errors.New("unknown series")
+	// ErrSeriesExists is returned when adding a series which is synchronized already
+	ErrSeriesExists = errors.New("series is synchronized already")
+	// ErrStopping is returned for the changes requested during the shutdown
+	ErrStopping = errors.New("synchronization is stopping")
+	// ErrResyncRunning is returned when resyncing a series whose previous resync is still running
+	ErrResyncRunning = errors.New("resync is running already")
+)
+
+// resources are the clients and components shared by all the synchronizers of the controller
+type resources struct {
+	srcConn *connection
+	dstConn *connection
+	// subscriptions multiplexes the live subscriptions of all the series
+	subscriptions *subscriptionMux
+	// migrations groups the migrations of the series into shared queries
+	migrations *migrationBatcher
+	// chunks splits the backfills of large series. nil when disabled
+	chunks *chunker
+	// journal records the ranges copied. nil when disabled
+	journal *journal
+	// adaptive holds the bounds of the adaptive interval. nil when disabled
+	adaptive *adaptiveInterval
+	// periodicInterval is the interval of the series demoted from live to periodic mode
+	periodicInterval time.Duration
+	// demoteAfter is the number of consecutive subscription failures demoting a live series. Disabled when 0
+	demoteAfter int
+	// skew is the handling of the records in the future
+	skew *skewPolicy
+	// srcBreaker and dstBreaker are the circuit breakers of the source and the destination
+	srcBreaker *circuitBreaker
+	dstBreaker *circuitBreaker
+	// backoff is the initial backoff of every synchronizer
+	backoff backoff
+	log     *common.Logger
+}
+
+// seriesRule holds the parsed settings of a common.SeriesConfig entry
+type seriesRule struct {
+	match    string
+	schedule Schedule
+	// hasSchedule is set when the rule overrides the default schedule
+	hasSchedule bool
+	priority    string
+	mode        string
+	interval    time.Duration
+}
+
+// registryState summarizes the source registry, in order to detect changes without reading it fully
+type registryState struct {
+	total int
+	// hash is the hash of the sorted series names. 0 forces the next discovery to process all the series
+	hash uint64
+}
+
+// registryListing holds the entries read from the source registry
+type registryListing struct {
+	series []registry.TimeSeries
+	state  registryState
+}
+
+// seriesSettings are the settings resolved for a particular series
+type seriesSettings struct {
+	schedule Schedule
+	class    *priorityClass
+	// interval is the interval of the periodic synchronization. 0 for a live synchronization
+	interval time.Duration
 }
 
 func NewController(conf *common.Config) (*Controller, error) {
@@ -46,57 +187,396 @@ func NewController(conf *common.Config) (*Controller, error) {
 	var err error
 	controller.destinationURL = conf.Destination
 	controller.sourceURL = conf.Source
+	controller.log = common.Log.With("source", conf.Source, "destination", conf.Destination)
 	controller.syncInterval, err = time.ParseDuration(conf.SyncInterval)
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse synchronization interval:%w", err)
 	}
+	controller.discoveryInterval = defaultDiscoveryInterval
+	if conf.DiscoveryInterval != "" {
+		controller.discoveryInterval, err = time.ParseDuration(conf.DiscoveryInterval)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse discovery interval:%w", err)
+		}
+		if controller.discoveryInterval <= 0 {
+			return nil, fmt.Errorf("discovery interval should be positive")
+		}
+	}
+	controller.discoveryPageSize = conf.DiscoveryPageSize
+	if controller.discoveryPageSize <= 0 {
+		controller.discoveryPageSize = defaultDiscoveryPageSize
+	}
+	controller.discoveryCheckInterval = defaultDiscoveryCheckInterval
+	if conf.DiscoveryCheckInterval != "" {
+		controller.discoveryCheckInterval, err = time.ParseDuration(conf.DiscoveryCheckInterval)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse discovery check interval:%w", err)
+		}
+	}
+	controller.shutdownTimeout = defaultShutdownTimeout
+	if conf.ShutdownTimeout != "" {
+		controller.shutdownTimeout, err = time.ParseDuration(conf.ShutdownTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse shutdown timeout:%w", err)
+		}
+	}
+	controller.periodicInterval = controller.syncInterval
+	if controller.periodicInterval == 0 {
+		controller.periodicInterval = defaultPeriodicInterval
+		if conf.PeriodicInterval != "" {
+			controller.periodicInterval, err = time.ParseDuration(conf.PeriodicInterval)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse periodic interval:%w", err)
+			}
+			if controller.periodicInterval <= 0 {
+				return nil, fmt.Errorf("periodic interval should be positive")
+			}
+		}
+	}
+	controller.health = healthThresholds{
+		minHealthyRatio: defaultMinHealthyRatio,
+		discoveryMaxAge: discoveryMaxAgeFactor * controller.discoveryInterval,
+		stallTimeout:    defaultStallTimeout,
+	}
+	if conf.Health.MinHealthyRatio != 0 {
+		if conf.Health.MinHealthyRatio < 0 || conf.Health.MinHealthyRatio > 1 {
+			return nil, fmt.Errorf("minimum healthy ratio should be between 0 and 1")
+		}
+		controller.health.minHealthyRatio = conf.Health.MinHealthyRatio
+	}
+	if conf.Health.DiscoveryMaxAge != "" {
+		controller.health.discoveryMaxAge, err = time.ParseDuration(conf.Health.DiscoveryMaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse discovery max age:%w", err)
+		}
+	}
+	if conf.Health.StallTimeout != "" {
+		controller.health.stallTimeout, err = time.ParseDuration(conf.Health.StallTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse stall timeout:%w", err)
+		}
+	}
+	var adaptive *adaptiveInterval
+	if conf.AdaptiveInterval.Enabled {
+		reference := controller.periodicInterval
+		adaptive = &adaptiveInterval{min: reference / 4, base: reference, max: reference * 16}
+		if conf.AdaptiveInterval.Min != "" {
+			adaptive.min, err = time.ParseDuration(conf.AdaptiveInterval.Min)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse minimum synchronization interval:%w", err)
+			}
+		}
+		if conf.AdaptiveInterval.Max != "" {
+			adaptive.max, err = time.ParseDuration(conf.AdaptiveInterval.Max)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse maximum synchronization interval:%w", err)
+			}
+		}
+		if adaptive.min <= 0 || adaptive.min > reference || adaptive.max < reference {
+			return nil, fmt.Errorf("adaptive interval bounds %v-%v should include the synchronization interval %v", adaptive.min, adaptive.max, reference)
+		}
+	}
+	controller.schedule, err = parseSchedule(conf.Schedule)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse synchronization schedule:%w", err)
+	}
+	controller.priorityClasses = map[string]*priorityClass{
+		defaultClassName: {name: defaultClassName},
+	}
+	for _, classConf := range conf.PriorityClasses {
+		controller.priorityClasses[classConf.Name] = &priorityClass{
+			name:         classConf.Name,
+			priority:     classConf.Priority,
+			maxBackfills: classConf.MaxBackfills,
+			limiter:      newRateLimiter(classConf.RecordsPerSecond),
+		}
+	}
+	controller.migrations = newMigrationPool(conf.MaxConcurrentBackfills, conf.MaxMigrationsPerDestination)
+	groupSpan := defaultBackfillGroupSpan
+	if conf.BackfillGroupSpan != "" {
+		groupSpan, err = time.ParseDuration(conf.BackfillGroupSpan)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse backfill group span:%w", err)
+		}
+	}
 
-	// get the clients for source
-	controller.srcRegistryClient, controller.srcDataClient, err = getClients(conf, conf.Source)
+	retry := backoff{initial: defaultInitialBackoff, max: defaultMaxBackoff}
+	if conf.Retry.InitialBackoff != "" {
+		retry.initial, err = time.ParseDuration(conf.Retry.InitialBackoff)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse initial backoff:%w", err)
+		}
+	}
+	if conf.Retry.MaxBackoff != "" {
+		retry.max, err = time.ParseDuration(conf.Retry.MaxBackoff)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse max backoff:%w", err)
+		}
+	}
+	if retry.initial <= 0 || retry.max < retry.initial {
+		return nil, fmt.Errorf("invalid backoff: initial %v, max %v", retry.initial, retry.max)
+	}
+	var breakerCooldown time.Duration
+	if conf.Retry.BreakerCooldown != "" {
+		breakerCooldown, err = time.ParseDuration(conf.Retry.BreakerCooldown)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse circuit breaker cooldown:%w", err)
+		}
+	}
+
+	for _, seriesConf := range conf.Series {
+		rule := seriesRule{match: seriesConf.Match, priority: seriesConf.Priority, mode: seriesConf.Mode}
+		if seriesConf.Interval != "" {
+			rule.interval, err = time.ParseDuration(seriesConf.Interval)
+			if err != nil || rule.interval <= 0 {
+				return nil, fmt.Errorf("invalid interval for series %s:%v", seriesConf.Match, seriesConf.Interval)
+			}
+		}
+		if seriesConf.Schedule != "" {
+			rule.hasSchedule = true
+			rule.schedule, err = parseSchedule(seriesConf.Schedule)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse schedule for series %s:%w", seriesConf.Match, err)
+			}
+		}
+		controller.seriesRules = append(controller.seriesRules, rule)
+	}
+
+	var keepaliveParams keepalive.ClientParameters
+	if conf.Connection.KeepaliveTime != "" {
+		keepaliveParams.Time, err = time.ParseDuration(conf.Connection.KeepaliveTime)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse keepalive time:%w", err)
+		}
+	}
+	if conf.Connection.KeepaliveTimeout != "" {
+		keepaliveParams.Timeout, err = time.ParseDuration(conf.Connection.KeepaliveTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse keepalive timeout:%w", err)
+		}
+		if keepaliveParams.Time <= 0 {
+			return nil, fmt.Errorf("keepalive timeout requires a keepalive time")
+		}
+	}
+	var streamIdleTimeout, reconnectAfter time.Duration
+	if conf.Connection.StreamIdleTimeout != "" {
+		streamIdleTimeout, err = time.ParseDuration(conf.Connection.StreamIdleTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse stream idle timeout:%w", err)
+		}
+	}
+	if conf.Connection.ReconnectAfter != "" {
+		reconnectAfter, err = time.ParseDuration(conf.Connection.ReconnectAfter)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse reconnect delay:%w", err)
+		}
+	}
+
+	controller.tracing, err = setupTracing(conf.Tracing, conf.Source, conf.Destination)
+	if err != nil {
+		return nil, err
+	}
+
+	// get the connection to the source
+	dial, err := getDialer(conf, conf.Source, keepaliveParams)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing  gRPC client for source %s: %w", conf.Source, err)
+	}
+	controller.srcConn, err = newConnection(conf.Source, dial, reconnectAfter)
 	if err != nil {
 		return nil, fmt.Errorf("error initializing  gRPC client for source %s: %w", conf.Source, err)
 	}
 
-	// get the clients for source
-	controller.dstRegistryClient, controller.dstDataClient, err = getClients(conf, conf.Destination)
+	// get the connection to the destination
+	dial, err = getDialer(conf, conf.Destination, keepaliveParams)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing  gRPC client for destination %s: %w", conf.Destination, err)
+	}
+	controller.dstConn, err = newConnection(conf.Destination, dial, reconnectAfter)
 	if err != nil {
 		return nil, fmt.Errorf("error initializing  gRPC client for destination %s: %w", conf.Destination, err)
 	}
 
-	controller.SyncMap = make(map[string]*Synchronizer)
+	chunks, err := newChunker(conf.BackfillChunkSize, conf.BackfillChunkParallelism, conf.StateDir)
+	if err != nil {
+		return nil, err
+	}
+	journal, err := openJournal(conf.Journal, conf.Source, conf.Destination, controller.log)
+	if err != nil {
+		return nil, err
+	}
+	controller.alerts, err = newAlerter(conf.Alerts, conf.Source, conf.Destination, controller.log)
+	if err != nil {
+		return nil, err
+	}
+	controller.events, err = newEventPublisher(conf.Events, conf.Source, conf.Destination, controller.log)
+	if err != nil {
+		return nil, err
+	}
+	controller.reports, err = newReporter(conf.Report, conf.Source, conf.Destination, controller.log)
+	if err != nil {
+		return nil, err
+	}
+	skew := &skewPolicy{tolerance: defaultSkewTolerance, policy: FutureHold}
+	if conf.ClockSkew.Tolerance != "" {
+		skew.tolerance, err = time.ParseDuration(conf.ClockSkew.Tolerance)
+		if err != nil || skew.tolerance < 0 {
+			return nil, fmt.Errorf("invalid clock skew tolerance %s", conf.ClockSkew.Tolerance)
+		}
+	}
+	switch FuturePolicy(conf.ClockSkew.Policy) {
+	case "", FutureHold:
+	case FutureForward:
+		skew.policy = FutureForward
+	case FutureQuarantine:
+		skew.policy = FutureQuarantine
+		skew.quarantine, err = newQuarantine(conf.StateDir, controller.log)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown policy %s for the records in the future", conf.ClockSkew.Policy)
+	}
+	srcBreaker := newCircuitBreaker(conf.Source, conf.Retry.BreakerThreshold, breakerCooldown)
+	dstBreaker := newCircuitBreaker(conf.Destination, conf.Retry.BreakerThreshold, breakerCooldown)
+	migrations := newMigrationBatcher(controller.srcConn, controller.dstConn, controller.destinationURL, controller.migrations, conf.StreamBatchSize, groupSpan)
+	migrations.srcBreaker, migrations.dstBreaker = srcBreaker, dstBreaker
+	migrations.quarantine = skew.quarantine
+	migrations.log = controller.log.With("pipeline", pipelineMigration)
+	subscriptions := newSubscriptionMux(controller.srcConn, conf.StreamBatchSize, streamIdleTimeout)
+	subscriptions.log = controller.log.With("pipeline", pipelineLive)
+	controller.resources = &resources{
+		srcConn:          controller.srcConn,
+		dstConn:          controller.dstConn,
+		subscriptions:    subscriptions,
+		migrations:       migrations,
+		chunks:           chunks,
+		journal:          journal,
+		srcBreaker:       srcBreaker,
+		dstBreaker:       dstBreaker,
+		backoff:          retry,
+		adaptive:         adaptive,
+		periodicInterval: controller.periodicInterval,
+		demoteAfter:      conf.DemoteAfter,
+		skew:             skew,
+		log:              controller.log,
+	}
+
+	controller.syncMap = make(map[string]*Synchronizer)
+	controller.excluded = make(map[string]bool)
+	controller.announced = make(map[string]bool)
+	controller.resyncing = make(map[string]bool)
 	controller.stopSync = make(chan bool)
+	controller.rediscover = make(chan struct{}, 1)
+	controller.config = effectiveConfig(conf, controller)
 	return controller, nil
 }
 
-func getClients(conf *common.Config, urlStr string) (*registry.GrpcClient, *data.GrpcClient, error) {
-	serverCertFile := conf.TLS.Cert
-	serverPrivatekey := conf.TLS.Key
-	caFile := conf.TLS.CA
-	// Load the certificates from disk
-	certificate, err := tls.LoadX509KeyPair(serverCertFile, serverPrivatekey)
-	if err != nil {
-		return nil, nil, fmt.Errorf("could not load client key pair: %s", err)
+// effectiveConfig returns the configuration with the values resolved by the controller in place of the defaults
+func effectiveConfig(conf *common.Config, c *Controller) common.Config {
+	res := c.resources
+	effective := *conf
+	effective.SyncInterval = c.syncInterval.String()
+	effective.PeriodicInterval = c.periodicInterval.String()
+	effective.DiscoveryInterval = c.discoveryInterval.String()
+	effective.DiscoveryPageSize = c.discoveryPageSize
+	effective.DiscoveryCheckInterval = c.discoveryCheckInterval.String()
+	effective.ShutdownTimeout = c.shutdownTimeout.String()
+	effective.MaxConcurrentBackfills = c.migrations.limit
+	effective.StreamBatchSize = res.migrations.batchSize
+	effective.BackfillGroupSpan = res.migrations.groupSpan.String()
+	if res.chunks != nil {
+		effective.BackfillChunkParallelism = res.chunks.parallelism
+	}
+	if res.adaptive != nil {
+		effective.AdaptiveInterval.Min = res.adaptive.min.String()
+		effective.AdaptiveInterval.Max = res.adaptive.max.String()
+	}
+	effective.Retry = common.RetryConfig{
+		InitialBackoff:   res.backoff.initial.String(),
+		MaxBackoff:       res.backoff.max.String(),
+		BreakerThreshold: res.srcBreaker.threshold,
+		BreakerCooldown:  res.srcBreaker.cooldown.String(),
 	}
+	effective.ClockSkew = common.ClockSkewConfig{Tolerance: res.skew.tolerance.String(), Policy: string(res.skew.policy)}
+	effective.Connection.ReconnectAfter = c.srcConn.reconnectAfter.String()
+	if res.journal != nil {
+		effective.Journal.Instance = res.journal.instance
+	}
+	if c.alerts != nil {
+		effective.Alerts.Interval = c.alerts.interval.String()
+		effective.Alerts.RepeatInterval = c.alerts.repeat.String()
+		effective.Alerts.RateLimit = c.alerts.rateLimit
+	}
+	if c.reports != nil {
+		effective.Report.LagSLA = c.reports.sla.String()
+		effective.Report.SampleInterval = c.reports.interval.String()
+		effective.Report.Formats = c.reports.formats
+		effective.Report.Days = c.reports.days
+	}
+	effective.Alerts.Webhooks = effectiveWebhooks(conf.Alerts.Webhooks)
+	effective.Events.Webhooks = effectiveWebhooks(conf.Events.Webhooks)
+	if c.tracing != nil {
+		if effective.Tracing.SampleRatio == 0 {
+			effective.Tracing.SampleRatio = 1
+		}
+		if effective.Tracing.ServiceName == "" {
+			effective.Tracing.ServiceName = defaultTracingServiceName
+		}
+	}
+	effective.Health.MinHealthyRatio = c.health.minHealthyRatio
+	effective.Health.DiscoveryMaxAge = c.health.discoveryMaxAge.String()
+	effective.Health.StallTimeout = c.health.stallTimeout.String()
+	effective.Series = append([]common.SeriesConfig(nil), conf.Series...)
+	effective.PriorityClasses = make([]common.PriorityClass, 0, len(c.priorityClasses))
+	for _, class := range c.priorityClasses {
+		classConf := common.PriorityClass{Name: class.name, Priority: class.priority, MaxBackfills: class.maxBackfills}
+		if class.limiter != nil {
+			classConf.RecordsPerSecond = int(class.limiter.rate)
+		}
+		effective.PriorityClasses = append(effective.PriorityClasses, classConf)
+	}
+	sort.Slice(effective.PriorityClasses, func(i, j int) bool {
+		return effective.PriorityClasses[i].Name < effective.PriorityClasses[j].Name
+	})
+	return effective
+}
 
-	// Create a certificate pool from the certificate authority
-	// Get the SystemCertPool, continue with an empty pool on error
-	certPool, _ := x509.SystemCertPool()
-	if certPool == nil {
-		certPool = x509.NewCertPool()
+// effectiveWebhooks returns the webhooks with their default timeout, without the values of the headers and the parts of the URLs
+// which may hold credentials
+func effectiveWebhooks(webhooks []common.WebhookConfig) []common.WebhookConfig {
+	effective := make([]common.WebhookConfig, 0, len(webhooks))
+	for _, hook := range webhooks {
+		hook.URL = redactURL(hook.URL)
+		headers := make(map[string]string, len(hook.Headers))
+		for name := range hook.Headers {
+			headers[name] = "<redacted>"
+		}
+		hook.Headers = headers
+		if hook.Timeout == "" {
+			hook.Timeout = defaultWebhookTimeout.String()
+		}
+		effective = append(effective, hook)
 	}
-	ca, err := ioutil.ReadFile(caFile)
+	return effective
+}
+
+// getDialer returns a function dialing the endpoint with the TLS and keepalive settings of the configuration
+func getDialer(conf *common.Config, urlStr string, keepaliveParams keepalive.ClientParameters) (func() (*grpc.ClientConn, error), error) {
+	// Load the certificates from disk
+	certificate, err := conf.TLS.KeyPair()
 	if err != nil {
-		return nil, nil, fmt.Errorf("could not read CA certificate: %s", err)
+		return nil, err
 	}
-
-	// Append the client certificates from the CA
-	if ok := certPool.AppendCertsFromPEM(ca); !ok {
-		return nil, nil, fmt.Errorf("failed to append client certs")
+	// Create a certificate pool from the system pool and the certificate authority
+	certPool, err := conf.TLS.CertPool(true)
+	if err != nil {
+		return nil, err
 	}
 
 	parsedUrl, err := url.Parse(urlStr)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to parse url %s: %s", conf.Destination, err)
+		return nil, fmt.Errorf("failed to parse url %s: %s", conf.Destination, err)
 	}
 
 	hostPort := parsedUrl.Host
@@ -104,7 +584,7 @@ func getClients(conf *common.Config, urlStr string) (*registry.GrpcClient, *data
 	if strings.Contains(hostPort, ":") {
 		host, _, err = net.SplitHostPort(hostPort)
 		if err != nil {
-			return nil, nil, fmt.Errorf("error splitting the port and host name from %s: %v", urlStr, err)
+			return nil, fmt.Errorf("error splitting the port and host name from %s: %v", urlStr, err)
 		}
 	} else {
 		host = hostPort
@@ -116,95 +596,518 @@ func getClients(conf *common.Config, urlStr string) (*registry.GrpcClient, *data
 		RootCAs:      certPool,
 	})
 
-	// Connect to the destination
-	dataClient, err := data.NewGrpcClient(hostPort, grpc.WithTransportCredentials(creds))
-	if err != nil {
-		return nil, nil, fmt.Errorf("error dialing to the destination: %w", err)
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if keepaliveParams.Time > 0 {
+		opts = append(opts, grpc.WithKeepaliveParams(keepaliveParams))
 	}
-	registryClient, err := registry.NewGrpcClient(hostPort, grpc.WithTransportCredentials(creds))
-	if err != nil {
-		return nil, nil, fmt.Errorf("error dialing to the destination: %w", err)
+	if conf.Tracing.Exporter != "" {
+		opts = append(opts, tracingInterceptors()...)
 	}
-	return registryClient, dataClient, nil
+	return func() (*grpc.ClientConn, error) {
+		return grpc.Dial(hostPort, opts...)
+	}, nil
 }
 
-func (c Controller) StartSyncForAll() {
+func (c *Controller) StartSyncForAll() {
 
+	c.discovery.Add(1)
 	go func() {
-		ticker := time.NewTicker(1 * time.Minute)
-		err := c.updateSyncing()
-		if err != nil {
-			log.Println(err)
+		defer c.discovery.Done()
+		ticker := time.NewTicker(c.discoveryInterval)
+		state := c.runDiscovery(registryState{})
+		defer ticker.Stop()
+		// checks stays nil when the change detection is disabled
+		var checks <-chan time.Time
+		if c.discoveryCheckInterval > 0 {
+			checkTicker := time.NewTicker(c.discoveryCheckInterval)
+			defer checkTicker.Stop()
+			checks = checkTicker.C
 		}
 		for {
 			select {
 			case <-c.stopSync:
-				ticker.Stop()
 				return
-			case <-ticker.C:
-				err := c.updateSyncing()
+			case <-c.rediscover:
+				c.log.Infof("rediscovering the registry of %s", c.sourceURL)
+				state = c.runDiscovery(registryState{})
+			case <-checks:
+				c.discoveryHealth.begin()
+				changed, err := c.registryChanged(state)
+				c.discoveryHealth.idle()
 				if err != nil {
-					log.Println(err)
+					c.log.Errorf("%v", err)
+					continue
 				}
+				if !changed {
+					continue
+				}
+				c.log.Infof("registry of %s changed", c.sourceURL)
+				state = c.runDiscovery(state)
+			case <-ticker.C:
+				state = c.runDiscovery(state)
+				stats := c.migrations.Stats()
+				c.log.Infof("%d series synchronized: %d migrations running, %d queued", len(c.synchronizers()), stats.Running, stats.Queued)
 			}
 		}
-		defer ticker.Stop()
 	}()
+	c.alerts.run(c.stopSync, c.List)
+	c.reports.run(c.stopSync, c.synchronizers)
+	c.events.run(c.stopSync)
+
+}
 
+// runDiscovery updates the synchronizations from the registry and records the outcome for the health checks
+func (c *Controller) runDiscovery(prev registryState) registryState {
+	c.discoveryHealth.begin()
+	ctx, span := tracer().Start(context.Background(), "discovery", trace.WithAttributes(attrEndpoint.String(c.sourceURL)))
+	state, err := c.updateSyncing(ctx, prev)
+	endSpan(span, err)
+	c.discoveryHealth.finished(err)
+	if err != nil {
+		c.log.Errorf("%v", err)
+	}
+	return state
 }
-func (c Controller) updateSyncing() error {
-	// Get all the registry entries
+
+// registryChanged checks whether the number of series in the source registry differs from the last discovery, by requesting a
+// single entry. The series replaced by others, which keep the number unchanged, are left to the full discovery: it compares the
+// hash of the names and only processes the series when it changed
+func (c *Controller) registryChanged(state registryState) (bool, error) {
+	_, span := startSpan(context.Background(), "registry.GetMany", attrEndpoint.String(c.sourceURL))
+	_, total, err := c.srcConn.registry().GetMany(1, 1)
+	endSpan(span, err)
+	if err != nil {
+		return false, fmt.Errorf("error checking registry of %s:%v", c.sourceURL, err)
+	}
+	return total != state.total, nil
+}
+
+// readRegistry reads all the entries of the source registry
+func (c *Controller) readRegistry(ctx context.Context) (*registryListing, error) {
 	page := 1
-	perPage := 100
+	perPage := c.discoveryPageSize
 	remaining := 0
-	skipDelete := make(map[string]bool)
-	log.Printf("Fetching registry of %s", c.sourceURL)
+	var all []registry.TimeSeries
+	c.log.Debugf("Fetching registry of %s", c.sourceURL)
 	for do := true; do; do = remaining > 0 {
 
-		seriesList, total, err := c.srcRegistryClient.GetMany(page, perPage)
+		_, span := startSpan(ctx, "registry.GetMany", attrEndpoint.String(c.sourceURL), attrPage.Int(page))
+		seriesList, total, err := c.srcConn.registry().GetMany(page, perPage)
+		endSpan(span, err)
 		if err != nil {
-			return fmt.Errorf("error fetching registry of %s:%v", c.sourceURL, err)
+			return nil, fmt.Errorf("error fetching registry of %s:%v", c.sourceURL, err)
 		}
-		// For each registry entry, check if the synchronization is enabled for that particular time series
 		if page == 1 {
 			remaining = total
 		}
 		remaining = remaining - len(seriesList)
-	seriesLoop:
-		for _, series := range seriesList {
-			skipDelete[series.Name] = true
-			if _, ok := c.SyncMap[series.Name]; ok {
-				// the series is being synced already. continue to other series
-				continue
+		all = append(all, seriesList...)
+		if len(seriesList) == 0 {
+			// the registry shrank while paging
+			break
+		}
+		page += 1
+	}
+
+	names := make([]string, 0, len(all))
+	for _, series := range all {
+		names = append(names, series.Name)
+	}
+	sort.Strings(names)
+	hash := fnv.New64a()
+	for _, name := range names {
+		hash.Write([]byte(name))
+		hash.Write([]byte{0})
+	}
+	return &registryListing{series: all, state: registryState{total: len(all), hash: hash.Sum64()}}, nil
+}
+
+// updateSyncing reads the source registry, starts the synchronization of the new series and stops it for the removed ones.
+// The series are only processed when the registry differs from the previous state
+func (c *Controller) updateSyncing(ctx context.Context, prev registryState) (registryState, error) {
+	listing, err := c.readRegistry(ctx)
+	if err != nil {
+		return prev, err
+	}
+	all, state := listing.series, listing.state
+	if state == prev {
+		return state, nil
+	}
+
+	c.updateMutex.Lock()
+	defer c.updateMutex.Unlock()
+	if c.isStopping() {
+		return state, nil
+	}
+	// the series found by the first discovery are not notified as added
+	c.discoveryHealth.Lock()
+	initial := c.discoveryHealth.succeeded.IsZero()
+	c.discoveryHealth.Unlock()
+	// For each registry entry, check if the synchronization is enabled for that particular time series
+	skipDelete := make(map[string]bool)
+	var newSeries []registry.TimeSeries
+	for _, series := range all {
+		skipDelete[series.Name] = true
+		if _, ok := c.syncMap[series.Name]; !ok && !c.excluded[series.Name] && !c.announced[series.Name] {
+			if !initial {
+				c.alerts.seriesChanged(AlertAdded, series.Name)
 			}
-			err = c.dstRegistryClient.Add(series)
-			if err != nil {
-				if st, ok := status.FromError(err); ok {
-					if st.Code() != codes.AlreadyExists {
-						log.Printf("error creating registry in destination:%s:%v", series.Name, err)
-						continue seriesLoop
-					} else {
-						log.Printf("Continuing with existing timeseries %s in destination", series.Name)
-					}
-				}
-			} else {
-				log.Printf("Created timeseries %s in destination", series.Name)
+			if !initial || c.events.initial {
+				entry := series
+				c.events.publish(EventAdded, series.Name, &entry)
 			}
-			c.SyncMap[series.Name] = newSynchronization(series.Name, c.srcDataClient, c.dstDataClient, c.syncInterval)
 		}
-		page += 1
+		c.announced[series.Name] = true
+		if s, ok := c.syncMap[series.Name]; (ok && s.Lifecycle().Stage != LifecycleStopped) || c.excluded[series.Name] {
+			// the series is being synced already, or was removed explicitly. continue to other series
+			continue
+		}
+		newSeries = append(newSeries, series)
 	}
 
-	for seriesName, series := range c.SyncMap {
+	// start the series with higher priority first
+	settings := make(map[string]seriesSettings, len(newSeries))
+	for _, series := range newSeries {
+		settings[series.Name] = c.settingsFor(series)
+	}
+	sort.SliceStable(newSeries, func(i, j int) bool {
+		return settings[newSeries[i].Name].class.priority > settings[newSeries[j].Name].class.priority
+	})
+
+	for _, series := range newSeries {
+		err := c.startSeries(series, settings[series.Name])
+		if err != nil {
+			c.log.With("series", series.Name).Errorf("%v", err)
+			// retry with the next discovery
+			state.hash = 0
+		}
+	}
+
+	// the removed series are stopped and forgotten, so that they start over if they are added again
+	for _, seriesName := range c.names() {
 		if _, ok := skipDelete[seriesName]; !ok {
-			series.clear()
+			c.log.With("series", seriesName).Infof("removed from the registry of %s", c.sourceURL)
+			c.stopSeries(seriesName)
+		}
+	}
+	// the series notified are forgotten once removed, so that they are notified again if they are added back
+	for seriesName := range c.announced {
+		if !skipDelete[seriesName] {
+			delete(c.announced, seriesName)
+			c.alerts.seriesChanged(AlertRemoved, seriesName)
+			c.events.publish(EventRemoved, seriesName, nil)
 		}
 	}
+	return state, nil
+}
+
+// startSeries creates the series at the destination and starts its synchronization, replacing a stopped one.
+// Must be called with updateMutex held
+func (c *Controller) startSeries(series registry.TimeSeries, settings seriesSettings) error {
+	if old, ok := c.syncMap[series.Name]; ok {
+		c.log.With("series", series.Name).Infof("restarting the stopped synchronization")
+		c.stopSeries(series.Name)
+		<-old.done
+	}
+	s := newSynchronization(series.Name, settings, c.resources)
+	s.transition(LifecycleCreating)
+	_, span := startSpan(context.Background(), "registry.Add", attrEndpoint.String(c.destinationURL), attrSeries.String(series.Name))
+	err := c.dstConn.registry().Add(series)
+	endSpan(span, err)
+	if err != nil {
+		if st, ok := status.FromError(err); ok && st.Code() == codes.AlreadyExists {
+			s.log.Infof("Continuing with existing timeseries %s in destination", series.Name)
+		} else {
+			s.transition(LifecycleStopped)
+			return fmt.Errorf("error creating registry in destination:%s:%v", series.Name, err)
+		}
+	} else {
+		s.log.Infof("Created timeseries %s in destination", series.Name)
+	}
+	c.mutex.Lock()
+	c.syncMap[series.Name] = s
+	c.mutex.Unlock()
+	s.start()
 	return nil
 }
-func (c Controller) StopSyncForAll() {
-	c.stopSync <- true
-	for _, s := range c.SyncMap {
+
+// stopSeries stops the synchronization of the series and forgets it. Must be called with updateMutex held
+func (c *Controller) stopSeries(name string) {
+	c.mutex.Lock()
+	s, ok := c.syncMap[name]
+	delete(c.syncMap, name)
+	c.mutex.Unlock()
+	if ok {
 		s.clear()
 	}
 }
+
+// List returns the status of the synchronization of each series, sorted by name
+func (c *Controller) List() []SeriesStatus {
+	synchronizers := c.synchronizers()
+	list := make([]SeriesStatus, 0, len(synchronizers))
+	for _, s := range synchronizers {
+		list = append(list, s.Status())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Series < list[j].Series
+	})
+	return list
+}
+
+// Get returns the status of the synchronization of the series
+func (c *Controller) Get(name string) (SeriesStatus, error) {
+	s, err := c.synchronizer(name)
+	if err != nil {
+		return SeriesStatus{}, err
+	}
+	return s.Status(), nil
+}
+
+// Add starts the synchronization of a series of the source registry. A series removed explicitly is taken over by the discovery again
+func (c *Controller) Add(name string) error {
+	c.updateMutex.Lock()
+	defer c.updateMutex.Unlock()
+	if c.isStopping() {
+		return ErrStopping
+	}
+	if s, ok := c.synchronizers()[name]; ok && s.Lifecycle().Stage != LifecycleStopped {
+		return fmt.Errorf("%s: %w", name, ErrSeriesExists)
+	}
+	_, span := startSpan(context.Background(), "registry.Get", attrEndpoint.String(c.sourceURL), attrSeries.String(name))
+	series, err := c.srcConn.registry().Get(name)
+	endSpan(span, err)
+	if err != nil {
+		if st, ok := status.FromError(err); ok && st.Code() == codes.NotFound {
+			return fmt.Errorf("%s: %w", name, ErrUnknownSeries)
+		}
+		return fmt.Errorf("error getting %s from the registry of %s: %w", name, c.sourceURL, err)
+	}
+	c.mutex.Lock()
+	delete(c.excluded, name)
+	c.mutex.Unlock()
+	return c.startSeries(*series, c.settingsFor(*series))
+}
+
+// Remove stops the synchronization of the series. The discovery does not start it again, unless it is added explicitly
+func (c *Controller) Remove(name string) error {
+	c.updateMutex.Lock()
+	defer c.updateMutex.Unlock()
+	if c.isStopping() {
+		return ErrStopping
+	}
+	if _, err := c.synchronizer(name); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	c.excluded[name] = true
+	c.mutex.Unlock()
+	c.log.With("series", name).Infof("removed explicitly")
+	c.stopSeries(name)
+	return nil
+}
+
+// Pause suspends the synchronization of the series until it is resumed
+func (c *Controller) Pause(name string) error {
+	s, err := c.synchronizer(name)
+	if err != nil {
+		return err
+	}
+	s.pause()
+	return nil
+}
+
+// Resume continues the synchronization of a paused series
+func (c *Controller) Resume(name string) error {
+	s, err := c.synchronizer(name)
+	if err != nil {
+		return err
+	}
+	s.resume()
+	return nil
+}
+
+// Resync copies the records of the series from from up to to again, whatever the destination holds already.
+// The copy runs in the background, beside the synchronization. A series is resynced once at a time
+func (c *Controller) Resync(name string, from, to time.Time) error {
+	s, err := c.synchronizer(name)
+	if err != nil {
+		return err
+	}
+	if to.Before(from) {
+		return fmt.Errorf("invalid range %v-%v", from, to)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	// checked along with the registration, so that the shutdown waits for every resync started
+	if c.stopping {
+		return ErrStopping
+	}
+	if c.resyncing[name] {
+		return fmt.Errorf("%s: %w", name, ErrResyncRunning)
+	}
+	c.resyncing[name] = true
+	c.resyncs.Add(1)
+	go func() {
+		defer c.resyncs.Done()
+		s.resync(from, to)
+		c.mutex.Lock()
+		delete(c.resyncing, name)
+		c.mutex.Unlock()
+	}()
+	return nil
+}
+
+// Discover reads the source registry fully with the next iteration of the discovery
+func (c *Controller) Discover() error {
+	if c.isStopping() {
+		return ErrStopping
+	}
+	select {
+	case c.rediscover <- struct{}{}:
+	default:
+		// a rediscovery is pending already
+	}
+	return nil
+}
+
+// Config returns the configuration of the controller, with the defaults resolved
+func (c *Controller) Config() common.Config {
+	return c.config
+}
+
+func (c *Controller) synchronizer(name string) (*Synchronizer, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	s, ok := c.syncMap[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, ErrUnknownSeries)
+	}
+	return s, nil
+}
+
+// synchronizers returns a copy of the map of the synchronizations
+func (c *Controller) synchronizers() map[string]*Synchronizer {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	synchronizers := make(map[string]*Synchronizer, len(c.syncMap))
+	for name, s := range c.syncMap {
+		synchronizers[name] = s
+	}
+	return synchronizers
+}
+
+// names returns the names of the synchronized series
+func (c *Controller) names() []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	names := make([]string, 0, len(c.syncMap))
+	for name := range c.syncMap {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (c *Controller) isStopping() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.stopping
+}
+
+// rule returns the first per-series rule matching the series name
+func (c *Controller) rule(series string) *seriesRule {
+	for i, rule := range c.seriesRules {
+		if ok, _ := path.Match(rule.match, series); ok {
+			return &c.seriesRules[i]
+		}
+	}
+	return nil
+}
+
+// settingsFor resolves the settings of the series from the configuration and the registry meta
+func (c *Controller) settingsFor(series registry.TimeSeries) seriesSettings {
+	settings := seriesSettings{
+		schedule: c.schedule,
+		class:    c.priorityClasses[defaultClassName],
+		interval: c.syncInterval,
+	}
+	className, _ := series.Meta[MetaPriority].(string)
+	mode, _ := series.Meta[MetaMode].(string)
+	rule := c.rule(series.Name)
+	if rule != nil {
+		if rule.hasSchedule {
+			settings.schedule = rule.schedule
+		}
+		if rule.priority != "" {
+			className = rule.priority
+		}
+		if rule.mode != "" {
+			mode = rule.mode
+		}
+	}
+	switch mode {
+	case "":
+	case "live":
+		settings.interval = 0
+	case "periodic":
+		settings.interval = c.periodicInterval
+	default:
+		c.log.With("series", series.Name).Warnf("unknown synchronization mode %s. using the default mode", mode)
+	}
+	if settings.interval != 0 && rule != nil && rule.interval != 0 {
+		settings.interval = rule.interval
+	}
+	if className != "" {
+		if class, ok := c.priorityClasses[className]; ok {
+			settings.class = class
+		} else {
+			c.log.With("series", series.Name).Warnf("unknown priority class %s. using the default class", className)
+		}
+	}
+	return settings
+}
+
+// MigrationStates returns the state of the migration of each series
+func (c *Controller) MigrationStates() map[string]MigrationState {
+	synchronizers := c.synchronizers()
+	states := make(map[string]MigrationState, len(synchronizers))
+	for name, s := range synchronizers {
+		states[name] = s.MigrationState()
+	}
+	return states
+}
+
+// Intervals returns the effective interval of the periodic synchronization of each series. The interval is 0 for live synchronizations
+func (c *Controller) Intervals() map[string]time.Duration {
+	synchronizers := c.synchronizers()
+	intervals := make(map[string]time.Duration, len(synchronizers))
+	for name, s := range synchronizers {
+		intervals[name] = s.Interval()
+	}
+	return intervals
+}
+
+// Lifecycles returns the stage of the synchronization of each series
+func (c *Controller) Lifecycles() map[string]LifecycleStatus {
+	synchronizers := c.synchronizers()
+	lifecycles := make(map[string]LifecycleStatus, len(synchronizers))
+	for name, s := range synchronizers {
+		lifecycles[name] = s.Lifecycle()
+	}
+	return lifecycles
+}
+
+// Skews returns how far the latest record of each series was ahead of the clock of the host when last observed
+func (c *Controller) Skews() map[string]time.Duration {
+	synchronizers := c.synchronizers()
+	skews := make(map[string]time.Duration, len(synchronizers))
+	for name, s := range synchronizers {
+		skews[name] = s.Skew()
+	}
+	return skews
+}
+
+// StopSyncForAll stops all the synchronizations immediately. See Shutdown for a graceful shutdown
+func (c *Controller) StopSyncForAll() {
+	c.shutdown(0)
+}
@@ -0,0 +1,178 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/linksmart/hds-data-synchronizer/common"
+	"github.com/linksmart/historical-datastore/registry"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestConcurrentChanges changes the synchronizations through the API while the discovery follows the changes of the registry.
+// It is meant to be run with -race
+func TestConcurrentChanges(t *testing.T) {
+	c, src, _ := newTestController(t, func(conf *common.Config) {
+		conf.ShutdownTimeout = "1s"
+	})
+	names := make([]string, 8)
+	for i := range names {
+		names[i] = fmt.Sprintf("s%d", i)
+	}
+	src.registry.add(names...)
+	c.runDiscovery(registryState{})
+
+	var wg gosync.WaitGroup
+	errs := make(chan error, 100)
+	deadline := time.Now().Add(time.Second)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		random := rand.New(rand.NewSource(0))
+		for time.Now().Before(deadline) {
+			name := names[random.Intn(len(names))]
+			if random.Intn(2) == 0 {
+				src.registry.remove(name)
+			} else {
+				src.registry.add(name)
+			}
+			c.runDiscovery(registryState{})
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(seed))
+			for time.Now().Before(deadline) {
+				name := names[random.Intn(len(names))]
+				var err error
+				switch random.Intn(6) {
+				case 0:
+					c.List()
+				case 1:
+					_, err = c.Get(name)
+				case 2:
+					err = c.Add(name)
+				case 3:
+					err = c.Remove(name)
+				case 4:
+					err = c.Pause(name)
+				case 5:
+					err = c.Resume(name)
+				}
+				if err != nil && !errors.Is(err, ErrUnknownSeries) && !errors.Is(err, ErrSeriesExists) {
+					errs <- err
+					return
+				}
+			}
+		}(int64(i + 1))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	list := c.List()
+	for i := 1; i < len(list); i++ {
+		if list[i-1].Series >= list[i].Series {
+			t.Fatalf("list not sorted or with duplicates: %s before %s", list[i-1].Series, list[i].Series)
+		}
+	}
+	report := c.Shutdown()
+	if len(report.Running) > 0 {
+		t.Fatalf("synchronizations did not stop: %v", report.Running)
+	}
+}
+
+func TestResyncOnceAtATime(t *testing.T) {
+	c, src, _ := newTestController(t, func(conf *common.Config) {
+		conf.ShutdownTimeout = "1s"
+	})
+	src.registry.add("a")
+	c.runDiscovery(registryState{})
+	src.data.hold()
+
+	from := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	if err := c.Resync("a", from, from.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Resync("a", from, from.Add(time.Hour)); !errors.Is(err, ErrResyncRunning) {
+		t.Fatalf("expected the second resync rejected, got %v", err)
+	}
+
+	// the shutdown cancels the resync and waits for it
+	c.Shutdown()
+	c.mutex.RLock()
+	resyncing := len(c.resyncing)
+	c.mutex.RUnlock()
+	if resyncing > 0 {
+		t.Fatalf("expected the resync to return within the shutdown")
+	}
+	if err := c.Resync("a", from, from.Add(time.Hour)); !errors.Is(err, ErrStopping) {
+		t.Fatalf("expected the resync rejected after the shutdown, got %v", err)
+	}
+}
+
+func TestSeriesMode(t *testing.T) {
+	c, _, _ := newTestController(t, func(conf *common.Config) {
+		conf.PeriodicInterval = "5m"
+		conf.Series = []common.SeriesConfig{
+			{Match: "live/*", Mode: "live"},
+			{Match: "slow/*", Mode: "periodic", Interval: "10m"},
+		}
+	})
+	defer c.Shutdown()
+	tests := []struct {
+		series string
+		mode   string
+		want   time.Duration
+	}{
+		{series: "a", want: 0},
+		{series: "a", mode: "periodic", want: 5 * time.Minute},
+		{series: "a", mode: "unknown", want: 0},
+		{series: "live/a", mode: "periodic", want: 0},
+		{series: "slow/a", want: 10 * time.Minute},
+		{series: "slow/a", mode: "live", want: 10 * time.Minute},
+	}
+	for _, test := range tests {
+		series := registry.TimeSeries{Name: test.series, Meta: map[string]interface{}{}}
+		if test.mode != "" {
+			series.Meta[MetaMode] = test.mode
+		}
+		if got := c.settingsFor(series).interval; got != test.want {
+			t.Errorf("%s with mode %q: expected interval %v, got %v", test.series, test.mode, test.want, got)
+		}
+	}
+}
+
+func TestDemoteAfterSubscriptionFailures(t *testing.T) {
+	c, src, dst := newTestController(t, func(conf *common.Config) {
+		conf.PeriodicInterval = "1h"
+		conf.DemoteAfter = 3
+	})
+	defer c.Shutdown()
+	src.data.serve(testPack("a", 1, 2, 3))
+	dst.data.serve()
+	src.data.failSubscribe(status.Error(codes.FailedPrecondition, "no subscriptions"))
+	src.registry.add("a")
+	c.runDiscovery(registryState{})
+
+	// the live series falls back to periodic mode, which copies the records
+	deadline := time.Now().Add(10 * time.Second)
+	for c.Intervals()["a"] != time.Hour || len(dst.data.stored("a")) != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the series demoted with its records copied, got interval %v and %d records", c.Intervals()["a"], len(dst.data.stored("a")))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := src.data.subscribeCount(); n != 3 {
+		t.Fatalf("expected 3 subscriptions before the demotion, got %d", n)
+	}
+}
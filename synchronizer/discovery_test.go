@@ -0,0 +1,174 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linksmart/hds-data-synchronizer/common"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRegistryChanged(t *testing.T) {
+	c, src, _ := newTestController(t, nil)
+	defer c.Shutdown()
+	names := make([]string, 50)
+	for i := range names {
+		names[i] = fmt.Sprintf("s%02d", i)
+	}
+	src.registry.add(names...)
+	state := c.runDiscovery(registryState{})
+	if got := sortedNames(c); !reflect.DeepEqual(got, names) {
+		t.Fatalf("expected the synchronization of %v, got %v", names, got)
+	}
+
+	// the check reads a single entry, however large the registry
+	served := src.registry.servedCount()
+	changed, err := c.registryChanged(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed {
+		t.Fatalf("unchanged registry detected as changed")
+	}
+	if n := src.registry.servedCount() - served; n > 1 {
+		t.Fatalf("expected the check to read a single entry, got %d", n)
+	}
+
+	// an added series is detected by the check
+	src.registry.add("new")
+	changed, err = c.registryChanged(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Fatalf("added series not detected")
+	}
+	state = c.runDiscovery(state)
+
+	// a series replaced by another is left to the discovery, which compares the names
+	src.registry.remove("s00")
+	src.registry.add("s50")
+	changed, err = c.registryChanged(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed {
+		t.Fatalf("expected the check to compare the number of series only")
+	}
+	c.runDiscovery(state)
+	got := sortedNames(c)
+	if len(got) != 51 || got[0] != "new" || got[1] != "s01" || got[50] != "s50" {
+		t.Fatalf("expected the replaced series to be synchronized after the discovery, got %v", got)
+	}
+}
+
+func sortedNames(c *Controller) []string {
+	names := c.names()
+	sort.Strings(names)
+	return names
+}
+
+func TestAnnounceSeriesOnce(t *testing.T) {
+	c, src, dst := newTestController(t, nil)
+	defer c.Shutdown()
+	events, unsubscribe := c.SubscribeDiscovery()
+	defer unsubscribe()
+	src.registry.add("a")
+	c.runDiscovery(registryState{})
+
+	// the synchronization of b cannot start, so that every discovery finds it again
+	src.registry.add("b")
+	dst.registry.failAdd(status.Error(codes.Unavailable, "unavailable"))
+	c.runDiscovery(registryState{})
+	c.runDiscovery(registryState{})
+	if got := receiveEvents(events); !reflect.DeepEqual(got, []string{"added b"}) {
+		t.Fatalf("expected b added once, got %v", got)
+	}
+
+	src.registry.remove("b")
+	c.runDiscovery(registryState{})
+	c.runDiscovery(registryState{})
+	src.registry.add("b")
+	c.runDiscovery(registryState{})
+	if got := receiveEvents(events); !reflect.DeepEqual(got, []string{"removed b", "added b"}) {
+		t.Fatalf("expected b removed and added again, got %v", got)
+	}
+}
+
+func TestDiscoveryEventsDelivered(t *testing.T) {
+	posted := make(chan DiscoveryEvent, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event DiscoveryEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("invalid event posted: %v", err)
+		}
+		posted <- event
+	}))
+	defer server.Close()
+	file := filepath.Join(t.TempDir(), "events.jsonl")
+	c, src, _ := newTestController(t, func(conf *common.Config) {
+		conf.Events = common.EventsConfig{Webhooks: []common.WebhookConfig{{URL: server.URL}}, File: file, Initial: true}
+	})
+	c.events.run(c.stopSync)
+	src.registry.add("a")
+	c.runDiscovery(registryState{})
+	src.registry.remove("a")
+	c.runDiscovery(registryState{})
+
+	// the webhook receives the events in order, with the registry entry of the series added
+	for _, kind := range []string{EventAdded, EventRemoved} {
+		select {
+		case event := <-posted:
+			if event.Kind != kind || event.Series != "a" || event.Source != c.sourceURL || event.Destination != c.destinationURL {
+				t.Fatalf("expected a %s event of a, got %+v", kind, event)
+			}
+			if (event.TimeSeries != nil) != (kind == EventAdded) {
+				t.Fatalf("expected the registry entry with the added event only, got %+v", event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the %s event to be posted", kind)
+		}
+	}
+
+	// the log file has one event per line
+	c.Shutdown()
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		var event DiscoveryEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("invalid event logged %s: %v", line, err)
+		}
+		got = append(got, event.Kind+" "+event.Series)
+	}
+	if !reflect.DeepEqual(got, []string{"added a", "removed a"}) {
+		t.Fatalf("expected a added and removed in the event log, got %v", got)
+	}
+}
+
+// receiveEvents returns the kinds and series of the events received so far
+func receiveEvents(events <-chan DiscoveryEvent) []string {
+	var got []string
+	for {
+		select {
+		case event := <-events:
+			got = append(got, event.Kind+" "+event.Series)
+		default:
+			return got
+		}
+	}
+}
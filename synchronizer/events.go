@@ -0,0 +1,210 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/linksmart/hds-data-synchronizer/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+// the kinds of the discovery events
+const (
+	EventAdded   = "added"
+	EventRemoved = "removed"
+)
+
+const (
+	// eventQueueSize bounds the events waiting for the webhooks
+	eventQueueSize = 1024
+	// eventSubscriberBuffer is the capacity of the channels of the subscribers
+	eventSubscriberBuffer = 100
+)
+
+// DiscoveryEvent is a series added to or removed from the source registry
+type DiscoveryEvent struct {
+	Kind        string    `json:"kind"`
+	Series      string    `json:"series"`
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	Time        time.Time `json:"time"`
+	// TimeSeries is the registry entry of an added series
+	TimeSeries *registry.TimeSeries `json:"timeSeries,omitempty"`
+}
+
+// eventPublisher delivers the discovery events to the webhooks, the event log file and the subscribers
+type eventPublisher struct {
+	webhooks    []webhook
+	initial     bool
+	source      string
+	destination string
+	log         *common.Logger
+
+	// queue holds the events waiting for the webhooks. nil without webhooks
+	queue chan DiscoveryEvent
+	// running tracks the delivery goroutine
+	running sync.WaitGroup
+
+	// mutex guards the file and the subscribers
+	mutex       sync.Mutex
+	file        *os.File
+	subscribers map[int]chan DiscoveryEvent
+	nextID      int
+	closed      bool
+}
+
+func newEventPublisher(conf common.EventsConfig, source, destination string, logger *common.Logger) (*eventPublisher, error) {
+	p := &eventPublisher{
+		initial:     conf.Initial,
+		source:      source,
+		destination: destination,
+		log:         logger,
+		subscribers: make(map[int]chan DiscoveryEvent),
+	}
+	var err error
+	p.webhooks, err = newWebhooks(conf.Webhooks)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.webhooks) > 0 {
+		p.queue = make(chan DiscoveryEvent, eventQueueSize)
+	}
+	if conf.File != "" {
+		p.file, err = os.OpenFile(conf.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("error opening event log: %w", err)
+		}
+	}
+	return p, nil
+}
+
+// publish appends the event to the log file and hands it to the subscribers and the webhooks, without blocking.
+// The events are dropped for the subscribers and the webhooks which do not keep up
+func (p *eventPublisher) publish(kind string, series string, ts *registry.TimeSeries) {
+	event := DiscoveryEvent{Kind: kind, Series: series, Source: p.source, Destination: p.destination, Time: time.Now(), TimeSeries: ts}
+	logger := p.log.With("series", series)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return
+	}
+	if p.file != nil {
+		b, err := json.Marshal(event)
+		if err == nil {
+			_, err = p.file.Write(append(b, '\n'))
+		}
+		if err != nil {
+			logger.Errorf("error writing %s event to the event log: %v", kind, err)
+		}
+	}
+	for _, ch := range p.subscribers {
+		select {
+		case ch <- event:
+		default:
+			logger.Warnf("%s event dropped for a subscriber", kind)
+		}
+	}
+	if p.queue != nil {
+		select {
+		case p.queue <- event:
+		default:
+			logger.Warnf("%s event dropped for the webhooks: %d events queued", kind, eventQueueSize)
+		}
+	}
+}
+
+// run delivers the queued events to the webhooks until stop is closed. The events queued then are delivered within the shutdown grace
+func (p *eventPublisher) run(stop <-chan bool) {
+	if p.queue == nil {
+		return
+	}
+	p.running.Add(1)
+	go func() {
+		defer p.running.Done()
+		for {
+			select {
+			case event := <-p.queue:
+				p.deliver(context.Background(), event)
+			case <-stop:
+				ctx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+				defer cancel()
+				for {
+					select {
+					case event := <-p.queue:
+						p.deliver(ctx, event)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+func (p *eventPublisher) deliver(ctx context.Context, event DiscoveryEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		p.log.With("series", event.Series).Errorf("error encoding %s event: %v", event.Kind, err)
+		return
+	}
+	for _, hook := range p.webhooks {
+		err = hook.send(ctx, body)
+		if err != nil {
+			p.log.With("series", event.Series).Errorf("error posting %s event to %s: %v", event.Kind, hook.redacted, err)
+		}
+	}
+}
+
+// wait blocks until the delivery goroutine returned
+func (p *eventPublisher) wait() {
+	p.running.Wait()
+}
+
+// close closes the channels of the subscribers and the event log file
+func (p *eventPublisher) close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	for id, ch := range p.subscribers {
+		close(ch)
+		delete(p.subscribers, id)
+	}
+	if p.file == nil {
+		return nil
+	}
+	return p.file.Close()
+}
+
+func (p *eventPublisher) subscribe() (<-chan DiscoveryEvent, func()) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	ch := make(chan DiscoveryEvent, eventSubscriberBuffer)
+	if p.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	id := p.nextID
+	p.nextID++
+	p.subscribers[id] = ch
+	return ch, func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		if ch, ok := p.subscribers[id]; ok {
+			close(ch)
+			delete(p.subscribers, id)
+		}
+	}
+}
+
+// SubscribeDiscovery returns a channel receiving the series added to and removed from the source registry, and the function
+// ending the subscription. The events are dropped while the channel is full. The channel is closed by the shutdown
+func (c *Controller) SubscribeDiscovery() (<-chan DiscoveryEvent, func()) {
+	return c.events.subscribe()
+}
@@ -0,0 +1,542 @@
+package sync
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"sort"
+	gosync "sync"
+	"testing"
+	"time"
+
+	senmlprotobuf "github.com/farshidtz/senml-protobuf/go"
+	"github.com/farshidtz/senml/v2"
+	"github.com/farshidtz/senml/v2/codec"
+	"github.com/linksmart/hds-data-synchronizer/common"
+	"github.com/linksmart/historical-datastore/data"
+	_go "github.com/linksmart/historical-datastore/protobuf/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// fakeHDS serves an in-memory registry over gRPC. Its data API fails the queries and submissions until it is told to serve
+// records, so that the synchronizations keep retrying
+type fakeHDS struct {
+	addr     string
+	registry *fakeRegistry
+	data     *fakeData
+	server   *grpc.Server
+
+	// traceMutex guards the trace contexts received in the metadata of the calls, by method
+	traceMutex   gosync.Mutex
+	traceParents map[string][]string
+}
+
+// fakeData is a data API whose queries fail, or block until cancelled once held. Once serving, it stores the submitted
+// records and answers the queries like HDS, with inclusive ranges. Its subscriptions receive the published records
+type fakeData struct {
+	_go.UnimplementedDataServer
+	mutex   gosync.Mutex
+	held    bool
+	serving bool
+	// records are resolved
+	records senml.Pack
+	streams []*fakeStream
+	// subscribes counts the Subscribe calls
+	subscribes int
+	// subscribeErr is returned by Subscribe when set
+	subscribeErr error
+}
+
+// fakeStream is an open subscription
+type fakeStream struct {
+	series   []string
+	messages chan *senmlprotobuf.Message
+}
+
+func (d *fakeData) Subscribe(request *_go.SubscribeRequest, stream _go.Data_SubscribeServer) error {
+	s := &fakeStream{series: request.Series, messages: make(chan *senmlprotobuf.Message, 100)}
+	d.mutex.Lock()
+	d.subscribes++
+	if err := d.subscribeErr; err != nil {
+		d.mutex.Unlock()
+		return err
+	}
+	d.streams = append(d.streams, s)
+	d.mutex.Unlock()
+	defer func() {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		for i := range d.streams {
+			if d.streams[i] == s {
+				d.streams = append(d.streams[:i], d.streams[i+1:]...)
+				break
+			}
+		}
+	}()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case message := <-s.messages:
+			if err := stream.Send(message); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// publish sends the records of a resolved pack to the subscriptions of their series
+func (d *fakeData) publish(pack senml.Pack) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, s := range d.streams {
+		var records senml.Pack
+		for _, r := range pack {
+			for _, series := range s.series {
+				if r.Name == series {
+					records = append(records, r)
+					break
+				}
+			}
+		}
+		if len(records) > 0 {
+			message := codec.ExportProtobufMessage(records)
+			s.messages <- &message
+		}
+	}
+}
+
+// failSubscribe makes the subscriptions fail with err
+func (d *fakeData) failSubscribe(err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.subscribeErr = err
+}
+
+// subscribeCount returns the number of Subscribe calls
+func (d *fakeData) subscribeCount() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.subscribes
+}
+
+// subscriptions returns the series of the open subscriptions
+func (d *fakeData) subscriptions() [][]string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var series [][]string
+	for _, s := range d.streams {
+		series = append(series, s.series)
+	}
+	return series
+}
+
+func (d *fakeData) Query(request *_go.QueryRequest, stream _go.Data_QueryServer) error {
+	d.mutex.Lock()
+	held, serving := d.held, d.serving
+	d.mutex.Unlock()
+	if held {
+		<-stream.Context().Done()
+		return stream.Context().Err()
+	}
+	if !serving {
+		return d.UnimplementedDataServer.Query(request, stream)
+	}
+	records, err := d.find(request)
+	if err != nil {
+		return err
+	}
+	perPacket := int(request.RecordPerPacket)
+	if perPacket <= 0 {
+		perPacket = 100
+	}
+	for len(records) > 0 {
+		n := perPacket
+		if n > len(records) {
+			n = len(records)
+		}
+		message := codec.ExportProtobufMessage(records[:n])
+		if err := stream.Send(&message); err != nil {
+			return err
+		}
+		records = records[n:]
+	}
+	return nil
+}
+
+func (d *fakeData) Count(ctx context.Context, request *_go.QueryRequest) (*_go.CountResponse, error) {
+	d.mutex.Lock()
+	serving := d.serving
+	d.mutex.Unlock()
+	if !serving {
+		return d.UnimplementedDataServer.Count(ctx, request)
+	}
+	request.Limit, request.Offset = 0, 0
+	records, err := d.find(request)
+	if err != nil {
+		return nil, err
+	}
+	return &_go.CountResponse{Total: int32(len(records))}, nil
+}
+
+func (d *fakeData) Submit(stream _go.Data_SubmitServer) error {
+	d.mutex.Lock()
+	serving := d.serving
+	d.mutex.Unlock()
+	if !serving {
+		return d.UnimplementedDataServer.Submit(stream)
+	}
+	for {
+		message, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&_go.Void{})
+		}
+		if err != nil {
+			return err
+		}
+		d.store(codec.ImportProtobufMessage(*message))
+	}
+}
+
+// find returns the records matching the query, sorted by time
+func (d *fakeData) find(request *_go.QueryRequest) (senml.Pack, error) {
+	from, err := time.Parse(time.RFC3339Nano, request.From)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid from: %v", err)
+	}
+	to, err := time.Parse(time.RFC3339Nano, request.To)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid to: %v", err)
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var records senml.Pack
+	for _, r := range d.records {
+		t := data.FromSenmlTime(r.Time)
+		if t.Before(from) || t.After(to) {
+			continue
+		}
+		for _, series := range request.Series {
+			if r.Name == series {
+				records = append(records, r)
+				break
+			}
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		if request.SortAsc {
+			return records[i].Time < records[j].Time
+		}
+		return records[i].Time > records[j].Time
+	})
+	if int(request.Offset) < len(records) {
+		records = records[request.Offset:]
+	} else {
+		records = nil
+	}
+	if request.Limit > 0 && int(request.Limit) < len(records) {
+		records = records[:request.Limit]
+	}
+	return records, nil
+}
+
+// serve makes the data API store the records and answer the queries, starting with the given records
+func (d *fakeData) serve(packs ...senml.Pack) {
+	d.mutex.Lock()
+	d.serving = true
+	d.mutex.Unlock()
+	for _, pack := range packs {
+		d.store(pack)
+	}
+}
+
+// store adds the records and publishes them to the subscriptions
+func (d *fakeData) store(pack senml.Pack) {
+	pack = append(senml.Pack(nil), pack...)
+	pack.Normalize()
+	d.mutex.Lock()
+	d.records = append(d.records, pack...)
+	d.mutex.Unlock()
+	d.publish(pack)
+}
+
+// stored returns the records of the series, sorted by time
+func (d *fakeData) stored(series string) senml.Pack {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var records senml.Pack
+	for _, r := range d.records {
+		if r.Name == series {
+			records = append(records, r)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time < records[j].Time })
+	return records
+}
+
+func (d *fakeData) hold() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.held = true
+}
+
+// fakeRegistry is a registry API holding the series in a map
+type fakeRegistry struct {
+	_go.UnimplementedRegistryServer
+	mutex  gosync.Mutex
+	series map[string]*_go.Series
+	// addErr is returned by Add when set
+	addErr error
+	// served counts the entries returned by GetAll
+	served int
+	// held blocks GetAll until it is closed, when set
+	held chan struct{}
+}
+
+func (r *fakeRegistry) Add(_ context.Context, series *_go.Series) (*_go.Void, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.addErr != nil {
+		return nil, r.addErr
+	}
+	if _, ok := r.series[series.Name]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, "series %s exists", series.Name)
+	}
+	r.series[series.Name] = series
+	return &_go.Void{}, nil
+}
+
+func (r *fakeRegistry) GetAll(ctx context.Context, params *_go.PageParams) (*_go.Registrations, error) {
+	r.mutex.Lock()
+	held := r.held
+	r.mutex.Unlock()
+	if held != nil {
+		select {
+		case <-held:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	names := make([]string, 0, len(r.series))
+	for name := range r.series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	from := int(params.Page-1) * int(params.PerPage)
+	to := from + int(params.PerPage)
+	if from > len(names) {
+		from = len(names)
+	}
+	if to > len(names) {
+		to = len(names)
+	}
+	registrations := &_go.Registrations{Total: int32(len(names)), Page: params.Page, PerPage: params.PerPage}
+	for _, name := range names[from:to] {
+		registrations.SeriesList = append(registrations.SeriesList, r.series[name])
+	}
+	r.served += to - from
+	return registrations, nil
+}
+
+func (r *fakeRegistry) Get(_ context.Context, name *_go.SeriesName) (*_go.Series, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	series, ok := r.series[name.Series]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "series %s not found", name.Series)
+	}
+	return series, nil
+}
+
+func (r *fakeRegistry) Delete(_ context.Context, name *_go.SeriesName) (*_go.Void, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.series, name.Series)
+	return &_go.Void{}, nil
+}
+
+func (r *fakeRegistry) add(names ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, name := range names {
+		r.series[name] = &_go.Series{Name: name, Type: _go.Series_Float}
+	}
+}
+
+// hold blocks the listings of the registry until release is called
+func (r *fakeRegistry) hold() (release func()) {
+	held := make(chan struct{})
+	r.mutex.Lock()
+	r.held = held
+	r.mutex.Unlock()
+	return func() {
+		r.mutex.Lock()
+		r.held = nil
+		r.mutex.Unlock()
+		close(held)
+	}
+}
+
+// servedCount returns the number of entries returned by GetAll
+func (r *fakeRegistry) servedCount() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.served
+}
+
+func (r *fakeRegistry) failAdd(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.addErr = err
+}
+
+func (r *fakeRegistry) remove(names ...string) {
+	for _, name := range names {
+		r.Delete(context.Background(), &_go.SeriesName{Series: name})
+	}
+}
+
+func startFakeHDS(t *testing.T, conf common.TLSConfig) *fakeHDS {
+	certificate, err := conf.KeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := conf.CertPool(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &fakeHDS{registry: &fakeRegistry{series: make(map[string]*_go.Series)}, data: &fakeData{}, traceParents: make(map[string][]string)}
+	h.server = grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})), grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		h.receivedMetadata(ctx, info.FullMethod)
+		return handler(ctx, req)
+	}), grpc.StreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		h.receivedMetadata(stream.Context(), info.FullMethod)
+		return handler(srv, stream)
+	}))
+	_go.RegisterRegistryServer(h.server, h.registry)
+	_go.RegisterDataServer(h.server, h.data)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.addr = listener.Addr().String()
+	go h.server.Serve(listener)
+	t.Cleanup(h.server.Stop)
+	return h
+}
+
+// receivedMetadata keeps the trace context propagated in the metadata of a call
+func (h *fakeHDS) receivedMetadata(ctx context.Context, method string) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	h.traceMutex.Lock()
+	defer h.traceMutex.Unlock()
+	h.traceParents[method] = append(h.traceParents[method], md.Get("traceparent")...)
+}
+
+// receivedTraceParents returns the trace contexts received in the calls of the method
+func (h *fakeHDS) receivedTraceParents(method string) []string {
+	h.traceMutex.Lock()
+	defer h.traceMutex.Unlock()
+	return append([]string(nil), h.traceParents[method]...)
+}
+
+// newTestController returns a controller synchronizing two fake HDS instances
+func newTestController(t *testing.T, configure func(conf *common.Config)) (*Controller, *fakeHDS, *fakeHDS) {
+	conf, src, dst := newTestConfig(t)
+	if configure != nil {
+		configure(conf)
+	}
+	c, err := NewController(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, src, dst
+}
+
+// newTestConfig returns the configuration of a controller synchronizing two fake HDS instances
+func newTestConfig(t *testing.T) (*common.Config, *fakeHDS, *fakeHDS) {
+	tlsConf := writeTestCertificates(t)
+	src, dst := startFakeHDS(t, tlsConf), startFakeHDS(t, tlsConf)
+	conf := &common.Config{
+		Source:       "dns://" + src.addr,
+		Destination:  "dns://" + dst.addr,
+		SyncInterval: "0",
+		TLS:          tlsConf,
+		Retry:        common.RetryConfig{InitialBackoff: "10ms", MaxBackoff: "50ms"},
+	}
+	return conf, src, dst
+}
+
+// writeTestCertificates writes a CA and a certificate for 127.0.0.1 signed by it, used by both the servers and the clients
+func writeTestCertificates(t *testing.T) common.TLSConfig {
+	dir := t.TempDir()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := common.TLSConfig{CA: filepath.Join(dir, "ca.cert"), Cert: filepath.Join(dir, "cert"), Key: filepath.Join(dir, "key")}
+	for path, block := range map[string]*pem.Block{
+		conf.CA:   {Type: "CERTIFICATE", Bytes: caDER},
+		conf.Cert: {Type: "CERTIFICATE", Bytes: der},
+		conf.Key:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return conf
+}
@@ -0,0 +1,174 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/connectivity"
+)
+
+const (
+	// defaultMinHealthyRatio is the share of healthy series required for readiness when not configured
+	defaultMinHealthyRatio = 0.9
+	// defaultStallTimeout is the time a registry call of the discovery may take before the process is reported not alive
+	defaultStallTimeout = 5 * time.Minute
+	// discoveryMaxAgeFactor gives the default maximum age of the last successful discovery, in discovery intervals
+	discoveryMaxAgeFactor = 3
+)
+
+// healthThresholds decide when the synchronizer is reported alive and ready
+type healthThresholds struct {
+	// minHealthyRatio is the share of the series which must be neither degraded nor stopped
+	minHealthyRatio float64
+	// discoveryMaxAge is the maximum age of the last successful discovery
+	discoveryMaxAge time.Duration
+	// stallTimeout is the maximum duration of a registry call of the discovery
+	stallTimeout time.Duration
+}
+
+// discoveryHealth tracks the outcome of the discoveries for the health checks
+type discoveryHealth struct {
+	sync.Mutex
+	// busySince is the start of the running registry call. Zero when idle
+	busySince time.Time
+	// succeeded is the end of the last successful discovery
+	succeeded time.Time
+	// err is the error of the last discovery
+	err error
+}
+
+// begin is called before a registry call of the discovery
+func (d *discoveryHealth) begin() {
+	d.Lock()
+	defer d.Unlock()
+	d.busySince = time.Now()
+}
+
+// idle is called after a registry call which does not complete a discovery
+func (d *discoveryHealth) idle() {
+	d.Lock()
+	defer d.Unlock()
+	d.busySince = time.Time{}
+}
+
+// finished records the outcome of a discovery
+func (d *discoveryHealth) finished(err error) {
+	d.Lock()
+	defer d.Unlock()
+	d.busySince = time.Time{}
+	d.err = err
+	if err == nil {
+		d.succeeded = time.Now()
+	}
+}
+
+// HealthCheck is the outcome of a single check
+type HealthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// HealthReport is the outcome of the liveness or the readiness checks
+type HealthReport struct {
+	OK     bool          `json:"ok"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+func (r *HealthReport) add(name string, ok bool, detail string) {
+	r.Checks = append(r.Checks, HealthCheck{Name: name, OK: ok, Detail: detail})
+	r.OK = r.OK && ok
+}
+
+// Liveness reports whether the process makes progress. It fails when a registry call of the discovery hangs
+func (c *Controller) Liveness() HealthReport {
+	report := HealthReport{OK: true}
+	c.discoveryHealth.Lock()
+	busySince := c.discoveryHealth.busySince
+	c.discoveryHealth.Unlock()
+	if !busySince.IsZero() && time.Since(busySince) > c.health.stallTimeout {
+		report.add("discovery", false, fmt.Sprintf("registry call running for %v", time.Since(busySince).Round(time.Second)))
+	} else {
+		report.add("discovery", true, "responsive")
+	}
+	return report
+}
+
+// Readiness reports whether the synchronizer does its job: both endpoints are connected, the registry was discovered recently
+// and enough of the series are healthy
+func (c *Controller) Readiness() HealthReport {
+	report := HealthReport{OK: true}
+	if c.isStopping() {
+		report.add("shutdown", false, "shutting down")
+	}
+	c.endpointHealth(&report, "source", c.srcConn, c.resources.srcBreaker)
+	c.endpointHealth(&report, "destination", c.dstConn, c.resources.dstBreaker)
+
+	c.discoveryHealth.Lock()
+	succeeded, err := c.discoveryHealth.succeeded, c.discoveryHealth.err
+	c.discoveryHealth.Unlock()
+	switch {
+	case succeeded.IsZero() && err != nil:
+		report.add("discovery", false, fmt.Sprintf("never succeeded: %v", err))
+	case succeeded.IsZero():
+		report.add("discovery", false, "not completed yet")
+	case time.Since(succeeded) > c.health.discoveryMaxAge:
+		report.add("discovery", false, fmt.Sprintf("last success %v ago: %v", time.Since(succeeded).Round(time.Second), err))
+	default:
+		report.add("discovery", true, fmt.Sprintf("last success %v ago", time.Since(succeeded).Round(time.Second)))
+	}
+
+	healthy, total := 0, 0
+	for _, s := range c.synchronizers() {
+		total++
+		if stage := s.Lifecycle().Stage; stage != LifecycleDegraded && stage != LifecycleStopped {
+			healthy++
+		}
+	}
+	ratio := 1.0
+	if total > 0 {
+		ratio = float64(healthy) / float64(total)
+	}
+	report.add("series", ratio >= c.health.minHealthyRatio, fmt.Sprintf("%d of %d series healthy, %.0f%% required", healthy, total, c.health.minHealthyRatio*100))
+	return report
+}
+
+// endpointHealth checks the connection and the circuit breaker of an endpoint
+func (c *Controller) endpointHealth(report *HealthReport, name string, conn *connection, breaker *circuitBreaker) {
+	state := conn.state()
+	if state != connectivity.Ready && state != connectivity.Idle {
+		report.add(name, false, fmt.Sprintf("connection to %s is %v", conn.endpoint, state))
+		return
+	}
+	if breaker.State() == breakerOpen {
+		report.add(name, false, fmt.Sprintf("circuit breaker of %s is open", conn.endpoint))
+		return
+	}
+	report.add(name, true, fmt.Sprintf("connection to %s is %v", conn.endpoint, state))
+}
+
+// HealthHandler serves the liveness at /healthz and the readiness at /readyz. The status is 503 when a check fails
+func (c *Controller) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, c.Liveness())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, c.Readiness())
+	})
+	return mux
+}
+
+func writeHealth(w http.ResponseWriter, report HealthReport) {
+	status := http.StatusOK
+	if !report.OK {
+		status = http.StatusServiceUnavailable
+	}
+	b, _ := json.Marshal(report)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
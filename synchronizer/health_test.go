@@ -0,0 +1,107 @@
+package sync
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linksmart/hds-data-synchronizer/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestReadiness(t *testing.T) {
+	c, src, dst := newTestController(t, func(conf *common.Config) {
+		conf.Health.DiscoveryMaxAge = "1s"
+	})
+	defer c.Shutdown()
+	if code := healthStatus(c, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected not ready before the first discovery, got %d", code)
+	}
+	if check := healthCheck(c.Readiness(), "discovery"); check.OK || check.Detail != "not completed yet" {
+		t.Fatalf("expected the discovery check to fail, got %+v", check)
+	}
+
+	src.data.serve(testPack("a", 0))
+	dst.data.serve()
+	src.registry.add("a")
+	c.runDiscovery(registryState{})
+	if report := c.Readiness(); !report.OK {
+		t.Fatalf("expected ready, got %+v", report)
+	}
+	if code := healthStatus(c, "/readyz"); code != http.StatusOK {
+		t.Fatalf("expected ready, got %d", code)
+	}
+	waitStored(t, dst, "a", []float64{0})
+
+	// half of the series are degraded, below the default ratio
+	src.data.failSubscribe(status.Error(codes.FailedPrecondition, "no subscriptions"))
+	src.registry.add("b")
+	c.runDiscovery(registryState{})
+	waitHealth(t, c.Readiness, "series", false)
+	if check := healthCheck(c.Readiness(), "series"); check.Detail != "1 of 2 series healthy, 90% required" {
+		t.Fatalf("expected 1 of 2 series healthy, got %+v", check)
+	}
+
+	// the discovery is too old once it did not succeed for longer than the maximum age
+	waitHealth(t, c.Readiness, "discovery", false)
+	if check := healthCheck(c.Readiness(), "discovery"); !strings.HasPrefix(check.Detail, "last success") {
+		t.Fatalf("expected the last discovery to be too old, got %+v", check)
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	c, src, _ := newTestController(t, func(conf *common.Config) {
+		conf.Health.StallTimeout = "100ms"
+	})
+	defer c.Shutdown()
+	if code := healthStatus(c, "/healthz"); code != http.StatusOK {
+		t.Fatalf("expected alive, got %d", code)
+	}
+
+	// a registry call hanging longer than the stall timeout fails the liveness, until it returns
+	release := src.registry.hold()
+	done := make(chan struct{})
+	go func() {
+		c.runDiscovery(registryState{})
+		close(done)
+	}()
+	waitHealth(t, c.Liveness, "discovery", false)
+	if code := healthStatus(c, "/healthz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected not alive while the discovery hangs, got %d", code)
+	}
+	release()
+	<-done
+	if report := c.Liveness(); !report.OK {
+		t.Fatalf("expected alive once the discovery returned, got %+v", report)
+	}
+}
+
+// healthStatus returns the HTTP status of the health endpoint
+func healthStatus(c *Controller, path string) int {
+	w := httptest.NewRecorder()
+	c.HealthHandler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w.Code
+}
+
+func healthCheck(report HealthReport, name string) HealthCheck {
+	for _, check := range report.Checks {
+		if check.Name == name {
+			return check
+		}
+	}
+	return HealthCheck{Name: name}
+}
+
+// waitHealth waits until the named check of the report has the given outcome
+func waitHealth(t *testing.T, report func() HealthReport, name string, ok bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for healthCheck(report(), name).OK != ok {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the %s check to be %v, got %+v", name, ok, report())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,338 @@
+package sync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/farshidtz/senml/v2"
+	"github.com/linksmart/hds-data-synchronizer/common"
+	"github.com/linksmart/historical-datastore/data"
+)
+
+// the kinds of the journal entries
+const (
+	JournalLive      = "live"
+	JournalMigration = "migration"
+	JournalResync    = "resync"
+)
+
+// JournalEntry records the records of a series copied to the destination
+type JournalEntry struct {
+	// Time is when the copy ended
+	Time        time.Time `json:"time"`
+	Instance    string    `json:"instance"`
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	Series      string    `json:"series"`
+	Kind        string    `json:"kind"`
+	// From and To are the range copied: the range of the migration, or the times of the first and the latest record submitted live
+	// within a flush interval
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// Count is the number of records submitted
+	Count int `json:"count"`
+	// Checksum is the SHA-256 of the JSON encodings of the normalized records, one per line, in the order of submission
+	Checksum string `json:"checksum"`
+	// Complete is false for a migration aborted after copying part of its range. To is then the time of the latest record copied
+	Complete bool `json:"complete"`
+}
+
+const (
+	// defaultJournalFlushInterval is the interval of the writes of the journal when not configured
+	defaultJournalFlushInterval = time.Second
+	// journalBatchSize is the number of buffered entries which are written without waiting for the interval
+	journalBatchSize = 100
+)
+
+// journal appends an entry for every range copied to a local file. The entries are buffered, then written and synced every
+// flush interval or once a batch is full. The live batches of a series within an interval are recorded as a single entry.
+// A nil journal records nothing
+type journal struct {
+	sync.Mutex
+	file *os.File
+	// buffer holds the entries not written yet, and buffered is their number
+	buffer   bytes.Buffer
+	buffered int
+	// live accumulates the records of each series submitted live since the last flush
+	live map[string]*liveRange
+
+	instance      string
+	source        string
+	destination   string
+	flushInterval time.Duration
+	stop          chan struct{}
+	done          chan struct{}
+	log           *common.Logger
+}
+
+// liveRange is the pending journal entry of the records of a series submitted live
+type liveRange struct {
+	from, to time.Time
+	// ended is the time of the latest submission
+	ended  time.Time
+	copied *journalRange
+}
+
+func openJournal(conf common.JournalConfig, source, destination string, logger *common.Logger) (*journal, error) {
+	if conf.Path == "" {
+		return nil, nil
+	}
+	instance := conf.Instance
+	if instance == "" {
+		var err error
+		instance, err = os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("error getting the instance name: %w", err)
+		}
+	}
+	flushInterval := defaultJournalFlushInterval
+	if conf.FlushInterval != "" {
+		var err error
+		flushInterval, err = time.ParseDuration(conf.FlushInterval)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse journal flush interval:%w", err)
+		}
+		if flushInterval <= 0 {
+			return nil, fmt.Errorf("journal flush interval must be positive")
+		}
+	}
+	file, err := os.OpenFile(conf.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening journal: %w", err)
+	}
+	j := &journal{
+		file:          file,
+		live:          make(map[string]*liveRange),
+		instance:      instance,
+		source:        source,
+		destination:   destination,
+		flushInterval: flushInterval,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+		log:           logger,
+	}
+	go j.run()
+	return j, nil
+}
+
+// run flushes the journal at every interval
+func (j *journal) run() {
+	defer close(j.done)
+	ticker := time.NewTicker(j.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-ticker.C:
+			j.Lock()
+			j.flushLocked()
+			j.Unlock()
+		}
+	}
+}
+
+// record adds the entry of a range of the series. A failure to write is logged, as it must not stop the synchronization
+func (j *journal) record(series, kind string, from, to time.Time, copied *journalRange, complete bool) {
+	if j == nil {
+		return
+	}
+	j.Lock()
+	defer j.Unlock()
+	j.write(j.entry(time.Now(), series, kind, from, to, copied, complete))
+	if j.buffered >= journalBatchSize {
+		j.flushLocked()
+	}
+}
+
+// recordLive adds the normalized records submitted live to the pending entry of the series
+func (j *journal) recordLive(series string, pack senml.Pack) {
+	if j == nil {
+		return
+	}
+	first, last := packRange(pack)
+	j.Lock()
+	defer j.Unlock()
+	r, ok := j.live[series]
+	if !ok {
+		r = &liveRange{from: first, to: last, copied: j.newRange()}
+		j.live[series] = r
+	}
+	if first.Before(r.from) {
+		r.from = first
+	}
+	if last.After(r.to) {
+		r.to = last
+	}
+	r.ended = time.Now()
+	r.copied.add(pack)
+}
+
+func (j *journal) entry(ended time.Time, series, kind string, from, to time.Time, copied *journalRange, complete bool) JournalEntry {
+	return JournalEntry{
+		Time:        ended,
+		Instance:    j.instance,
+		Source:      j.source,
+		Destination: j.destination,
+		Series:      series,
+		Kind:        kind,
+		From:        from,
+		To:          to,
+		Count:       copied.count,
+		Checksum:    hex.EncodeToString(copied.hash.Sum(nil)),
+		Complete:    complete,
+	}
+}
+
+// write adds the entry to the buffer. Must be called with the lock held
+func (j *journal) write(entry JournalEntry) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		j.log.With("series", entry.Series).Errorf("error encoding journal entry: %v", err)
+		return
+	}
+	j.buffer.Write(append(b, '\n'))
+	j.buffered++
+}
+
+// flushLocked adds the entries of the live ranges, then writes the buffered entries to the file and syncs it. Must be called with the lock held
+func (j *journal) flushLocked() {
+	series := make([]string, 0, len(j.live))
+	for name := range j.live {
+		series = append(series, name)
+	}
+	sort.Strings(series)
+	for _, name := range series {
+		r := j.live[name]
+		j.write(j.entry(r.ended, name, JournalLive, r.from, r.to, r.copied, true))
+	}
+	j.live = make(map[string]*liveRange)
+	if j.buffered == 0 {
+		return
+	}
+	j.buffered = 0
+	_, err := j.file.Write(j.buffer.Bytes())
+	j.buffer.Reset()
+	if err != nil {
+		j.log.Errorf("error writing journal: %v", err)
+		return
+	}
+	err = j.file.Sync()
+	if err != nil {
+		j.log.Errorf("error syncing journal: %v", err)
+	}
+}
+
+// newRange returns the accumulator of the records of a range. nil if the journal is disabled
+func (j *journal) newRange() *journalRange {
+	if j == nil {
+		return nil
+	}
+	return &journalRange{hash: sha256.New()}
+}
+
+// close writes the pending entries and closes the file
+func (j *journal) close() error {
+	if j == nil {
+		return nil
+	}
+	close(j.stop)
+	<-j.done
+	j.Lock()
+	defer j.Unlock()
+	j.flushLocked()
+	return j.file.Close()
+}
+
+// journalRange counts and hashes the records copied for a journal entry. A nil range ignores the records
+type journalRange struct {
+	hash  hash.Hash
+	count int
+}
+
+// add accumulates the normalized records
+func (r *journalRange) add(pack senml.Pack) {
+	if r == nil {
+		return
+	}
+	for _, record := range pack {
+		b, _ := json.Marshal(record)
+		r.hash.Write(b)
+		r.hash.Write([]byte{'\n'})
+	}
+	r.count += len(pack)
+}
+
+// JournalQuery selects the journal entries of the series matching a pattern, with the syntax of path.Match, which overlap a time range.
+// The empty fields match everything
+type JournalQuery struct {
+	Series string
+	From   time.Time
+	To     time.Time
+}
+
+func (q JournalQuery) matches(entry JournalEntry) bool {
+	if q.Series != "" {
+		if ok, _ := path.Match(q.Series, entry.Series); !ok {
+			return false
+		}
+	}
+	if !q.From.IsZero() && entry.To.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && entry.From.After(q.To) {
+		return false
+	}
+	return true
+}
+
+// QueryJournal copies the entries of the journal matching the query to w, as JSON lines
+func QueryJournal(r io.Reader, w io.Writer, q JournalQuery) error {
+	if _, err := path.Match(q.Series, ""); err != nil {
+		return fmt.Errorf("invalid series pattern %q: %w", q.Series, err)
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var entry JournalEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return fmt.Errorf("invalid journal entry at line %d: %w", line, err)
+		}
+		if !q.matches(entry) {
+			continue
+		}
+		_, err = w.Write(append(scanner.Bytes(), '\n'))
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// packRange returns the times of the first and the latest record of the normalized pack
+func packRange(pack senml.Pack) (first, last time.Time) {
+	for i, r := range pack {
+		t := data.FromSenmlTime(r.Time)
+		if i == 0 || t.Before(first) {
+			first = t
+		}
+		if i == 0 || t.After(last) {
+			last = t
+		}
+	}
+	return first, last
+}
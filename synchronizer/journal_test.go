@@ -0,0 +1,106 @@
+package sync
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/linksmart/hds-data-synchronizer/common"
+	"github.com/linksmart/historical-datastore/data"
+)
+
+func TestJournalBatches(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	j, err := openJournal(common.JournalConfig{Path: path, Instance: "test", FlushInterval: "1h"}, "src", "dst", common.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the live packs of a series are merged, and nothing is written before the batch is full
+	live := [][]float64{{10, 11}, {12}, {9}}
+	for _, times := range live {
+		j.recordLive("a", testPack("a", times...))
+	}
+	j.recordLive("b", testPack("b", 20))
+	for i := 0; i < journalBatchSize-1; i++ {
+		j.record("c", JournalMigration, time.Time{}, time.Time{}, j.newRange(), true)
+	}
+	if entries := readJournal(t, path); len(entries) != 0 {
+		t.Fatalf("expected the entries to be buffered, got %d", len(entries))
+	}
+
+	// the batch is written once full, along with the live entries
+	j.record("c", JournalMigration, time.Time{}, time.Time{}, j.newRange(), true)
+	entries := readJournal(t, path)
+	if len(entries) != journalBatchSize+2 {
+		t.Fatalf("expected %d entries, got %d", journalBatchSize+2, len(entries))
+	}
+	a := entries[journalBatchSize]
+	want := j.newRange()
+	for _, times := range live {
+		want.add(testPack("a", times...))
+	}
+	wantEntry := j.entry(a.Time, "a", JournalLive, data.FromSenmlTime(testEpoch+9), data.FromSenmlTime(testEpoch+12), want, true)
+	if got, want := mustJSON(t, a), mustJSON(t, wantEntry); got != want {
+		t.Fatalf("expected the live entry %s, got %s", want, got)
+	}
+	if b := entries[journalBatchSize+1]; b.Series != "b" || b.Count != 1 {
+		t.Fatalf("expected the live entry of b, got %+v", b)
+	}
+
+	// the entries left are written when closed
+	j.recordLive("a", testPack("a", 13))
+	if err := j.close(); err != nil {
+		t.Fatal(err)
+	}
+	entries = readJournal(t, path)
+	if last := entries[len(entries)-1]; len(entries) != journalBatchSize+3 || last.Series != "a" || last.Count != 1 {
+		t.Fatalf("expected the live entry of a written on close, got %d entries ending with %+v", len(entries), last)
+	}
+}
+
+func TestJournalFlushInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	j, err := openJournal(common.JournalConfig{Path: path, Instance: "test", FlushInterval: "50ms"}, "src", "dst", common.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.close()
+	j.recordLive("a", testPack("a", 10))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(readJournal(t, path)) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the entry to be written at the interval")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// readJournal returns the entries written to the journal file
+func readJournal(t *testing.T, path string) []JournalEntry {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid journal entry %s: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
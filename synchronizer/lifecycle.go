@@ -0,0 +1,211 @@
+package sync
+
+import (
+	"context"
+	"time"
+)
+
+// Lifecycle is the stage of the synchronization of a series
+type Lifecycle string
+
+const (
+	// LifecycleDiscovered is the stage of a series found in the source registry
+	LifecycleDiscovered Lifecycle = "discovered"
+	// LifecycleCreating is the stage while the series is created at the destination
+	LifecycleCreating Lifecycle = "creating"
+	// LifecycleBackfilling is the stage while the destination catches up with the source
+	LifecycleBackfilling Lifecycle = "backfilling"
+	// LifecycleLive is the stage of a series in sync, either live or at the interval of its periodic synchronization
+	LifecycleLive Lifecycle = "live"
+	// LifecyclePaused is the stage of a series outside of its schedule
+	LifecyclePaused Lifecycle = "paused"
+	// LifecycleDegraded is the stage of a series whose synchronization fails and is retried
+	LifecycleDegraded Lifecycle = "degraded"
+	// LifecycleStopped is the final stage, once the synchronization returned
+	LifecycleStopped Lifecycle = "stopped"
+)
+
+// lifecycleTransitions lists the stages which may follow each stage
+var lifecycleTransitions = map[Lifecycle][]Lifecycle{
+	LifecycleDiscovered:  {LifecycleCreating, LifecycleStopped},
+	LifecycleCreating:    {LifecycleBackfilling, LifecycleLive, LifecyclePaused, LifecycleDegraded, LifecycleStopped},
+	LifecycleBackfilling: {LifecycleLive, LifecyclePaused, LifecycleDegraded, LifecycleStopped},
+	LifecycleLive:        {LifecycleBackfilling, LifecyclePaused, LifecycleDegraded, LifecycleStopped},
+	LifecyclePaused:      {LifecycleBackfilling, LifecycleLive, LifecycleDegraded, LifecycleStopped},
+	LifecycleDegraded:    {LifecycleBackfilling, LifecycleLive, LifecyclePaused, LifecycleStopped},
+	LifecycleStopped:     {},
+}
+
+// canTransition returns true if the stage to may follow the stage from
+func canTransition(from, to Lifecycle) bool {
+	for _, next := range lifecycleTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// LifecycleStatus is the stage of a series and the time at which it was entered
+type LifecycleStatus struct {
+	Stage Lifecycle `json:"stage"`
+	Since time.Time `json:"since"`
+}
+
+// Lifecycle returns the current stage of the synchronization
+func (s *Synchronizer) Lifecycle() LifecycleStatus {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	return s.lifecycle
+}
+
+// transition moves the synchronization to the given stage. Staying in the same stage is a no-op,
+// and invalid transitions are logged and refused, keeping the current stage
+func (s *Synchronizer) transition(to Lifecycle) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	from := s.lifecycle.Stage
+	if from == to {
+		return
+	}
+	if !canTransition(from, to) {
+		s.log.Warnf("invalid lifecycle transition from %s to %s", from, to)
+		return
+	}
+	s.log.Infof("%s -> %s", from, to)
+	if from == LifecycleLive {
+		s.leftLive = time.Now()
+	}
+	s.lifecycle = LifecycleStatus{Stage: to, Since: time.Now()}
+	if to == LifecycleLive {
+		s.metrics.errorStreak = 0
+	}
+}
+
+// SeriesStatus is the state of the synchronization of a series
+type SeriesStatus struct {
+	Series    string          `json:"series"`
+	Lifecycle LifecycleStatus `json:"lifecycle"`
+	Migration MigrationState  `json:"migration"`
+	// Interval is the current interval of the periodic synchronization. 0 for a live synchronization
+	Interval time.Duration `json:"interval"`
+	// Skew is how far the latest record was ahead of the clock when last observed
+	Skew time.Duration `json:"skew"`
+	// Paused is set while the synchronization is paused explicitly
+	Paused bool `json:"paused"`
+	// Mode is "live" or "periodic"
+	Mode string `json:"mode"`
+	// SourceLatest and DestinationLatest are the times of the latest records of the series at the source and at the destination
+	SourceLatest      time.Time `json:"sourceLatest"`
+	DestinationLatest time.Time `json:"destinationLatest"`
+	// Lag is the time between the latest records at the source and at the destination. 0 until the destination has a record
+	Lag time.Duration `json:"lag"`
+	// LastLive is the last time the synchronization was live: now while it is live, otherwise when it left the live stage.
+	// Zero if it was never live
+	LastLive time.Time `json:"lastLive"`
+	// LastError is the latest failure of the synchronization, if any
+	LastError *SeriesError `json:"lastError,omitempty"`
+	// ErrorStreak is the number of failed attempts since the synchronization was last live
+	ErrorStreak int `json:"errorStreak"`
+}
+
+// SeriesError is a failure of the synchronization of a series
+type SeriesError struct {
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// Status returns the state of the synchronization
+func (s *Synchronizer) Status() SeriesStatus {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	status := SeriesStatus{
+		Series:            s.series,
+		Lifecycle:         s.lifecycle,
+		Migration:         s.migrationState,
+		Interval:          s.effectiveInterval,
+		Skew:              s.skewObserved,
+		Paused:            s.pausedExplicitly,
+		Mode:              "live",
+		SourceLatest:      s.src.lastTS,
+		DestinationLatest: s.dst.lastTS,
+		LastError:         s.lastError,
+		ErrorStreak:       s.metrics.errorStreak,
+	}
+	if s.effectiveInterval != 0 {
+		status.Mode = "periodic"
+	}
+	if !s.src.lastTS.IsZero() && !s.dst.lastTS.IsZero() && s.src.lastTS.After(s.dst.lastTS) {
+		status.Lag = s.src.lastTS.Sub(s.dst.lastTS)
+	}
+	status.LastLive = s.leftLive
+	if s.lifecycle.Stage == LifecycleLive {
+		status.LastLive = time.Now()
+	}
+	return status
+}
+
+// pause interrupts the synchronization until resume is called
+func (s *Synchronizer) pause() {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	if s.pausedExplicitly {
+		return
+	}
+	s.log.Infof("pausing")
+	s.pausedExplicitly = true
+	close(s.pauseCh)
+	s.resumeCh = make(chan struct{})
+}
+
+// resume continues the synchronization after pause
+func (s *Synchronizer) resume() {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	if !s.pausedExplicitly {
+		return
+	}
+	s.log.Infof("resuming")
+	s.pausedExplicitly = false
+	close(s.resumeCh)
+	s.pauseCh = make(chan struct{})
+}
+
+func (s *Synchronizer) isPaused() bool {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	return s.pausedExplicitly
+}
+
+// waitForResume blocks while the synchronization is paused. It returns false if the synchronization is stopped meanwhile
+func (s *Synchronizer) waitForResume() bool {
+	s.stateMutex.Lock()
+	paused, resumed := s.pausedExplicitly, s.resumeCh
+	s.stateMutex.Unlock()
+	if !paused {
+		return true
+	}
+	s.transition(LifecyclePaused)
+	select {
+	case <-resumed:
+		return true
+	case <-s.stopCtx.Done():
+		return false
+	}
+}
+
+// pauseContext returns a copy of ctx which is cancelled when the synchronization is paused
+func (s *Synchronizer) pauseContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	s.stateMutex.Lock()
+	paused := s.pauseCh
+	s.stateMutex.Unlock()
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-paused:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
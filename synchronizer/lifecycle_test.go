@@ -0,0 +1,47 @@
+package sync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/linksmart/hds-data-synchronizer/common"
+)
+
+func TestTransition(t *testing.T) {
+	since := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name string
+		from Lifecycle
+		to   Lifecycle
+		want Lifecycle
+		// moved tells whether the time of the stage is updated
+		moved bool
+	}{
+		{name: "valid transition", from: LifecycleBackfilling, to: LifecycleLive, want: LifecycleLive, moved: true},
+		{name: "same stage", from: LifecycleLive, to: LifecycleLive, want: LifecycleLive},
+		{name: "restart after stopped", from: LifecycleStopped, to: LifecycleLive, want: LifecycleStopped},
+		{name: "live before created", from: LifecycleDiscovered, to: LifecycleLive, want: LifecycleDiscovered},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &Synchronizer{series: "a", lifecycle: LifecycleStatus{Stage: test.from, Since: since}, log: common.Log}
+			s.metrics.errorStreak = 3
+			s.transition(test.to)
+			got := s.Lifecycle()
+			if got.Stage != test.want {
+				t.Fatalf("expected the stage %s, got %s", test.want, got.Stage)
+			}
+			if moved := !got.Since.Equal(since); moved != test.moved {
+				t.Fatalf("expected the time of the stage to be updated: %v, got %v", test.moved, got.Since)
+			}
+			// only the transitions to live reset the errors
+			wantStreak := 3
+			if test.moved && test.want == LifecycleLive {
+				wantStreak = 0
+			}
+			if s.metrics.errorStreak != wantStreak {
+				t.Fatalf("expected the error streak %d, got %d", wantStreak, s.metrics.errorStreak)
+			}
+		})
+	}
+}
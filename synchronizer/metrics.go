@@ -0,0 +1,249 @@
+package sync
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/farshidtz/senml/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// seriesMetrics are the counters of the synchronization of a series
+type seriesMetrics struct {
+	// records and bytes count the records submitted to the destination, live or by migrations
+	records int64
+	bytes   int64
+	// errors counts the failed synchronization attempts
+	errors int64
+	// queryErrors and submitErrors count the failed calls to the source and to the destination
+	queryErrors  int64
+	submitErrors int64
+	// errorStreak is the number of failed attempts since the synchronization was last live
+	errorStreak int
+	// buffered is the number of records received live and not submitted yet
+	buffered int
+	// migrationFrom and migrationTo are the range of the current or last migration, and migrationPosition the latest record it submitted
+	migrationFrom     time.Time
+	migrationTo       time.Time
+	migrationPosition time.Time
+}
+
+// seriesSnapshot is the state of a synchronization exposed as metrics
+type seriesSnapshot struct {
+	series    string
+	stage     Lifecycle
+	srcLatest time.Time
+	dstLatest time.Time
+	metrics   seriesMetrics
+}
+
+// submitted counts the records submitted live
+func (s *Synchronizer) submitted(pack senml.Pack) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.metrics.records += int64(len(pack))
+	s.metrics.bytes += int64(packSize(pack))
+}
+
+// migrated counts the normalized records submitted by a migration and tracks its progress
+func (s *Synchronizer) migrated(pack senml.Pack) {
+	latest := getLatestInPack(pack)
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.metrics.records += int64(len(pack))
+	s.metrics.bytes += int64(packSize(pack))
+	if latest.After(s.metrics.migrationPosition) {
+		s.metrics.migrationPosition = latest
+	}
+}
+
+func (s *Synchronizer) migrationStarted(from, to time.Time) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.metrics.migrationFrom = from
+	s.metrics.migrationTo = to
+	s.metrics.migrationPosition = from
+}
+
+// recordSrc passes the outcome of a call to the source to its circuit breaker, and counts the failure for the series
+func (s *Synchronizer) recordSrc(ctx context.Context, err error) {
+	s.src.breaker.record(ctx, err)
+	if err != nil && ctx.Err() == nil {
+		s.callFailed(true)
+	}
+}
+
+// recordDst passes the outcome of a call to the destination to its circuit breaker, and counts the failure for the series
+func (s *Synchronizer) recordDst(ctx context.Context, err error) {
+	s.dst.breaker.record(ctx, err)
+	if err != nil && ctx.Err() == nil {
+		s.callFailed(false)
+	}
+}
+
+// callFailed counts a failed call to the source, if source is set, or to the destination
+func (s *Synchronizer) callFailed(source bool) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	if source {
+		s.metrics.queryErrors++
+	} else {
+		s.metrics.submitErrors++
+	}
+}
+
+// failed counts a failed synchronization attempt and keeps its error
+func (s *Synchronizer) failed(err error) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.metrics.errors++
+	s.lastError = &SeriesError{Message: err.Error(), Time: time.Now()}
+}
+
+// failedAttempt counts a failed attempt of the synchronization itself, which extends the error streak until it is live again
+func (s *Synchronizer) failedAttempt(err error) {
+	s.failed(err)
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.metrics.errorStreak++
+}
+
+func (s *Synchronizer) setBuffered(n int) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.metrics.buffered = n
+}
+
+func (s *Synchronizer) snapshot() seriesSnapshot {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	return seriesSnapshot{
+		series:    s.series,
+		stage:     s.lifecycle.Stage,
+		srcLatest: s.src.lastTS,
+		dstLatest: s.dst.lastTS,
+		metrics:   s.metrics,
+	}
+}
+
+// backfillProgress returns the completed share of the current migration. Chunked migrations progress by chunk,
+// the others by the time of the latest record submitted. It is 1 when no migration is running
+func (s *Synchronizer) backfillProgress(snapshot seriesSnapshot) float64 {
+	if snapshot.stage != LifecycleBackfilling {
+		return 1
+	}
+	if s.chunks != nil {
+		if done, total := s.chunks.progress(s.series); total > 0 {
+			return float64(done) / float64(total)
+		}
+	}
+	m := snapshot.metrics
+	if m.migrationFrom.IsZero() {
+		// the first migration of the series starts at its first record, whose time is unknown
+		return 0
+	}
+	span := m.migrationTo.Sub(m.migrationFrom)
+	if span <= 0 {
+		return 1
+	}
+	return float64(m.migrationPosition.Sub(m.migrationFrom)) / float64(span)
+}
+
+// packSize approximates the size of the records: their strings plus 8 bytes per number
+func packSize(pack senml.Pack) int {
+	n := 0
+	for _, r := range pack {
+		n += len(r.BaseName) + len(r.BaseUnit) + len(r.Name) + len(r.Unit) + len(r.StringValue) + len(r.DataValue) + 8
+		if r.Value != nil {
+			n += 8
+		}
+		if r.Sum != nil {
+			n += 8
+		}
+		if r.BoolValue != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// MetricsHandler serves the metrics of the synchronizations in the Prometheus format
+func (c *Controller) MetricsHandler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&metricsCollector{c: c})
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// seriesLabels are the labels of the metrics of a series
+var seriesLabels = []string{"series", "destination"}
+
+var (
+	synchronizersDesc = prometheus.NewDesc("hds_sync_synchronizers", "Number of synchronizations by lifecycle stage.", []string{"stage"}, nil)
+	srcLatestDesc     = prometheus.NewDesc("hds_sync_source_latest_timestamp_seconds", "Time of the latest record of the series at the source.", seriesLabels, nil)
+	dstLatestDesc     = prometheus.NewDesc("hds_sync_destination_latest_timestamp_seconds", "Time of the latest record of the series at the destination.", seriesLabels, nil)
+	lagDesc           = prometheus.NewDesc("hds_sync_lag_seconds", "Time between the latest records of the series at the source and at the destination. Absent until the destination has a record.", seriesLabels, nil)
+	recordsDesc       = prometheus.NewDesc("hds_sync_records_total", "Records of the series submitted to the destination.", seriesLabels, nil)
+	bytesDesc         = prometheus.NewDesc("hds_sync_bytes_total", "Approximate size of the records of the series submitted to the destination.", seriesLabels, nil)
+	errorsDesc        = prometheus.NewDesc("hds_sync_errors_total", "Failed synchronization attempts of the series.", seriesLabels, nil)
+	queryErrorsDesc   = prometheus.NewDesc("hds_sync_query_errors_total", "Failed calls of the series to the source: queries and subscriptions.", seriesLabels, nil)
+	submitErrorsDesc  = prometheus.NewDesc("hds_sync_submit_errors_total", "Failed calls of the series to the destination: submissions and the queries of the latest records.", seriesLabels, nil)
+	progressDesc      = prometheus.NewDesc("hds_sync_backfill_progress_ratio", "Completed share of the running migration of the series. 1 when the series is not backfilling.", seriesLabels, nil)
+	bufferedDesc      = prometheus.NewDesc("hds_sync_buffered_records", "Records of the series received live and not submitted yet.", seriesLabels, nil)
+	migrationsDesc    = prometheus.NewDesc("hds_sync_migrations", "Migrations running and queued in the migration pool.", []string{"state"}, nil)
+)
+
+// metricsCollector collects the metrics from the state of the synchronizations when scraped
+type metricsCollector struct {
+	c *Controller
+}
+
+func (m *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{synchronizersDesc, srcLatestDesc, dstLatestDesc, lagDesc, recordsDesc, bytesDesc, errorsDesc,
+		queryErrorsDesc, submitErrorsDesc, progressDesc, bufferedDesc, migrationsDesc} {
+		ch <- desc
+	}
+}
+
+func (m *metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	c := m.c
+	stages := make(map[Lifecycle]int)
+	for _, s := range c.synchronizers() {
+		snapshot := s.snapshot()
+		stages[snapshot.stage]++
+		sample := func(desc *prometheus.Desc, kind prometheus.ValueType, value float64) {
+			ch <- prometheus.MustNewConstMetric(desc, kind, value, snapshot.series, c.destinationURL)
+		}
+		if !snapshot.srcLatest.IsZero() {
+			sample(srcLatestDesc, prometheus.GaugeValue, unixSeconds(snapshot.srcLatest))
+		}
+		if !snapshot.dstLatest.IsZero() {
+			sample(dstLatestDesc, prometheus.GaugeValue, unixSeconds(snapshot.dstLatest))
+		}
+		if !snapshot.srcLatest.IsZero() && !snapshot.dstLatest.IsZero() {
+			lag := snapshot.srcLatest.Sub(snapshot.dstLatest).Seconds()
+			if lag < 0 {
+				lag = 0
+			}
+			sample(lagDesc, prometheus.GaugeValue, lag)
+		}
+		sample(recordsDesc, prometheus.CounterValue, float64(snapshot.metrics.records))
+		sample(bytesDesc, prometheus.CounterValue, float64(snapshot.metrics.bytes))
+		sample(errorsDesc, prometheus.CounterValue, float64(snapshot.metrics.errors))
+		sample(queryErrorsDesc, prometheus.CounterValue, float64(snapshot.metrics.queryErrors))
+		sample(submitErrorsDesc, prometheus.CounterValue, float64(snapshot.metrics.submitErrors))
+		sample(progressDesc, prometheus.GaugeValue, s.backfillProgress(snapshot))
+		sample(bufferedDesc, prometheus.GaugeValue, float64(snapshot.metrics.buffered))
+	}
+	for _, stage := range []Lifecycle{LifecycleDiscovered, LifecycleCreating, LifecycleBackfilling, LifecycleLive, LifecyclePaused, LifecycleDegraded, LifecycleStopped} {
+		ch <- prometheus.MustNewConstMetric(synchronizersDesc, prometheus.GaugeValue, float64(stages[stage]), string(stage))
+	}
+	stats := c.migrations.Stats()
+	ch <- prometheus.MustNewConstMetric(migrationsDesc, prometheus.GaugeValue, float64(stats.Running), "running")
+	ch <- prometheus.MustNewConstMetric(migrationsDesc, prometheus.GaugeValue, float64(stats.Queued), "queued")
+}
+
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
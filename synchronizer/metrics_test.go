@@ -0,0 +1,110 @@
+package sync
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMetrics(t *testing.T) {
+	c, src, dst := newTestController(t, nil)
+	defer c.Shutdown()
+	src.data.serve(testPack("a", 0, 1), testPack("b", 0))
+	dst.data.serve()
+	src.registry.add("a")
+	c.runDiscovery(registryState{})
+	waitStored(t, dst, "a", []float64{0, 1})
+
+	// the series added later fails to subscribe, while the other one stays live
+	src.data.failSubscribe(status.Error(codes.FailedPrecondition, "no subscriptions"))
+	src.registry.add("b")
+	c.runDiscovery(registryState{})
+	var families map[string]*dto.MetricFamily
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		families = scrapeMetrics(t, c)
+		if metricValue(families, "hds_sync_query_errors_total", "b") > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the failed subscriptions of b to be counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the errors are counted for the failing series only
+	if n := metricValue(families, "hds_sync_query_errors_total", "a"); n != 0 {
+		t.Fatalf("expected no query errors for a, got %v", n)
+	}
+	if n := metricValue(families, "hds_sync_records_total", "a"); n != 2 {
+		t.Fatalf("expected 2 records submitted for a, got %v", n)
+	}
+	if got := metricValue(families, "hds_sync_source_latest_timestamp_seconds", "a"); got != testEpoch+1 {
+		t.Fatalf("expected the latest record of a at the source at %v, got %v", testEpoch+1, got)
+	}
+	if lag := metricValue(families, "hds_sync_lag_seconds", "a"); lag != 0 {
+		t.Fatalf("expected no lag for a, got %v", lag)
+	}
+
+	// the metrics of the series share the same labels
+	for name, family := range families {
+		for _, m := range family.Metric {
+			labels := make(map[string]string)
+			for _, l := range m.Label {
+				labels[l.GetName()] = l.GetValue()
+			}
+			switch name {
+			case "hds_sync_synchronizers":
+				if _, ok := labels["stage"]; !ok || len(labels) != 1 {
+					t.Fatalf("expected the stage label for %s, got %v", name, labels)
+				}
+			case "hds_sync_migrations":
+				if _, ok := labels["state"]; !ok || len(labels) != 1 {
+					t.Fatalf("expected the state label for %s, got %v", name, labels)
+				}
+			default:
+				if labels["series"] == "" || labels["destination"] != c.destinationURL || len(labels) != 2 {
+					t.Fatalf("expected the series and destination labels for %s, got %v", name, labels)
+				}
+			}
+		}
+	}
+}
+
+// scrapeMetrics parses the metrics served by the controller
+func scrapeMetrics(t *testing.T, c *Controller) map[string]*dto.MetricFamily {
+	w := httptest.NewRecorder()
+	c.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(w.Body)
+	if err != nil {
+		t.Fatalf("error parsing the metrics: %v", err)
+	}
+	return families
+}
+
+// metricValue returns the value of the metric of the series, or -1 if absent
+func metricValue(families map[string]*dto.MetricFamily, name, series string) float64 {
+	family, ok := families[name]
+	if !ok {
+		return -1
+	}
+	for _, m := range family.Metric {
+		for _, l := range m.Label {
+			if l.GetName() == "series" && l.GetValue() == series {
+				switch {
+				case m.Gauge != nil:
+					return m.Gauge.GetValue()
+				case m.Counter != nil:
+					return m.Counter.GetValue()
+				}
+			}
+		}
+	}
+	return -1
+}
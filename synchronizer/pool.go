@@ -0,0 +1,223 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/linksmart/hds-data-synchronizer/common"
+)
+
+// MigrationState tells whether a migration of a series is waiting in the queue or being executed
+type MigrationState string
+
+const (
+	MigrationIdle    MigrationState = "idle"
+	MigrationQueued  MigrationState = "queued"
+	MigrationRunning MigrationState = "running"
+)
+
+// priorityAging is the time a migration waits in the queue to gain one priority level
+const priorityAging = 30 * time.Second
+
+// errPoolClosed is returned for the jobs which did not start before the pool was closed
+var errPoolClosed = errors.New("migration pool closed")
+
+// migrationPool is the work queue for the migrations of all the series. It bounds the number of concurrent migrations
+// globally and per destination. Queued migrations with higher priority are started first, in the order of arrival
+// within the same priority. The priority of a queued migration grows with the time it waits, so that the lower classes
+// are not starved by a sustained load of the higher ones.
+type migrationPool struct {
+	sync.Mutex
+	// limit is the maximum number of concurrent migrations. Unlimited when 0
+	limit int
+	// perDestination is the maximum number of concurrent migrations towards a destination. Unlimited when 0
+	perDestination int
+	// aging is the time waited per priority level gained
+	aging time.Duration
+
+	running               int
+	runningPerDestination map[string]int
+	runningPerClass       map[*priorityClass]int
+	queue                 []*migrationJob
+	// closed is closed when the pool stops starting jobs
+	closed chan struct{}
+	// active counts the jobs being executed
+	active sync.WaitGroup
+}
+
+type migrationJob struct {
+	destination string
+	class       *priorityClass
+	run         func()
+	// queued is the time the job was queued
+	queued time.Time
+	// started is closed when the job is taken from the queue
+	started chan struct{}
+	// done is closed when the job finished running
+	done chan struct{}
+}
+
+// PoolStats gives the number of running and queued migrations
+type PoolStats struct {
+	Running int
+	Queued  int
+}
+
+func newMigrationPool(limit, perDestination int) *migrationPool {
+	return &migrationPool{
+		limit:                 limit,
+		perDestination:        perDestination,
+		aging:                 priorityAging,
+		runningPerDestination: make(map[string]int),
+		runningPerClass:       make(map[*priorityClass]int),
+		closed:                make(chan struct{}),
+	}
+}
+
+// run queues the job and blocks until it has been executed. If ctx ends while the job is still queued, the job is
+// dropped and the error of the context is returned
+func (p *migrationPool) run(ctx context.Context, destination string, class *priorityClass, run func()) error {
+	job := &migrationJob{
+		destination: destination,
+		class:       class,
+		run:         run,
+		queued:      time.Now(),
+		started:     make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	p.Lock()
+	if p.isClosed() {
+		p.Unlock()
+		return errPoolClosed
+	}
+	p.queue = append(p.queue, job)
+	p.dispatch()
+	p.Unlock()
+
+	var err error
+	select {
+	case <-job.started:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-p.closed:
+		err = errPoolClosed
+	}
+	if err != nil {
+		p.Lock()
+		select {
+		case <-job.started:
+			// started in the meantime
+			p.Unlock()
+		default:
+			p.remove(job)
+			p.Unlock()
+			return err
+		}
+	}
+	<-job.done
+	return nil
+}
+
+// close stops starting jobs. The queued jobs are dropped, the running ones complete
+func (p *migrationPool) close() {
+	p.Lock()
+	defer p.Unlock()
+	if !p.isClosed() {
+		if len(p.queue) > 0 {
+			common.Log.Warnf("migration pool closed. dropping %d queued migrations", len(p.queue))
+		}
+		close(p.closed)
+	}
+}
+
+// isClosed must be called with the lock held
+func (p *migrationPool) isClosed() bool {
+	select {
+	case <-p.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait blocks until no job is running, or until ctx ends
+func (p *migrationPool) wait(ctx context.Context) error {
+	if !waitContext(ctx, p.active.Wait) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// Stats returns the number of running and queued migrations
+func (p *migrationPool) Stats() PoolStats {
+	p.Lock()
+	defer p.Unlock()
+	return PoolStats{Running: p.running, Queued: len(p.queue)}
+}
+
+// dispatch starts queued jobs as long as there are free slots. Must be called with the lock held
+func (p *migrationPool) dispatch() {
+	now := time.Now()
+	for (p.limit <= 0 || p.running < p.limit) && !p.isClosed() {
+		next, nextPriority := -1, 0
+		for i, job := range p.queue {
+			if !p.allowed(job) {
+				continue
+			}
+			if priority := p.priority(job, now); next == -1 || priority > nextPriority {
+				next, nextPriority = i, priority
+			}
+		}
+		if next == -1 {
+			return
+		}
+		job := p.queue[next]
+		p.queue = append(p.queue[:next], p.queue[next+1:]...)
+		p.running++
+		p.runningPerDestination[job.destination]++
+		p.runningPerClass[job.class]++
+		close(job.started)
+		p.active.Add(1)
+		go p.execute(job)
+	}
+}
+
+// priority returns the priority of the class of the job, raised by the time it waited in the queue
+func (p *migrationPool) priority(job *migrationJob, now time.Time) int {
+	return job.class.priority + int(now.Sub(job.queued)/p.aging)
+}
+
+// allowed checks the per-destination and per-class limits of the job. Must be called with the lock held
+func (p *migrationPool) allowed(job *migrationJob) bool {
+	if p.perDestination > 0 && p.runningPerDestination[job.destination] >= p.perDestination {
+		return false
+	}
+	if job.class.maxBackfills > 0 && p.runningPerClass[job.class] >= job.class.maxBackfills {
+		return false
+	}
+	return true
+}
+
+func (p *migrationPool) execute(job *migrationJob) {
+	defer p.active.Done()
+	defer close(job.done)
+	job.run()
+
+	p.Lock()
+	defer p.Unlock()
+	p.running--
+	p.runningPerDestination[job.destination]--
+	p.runningPerClass[job.class]--
+	p.dispatch()
+}
+
+func (p *migrationPool) remove(job *migrationJob) {
+	for i, j := range p.queue {
+		if j == job {
+			p.queue = append(p.queue[:i], p.queue[i+1:]...)
+			return
+		}
+	}
+}
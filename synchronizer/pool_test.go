@@ -0,0 +1,90 @@
+package sync
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPoolPriority(t *testing.T) {
+	p := newMigrationPool(1, 0)
+	low, high := &priorityClass{name: "low"}, &priorityClass{name: "high", priority: 10}
+	release := make(chan struct{})
+	go p.run(context.Background(), "dst", low, func() { <-release })
+	waitStats(t, p, PoolStats{Running: 1})
+
+	started := make(chan string, 2)
+	for i, class := range []*priorityClass{low, high} {
+		class := class
+		go p.run(context.Background(), "dst", class, func() { started <- class.name })
+		waitStats(t, p, PoolStats{Running: 1, Queued: i + 1})
+	}
+	close(release)
+	if first := <-started; first != "high" {
+		t.Fatalf("expected the high priority migration first, got %s", first)
+	}
+}
+
+func TestPoolPerDestination(t *testing.T) {
+	p := newMigrationPool(0, 1)
+	class := &priorityClass{name: "default"}
+	release := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go p.run(context.Background(), "a", class, func() { <-release })
+	}
+	waitStats(t, p, PoolStats{Running: 1, Queued: 1})
+
+	// another destination is not held back by the busy one
+	started := make(chan struct{})
+	go p.run(context.Background(), "b", class, func() { close(started) })
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("migration towards another destination did not start")
+	}
+
+	close(release)
+	waitStats(t, p, PoolStats{})
+}
+
+func TestPoolAging(t *testing.T) {
+	p := newMigrationPool(1, 0)
+	p.aging = 10 * time.Millisecond
+	low, high := &priorityClass{name: "low"}, &priorityClass{name: "high", priority: 10}
+
+	// keep the queue full of high priority migrations, each running shortly
+	stop := make(chan struct{})
+	defer close(stop)
+	for i := 0; i < 2; i++ {
+		go func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				p.run(context.Background(), "dst", high, func() { time.Sleep(time.Millisecond) })
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	started := make(chan struct{})
+	go p.run(context.Background(), "dst", low, func() { close(started) })
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("low priority migration starved")
+	}
+}
+
+// waitStats waits until the pool has the given number of running and queued migrations
+func waitStats(t *testing.T, p *migrationPool, want PoolStats) {
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Stats() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %+v, got %+v", want, p.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,63 @@
+package sync
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// MetaPriority is the registry meta field holding the name of the priority class of a series
+	MetaPriority = "syncPriority"
+	// MetaMode is the registry meta field holding the synchronization mode of a series, "live" or "periodic"
+	MetaMode = "syncMode"
+	// defaultClassName is the class of the series without any priority setting
+	defaultClassName = "default"
+)
+
+// priorityClass holds the resources allocated to the series of a class
+type priorityClass struct {
+	name string
+	// priority decides the order of backfills. Classes with higher value are served first
+	priority int
+	// maxBackfills is the number of concurrent backfills allowed for the class. Unlimited when 0
+	maxBackfills int
+	// limiter caps the throughput shared by the backfills of the class
+	limiter *rateLimiter
+}
+
+// rateLimiter paces the records to a given rate
+type rateLimiter struct {
+	sync.Mutex
+	// rate in records per second
+	rate float64
+	// next is the time at which the next records may be sent
+	next time.Time
+}
+
+func newRateLimiter(recordsPerSecond int) *rateLimiter {
+	if recordsPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(recordsPerSecond)}
+}
+
+// wait blocks until n records may be sent. A nil limiter never blocks
+func (r *rateLimiter) wait(ctx context.Context, n int) error {
+	if r == nil {
+		return nil
+	}
+	r.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	delay := r.next.Sub(now)
+	r.next = r.next.Add(time.Duration(float64(n) / r.rate * float64(time.Second)))
+	r.Unlock()
+
+	if sleepContext(ctx, delay) {
+		return ctx.Err()
+	}
+	return nil
+}
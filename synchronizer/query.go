@@ -0,0 +1,128 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/farshidtz/senml/v2"
+	"github.com/farshidtz/senml/v2/codec"
+	"github.com/linksmart/historical-datastore/data"
+	_go "github.com/linksmart/historical-datastore/protobuf/go"
+)
+
+// queryPadding widens the query ranges, since HDS compares the times with microsecond precision.
+// The records are then filtered exactly by the caller
+const queryPadding = time.Microsecond
+
+// seenAll marks a cursor whose records at ts are all copied
+const seenAll = -1
+
+// cursor is the exact position of a copy: the records before ts are copied, and so are the first seen records at ts
+type cursor struct {
+	ts   time.Time
+	seen int
+}
+
+// skip returns true if the record at t was already copied. It must be called for the records in ascending order of time
+func (c *cursor) skip(t time.Time) bool {
+	if t.Before(c.ts) {
+		return true
+	}
+	if !t.Equal(c.ts) {
+		return false
+	}
+	if c.seen == seenAll {
+		return true
+	}
+	if c.seen > 0 {
+		c.seen--
+		return true
+	}
+	return false
+}
+
+// The data client of HDS formats the query ranges with time.RFC3339, which drops the sub-second part.
+// The functions below send the same requests with the full precision of the times.
+
+func queryRequest(names []string, q data.Query) *_go.QueryRequest {
+	return &_go.QueryRequest{
+		Series:          names,
+		From:            q.From.UTC().Format(time.RFC3339Nano),
+		To:              q.To.UTC().Format(time.RFC3339Nano),
+		RecordPerPacket: int32(q.PerPage),
+		DenormaMask:     _go.DenormMask(q.Denormalize),
+		SortAsc:         q.SortAsc,
+		Limit:           int32(q.Limit),
+		Offset:          int32(q.Offset),
+	}
+}
+
+// queryStream is data.GrpcClient.QueryStream with precise ranges
+func queryStream(ctx context.Context, client *data.GrpcClient, names []string, q data.Query) (chan data.ResponsePack, error) {
+	stream, err := client.Client.Query(ctx, queryRequest(names, q))
+	if err != nil {
+		return nil, fmt.Errorf("error querying stream: %w", err)
+	}
+	ch := make(chan data.ResponsePack)
+	go func() {
+		defer close(ch)
+		for {
+			message, err := stream.Recv()
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				ch <- data.ResponsePack{Pack: nil, Err: err}
+				return
+			}
+			ch <- data.ResponsePack{Pack: codec.ImportProtobufMessage(*message), Err: nil}
+		}
+	}()
+	return ch, nil
+}
+
+// query is data.GrpcClient.Query with precise ranges
+func query(ctx context.Context, client *data.GrpcClient, names []string, q data.Query) (senml.Pack, error) {
+	stream, err := client.Client.Query(ctx, queryRequest(names, q))
+	if err != nil {
+		return nil, fmt.Errorf("error querying: %w", err)
+	}
+	var records senml.Pack
+	for {
+		message, err := stream.Recv()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can not receive: %w", err)
+		}
+		records = append(records, codec.ImportProtobufMessage(*message)...)
+	}
+}
+
+// count is data.GrpcClient.Count with precise ranges
+func count(ctx context.Context, client *data.GrpcClient, names []string, q data.Query) (int, error) {
+	response, err := client.Client.Count(ctx, queryRequest(names, q))
+	if err != nil {
+		return 0, fmt.Errorf("error retrieving the count: %w", err)
+	}
+	return int(response.Total), nil
+}
+
+// countAt returns the number of records of the series exactly at t
+func countAt(ctx context.Context, client *data.GrpcClient, series string, t time.Time) (int, error) {
+	pack, err := query(ctx, client, []string{series}, data.Query{From: t.Add(-queryPadding), To: t.Add(queryPadding), SortAsc: true})
+	if err != nil {
+		return 0, err
+	}
+	pack.Normalize()
+	n := 0
+	for _, r := range pack {
+		if data.FromSenmlTime(r.Time).Equal(t) {
+			n++
+		}
+	}
+	return n, nil
+}
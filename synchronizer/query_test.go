@@ -0,0 +1,64 @@
+package sync
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCursorSkip(t *testing.T) {
+	base := time.Unix(1600000000, 0)
+	at := func(seconds ...int) []time.Time {
+		var times []time.Time
+		for _, s := range seconds {
+			times = append(times, base.Add(time.Duration(s)*time.Second))
+		}
+		return times
+	}
+	tests := []struct {
+		name     string
+		position cursor
+		times    []time.Time
+		want     []bool
+	}{
+		{
+			name:     "zero cursor skips nothing",
+			position: cursor{},
+			times:    at(0, 1),
+			want:     []bool{false, false},
+		},
+		{
+			name:     "records before the cursor are skipped",
+			position: cursor{ts: base.Add(2 * time.Second)},
+			times:    at(0, 1, 3),
+			want:     []bool{true, true, false},
+		},
+		{
+			name:     "no record seen at the cursor",
+			position: cursor{ts: base},
+			times:    at(0, 0, 1),
+			want:     []bool{false, false, false},
+		},
+		{
+			name:     "the records seen at the cursor are skipped once",
+			position: cursor{ts: base, seen: 2},
+			times:    at(0, 0, 0, 1),
+			want:     []bool{true, true, false, false},
+		},
+		{
+			name:     "all the records at the cursor are skipped",
+			position: cursor{ts: base, seen: seenAll},
+			times:    at(0, 0, 0, 1),
+			want:     []bool{true, true, true, false},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			position := test.position
+			for i, ts := range test.times {
+				if got := position.skip(ts); got != test.want[i] {
+					t.Fatalf("record %d at %v: expected skip %v, got %v", i, ts.Sub(base), test.want[i], got)
+				}
+			}
+		})
+	}
+}
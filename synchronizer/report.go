@@ -0,0 +1,397 @@
+package sync
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linksmart/hds-data-synchronizer/common"
+)
+
+// the formats of the report files
+const (
+	ReportJSON = "json"
+	ReportCSV  = "csv"
+)
+
+const (
+	defaultReportLagSLA         = 5 * time.Minute
+	defaultReportSampleInterval = time.Minute
+	defaultReportDays           = 31
+	// reportWriteInterval is the interval at which the report of the current day is written
+	reportWriteInterval = time.Hour
+	// reportDayLayout formats the UTC days of the reports
+	reportDayLayout = "2006-01-02"
+)
+
+// ErrNoReport is returned for a day without report
+var ErrNoReport = errors.New("no report for this day")
+
+// SLAReport is the replication SLA of the series over a UTC day
+type SLAReport struct {
+	Day         string `json:"day"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	// LagSLA is the maximum lag within the SLA
+	LagSLA time.Duration `json:"lagSLA"`
+	Series []SeriesSLA   `json:"series"`
+}
+
+// SeriesSLA is the replication SLA of a series over a day
+type SeriesSLA struct {
+	Series string `json:"series"`
+	// WithinSLA is the percentage of the sampled time during which the lag was within the SLA
+	WithinSLA float64 `json:"withinSLA"`
+	// MaxLag is the largest lag sampled
+	MaxLag time.Duration `json:"maxLag"`
+	// Records is the number of records submitted to the destination
+	Records int64 `json:"records"`
+	// Gaps is the number of times the lag went beyond the SLA
+	Gaps int `json:"gaps"`
+	// Sampled is the time during which the lag was known, and Within the part of it within the SLA
+	Sampled time.Duration `json:"sampled"`
+	Within  time.Duration `json:"within"`
+}
+
+// WriteCSV writes the series of the report as CSV, with the durations in seconds
+func (r SLAReport) WriteCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"day", "series", "within_sla_percent", "max_lag_seconds", "records", "gaps", "sampled_seconds"})
+	for _, s := range r.Series {
+		out.Write([]string{
+			r.Day,
+			s.Series,
+			strconv.FormatFloat(s.WithinSLA, 'f', 3, 64),
+			strconv.FormatFloat(s.MaxLag.Seconds(), 'f', 3, 64),
+			strconv.FormatInt(s.Records, 10),
+			strconv.Itoa(s.Gaps),
+			strconv.FormatFloat(s.Sampled.Seconds(), 'f', 0, 64),
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// reportSample is the previous sample of a series
+type reportSample struct {
+	time    time.Time
+	records int64
+	// breach is set while the lag is beyond the SLA
+	breach bool
+}
+
+// reporter samples the lag of the series and aggregates it into daily reports
+type reporter struct {
+	source      string
+	destination string
+	sla         time.Duration
+	interval    time.Duration
+	dir         string
+	formats     []string
+	days        int
+	log         *common.Logger
+
+	mutex sync.Mutex
+	// reports are the aggregates by day and series
+	reports map[string]map[string]*SeriesSLA
+	last    map[string]reportSample
+	// written is the time the reports were last written
+	written time.Time
+	// running tracks the sampling goroutine
+	running sync.WaitGroup
+}
+
+func newReporter(conf common.ReportConfig, source, destination string, logger *common.Logger) (*reporter, error) {
+	if !conf.Enabled {
+		return nil, nil
+	}
+	r := &reporter{
+		source:      source,
+		destination: destination,
+		sla:         defaultReportLagSLA,
+		interval:    defaultReportSampleInterval,
+		dir:         conf.Dir,
+		formats:     conf.Formats,
+		days:        conf.Days,
+		log:         logger.With("component", "report"),
+		reports:     make(map[string]map[string]*SeriesSLA),
+		last:        make(map[string]reportSample),
+	}
+	var err error
+	if conf.LagSLA != "" {
+		r.sla, err = time.ParseDuration(conf.LagSLA)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse lag SLA:%w", err)
+		}
+	}
+	if conf.SampleInterval != "" {
+		r.interval, err = time.ParseDuration(conf.SampleInterval)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse report sample interval:%w", err)
+		}
+		if r.interval <= 0 {
+			return nil, fmt.Errorf("report sample interval should be positive")
+		}
+	}
+	if len(r.formats) == 0 {
+		r.formats = []string{ReportJSON, ReportCSV}
+	}
+	for _, format := range r.formats {
+		if format != ReportJSON && format != ReportCSV {
+			return nil, fmt.Errorf("unknown report format %s", format)
+		}
+	}
+	if r.days == 0 {
+		r.days = defaultReportDays
+	}
+	if r.dir != "" {
+		err = os.MkdirAll(r.dir, 0755)
+		if err != nil {
+			return nil, fmt.Errorf("error creating report directory: %w", err)
+		}
+		err = r.load(time.Now())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// load reads the JSON reports of the retained days, so that the report of the current day continues after a restart
+func (r *reporter) load(now time.Time) error {
+	for _, day := range r.retained(now) {
+		b, err := ioutil.ReadFile(r.file(day, ReportJSON))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error reading report: %w", err)
+		}
+		var report SLAReport
+		err = json.Unmarshal(b, &report)
+		if err != nil {
+			return fmt.Errorf("error decoding report %s: %w", r.file(day, ReportJSON), err)
+		}
+		aggregates := make(map[string]*SeriesSLA, len(report.Series))
+		for i := range report.Series {
+			aggregates[report.Series[i].Series] = &report.Series[i]
+		}
+		r.reports[day] = aggregates
+	}
+	return nil
+}
+
+// retained returns the days kept until now, the latest first
+func (r *reporter) retained(now time.Time) []string {
+	days := make([]string, r.days)
+	for i := range days {
+		days[i] = now.UTC().AddDate(0, 0, -i).Format(reportDayLayout)
+	}
+	return days
+}
+
+func (r *reporter) file(day, format string) string {
+	return filepath.Join(r.dir, "sla-"+day+"."+format)
+}
+
+// run samples the synchronizers returned by list, until stop is closed. The reports are written once more when it returns
+func (r *reporter) run(stop <-chan bool, list func() map[string]*Synchronizer) {
+	if r == nil {
+		return
+	}
+	r.running.Add(1)
+	go func() {
+		defer r.running.Done()
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				r.write(time.Now())
+				return
+			case <-ticker.C:
+				r.sample(time.Now(), list())
+			}
+		}
+	}()
+}
+
+// wait blocks until the sampling goroutine returned
+func (r *reporter) wait() {
+	if r == nil {
+		return
+	}
+	r.running.Wait()
+}
+
+// sample adds the lag of the series at now to the report of the day. The time since the previous sample of a series is accounted
+// with the lag at now, unless the sampling was interrupted
+func (r *reporter) sample(now time.Time, synchronizers map[string]*Synchronizer) {
+	day := now.UTC().Format(reportDayLayout)
+	r.mutex.Lock()
+	previousDay := ""
+	if !r.written.IsZero() {
+		previousDay = r.written.UTC().Format(reportDayLayout)
+	}
+	aggregates, ok := r.reports[day]
+	if !ok {
+		aggregates = make(map[string]*SeriesSLA)
+		r.reports[day] = aggregates
+	}
+	for name, s := range synchronizers {
+		snapshot := s.snapshot()
+		aggregate, ok := aggregates[name]
+		if !ok {
+			aggregate = &SeriesSLA{Series: name}
+			aggregates[name] = aggregate
+		}
+		prev, sampled := r.last[name]
+		records := snapshot.metrics.records - prev.records
+		if records < 0 {
+			// the synchronization of the series started again
+			records = snapshot.metrics.records
+		}
+		aggregate.Records += records
+		current := reportSample{time: now, records: snapshot.metrics.records, breach: prev.breach}
+
+		// the lag is unknown until both instances have a record
+		if !snapshot.srcLatest.IsZero() && !snapshot.dstLatest.IsZero() {
+			var lag time.Duration
+			if snapshot.srcLatest.After(snapshot.dstLatest) {
+				lag = snapshot.srcLatest.Sub(snapshot.dstLatest)
+			}
+			if lag > aggregate.MaxLag {
+				aggregate.MaxLag = lag
+			}
+			current.breach = lag > r.sla
+			if current.breach && !prev.breach {
+				aggregate.Gaps++
+			}
+			if elapsed := now.Sub(prev.time); sampled && elapsed <= 2*r.interval {
+				aggregate.Sampled += elapsed
+				if !current.breach {
+					aggregate.Within += elapsed
+				}
+			}
+		}
+		if aggregate.Sampled > 0 {
+			aggregate.WithinSLA = 100 * float64(aggregate.Within) / float64(aggregate.Sampled)
+		}
+		r.last[name] = current
+	}
+	for name := range r.last {
+		if _, ok := synchronizers[name]; !ok {
+			delete(r.last, name)
+		}
+	}
+	r.mutex.Unlock()
+
+	// write the report of the day ended, and the current one from time to time
+	if previousDay != "" && previousDay != day || now.Sub(r.written) >= reportWriteInterval {
+		if previousDay != "" && previousDay != day {
+			r.writeDay(previousDay)
+		}
+		r.write(now)
+	}
+}
+
+// write writes the report of the day of now and forgets the days not retained anymore
+func (r *reporter) write(now time.Time) {
+	r.mutex.Lock()
+	r.written = now
+	retained := make(map[string]bool, r.days)
+	for _, day := range r.retained(now) {
+		retained[day] = true
+	}
+	for day := range r.reports {
+		if !retained[day] {
+			delete(r.reports, day)
+		}
+	}
+	r.mutex.Unlock()
+	r.writeDay(now.UTC().Format(reportDayLayout))
+}
+
+// writeDay writes the files of the report of a day
+func (r *reporter) writeDay(day string) {
+	if r.dir == "" {
+		return
+	}
+	report, err := r.report(day)
+	if err != nil {
+		return
+	}
+	for _, format := range r.formats {
+		var b strings.Builder
+		if format == ReportCSV {
+			err = report.WriteCSV(&b)
+		} else {
+			err = json.NewEncoder(&b).Encode(report)
+		}
+		if err == nil {
+			// write to a temporary file first, so that a crash does not leave a truncated report behind
+			tmp := r.file(day, format) + ".tmp"
+			err = ioutil.WriteFile(tmp, []byte(b.String()), 0644)
+			if err == nil {
+				err = os.Rename(tmp, r.file(day, format))
+			}
+		}
+		if err != nil {
+			r.log.Errorf("error writing report %s: %v", r.file(day, format), err)
+		}
+	}
+}
+
+// report returns the report of a day, the series sorted by name
+func (r *reporter) report(day string) (SLAReport, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	aggregates, ok := r.reports[day]
+	if !ok {
+		return SLAReport{}, ErrNoReport
+	}
+	report := SLAReport{Day: day, Source: r.source, Destination: r.destination, LagSLA: r.sla, Series: make([]SeriesSLA, 0, len(aggregates))}
+	for _, aggregate := range aggregates {
+		report.Series = append(report.Series, *aggregate)
+	}
+	sort.Slice(report.Series, func(i, j int) bool { return report.Series[i].Series < report.Series[j].Series })
+	return report, nil
+}
+
+// reportDays returns the days with a report, the latest first
+func (r *reporter) reportDays() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	days := make([]string, 0, len(r.reports))
+	for day := range r.reports {
+		days = append(days, day)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(days)))
+	return days
+}
+
+// ReportDays returns the days with an SLA report, the latest first. It is empty when the reports are disabled
+func (c *Controller) ReportDays() []string {
+	if c.reports == nil {
+		return []string{}
+	}
+	return c.reports.reportDays()
+}
+
+// Report returns the SLA report of a UTC day, formatted as 2006-01-02. The report of the current day is updated until the day ends
+func (c *Controller) Report(day string) (SLAReport, error) {
+	if c.reports == nil {
+		return SLAReport{}, ErrNoReport
+	}
+	return c.reports.report(day)
+}
@@ -0,0 +1,135 @@
+package sync
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linksmart/hds-data-synchronizer/common"
+)
+
+func TestReportBuckets(t *testing.T) {
+	dir := t.TempDir()
+	conf := common.ReportConfig{Enabled: true, LagSLA: "5m", SampleInterval: "1m", Dir: dir, Days: 2}
+	r, err := newReporter(conf, "src", "dst", common.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := &Synchronizer{series: "a"}, &Synchronizer{series: "b"}
+	synchronizers := map[string]*Synchronizer{"a": a, "b": b}
+	// set gives a the lag and the count of records submitted. b never has a record at the destination, so that its lag is unknown
+	latest := time.Unix(testEpoch, 0)
+	set := func(lag time.Duration, records int64) {
+		a.setSrcLast(latest.Add(lag))
+		a.setDstLast(latest)
+		a.stateMutex.Lock()
+		a.metrics.records = records
+		a.stateMutex.Unlock()
+	}
+	start := time.Date(2021, 1, 1, 23, 55, 0, 0, time.UTC)
+	samples := []struct {
+		lag     time.Duration
+		records int64
+	}{
+		{0, 0},
+		{time.Minute, 10},
+		// beyond the SLA for 2 samples: a single gap
+		{10 * time.Minute, 10},
+		{6 * time.Minute, 15},
+		{0, 20},
+		// the next day, the elapsed minute is accounted to it
+		{0, 30},
+	}
+	for i, sample := range samples {
+		set(sample.lag, sample.records)
+		r.sample(start.Add(time.Duration(i)*time.Minute), synchronizers)
+	}
+
+	report, err := r.report("2021-01-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SLAReport{Day: "2021-01-01", Source: "src", Destination: "dst", LagSLA: 5 * time.Minute, Series: []SeriesSLA{
+		{Series: "a", WithinSLA: 50, MaxLag: 10 * time.Minute, Records: 20, Gaps: 1, Sampled: 4 * time.Minute, Within: 2 * time.Minute},
+		{Series: "b"},
+	}}
+	if !reflect.DeepEqual(report, want) {
+		t.Fatalf("expected the report\n%+v\ngot\n%+v", want, report)
+	}
+	next, err := r.report("2021-01-02")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := next.Series[0]; got.Records != 10 || got.Sampled != time.Minute || got.WithinSLA != 100 || got.Gaps != 0 {
+		t.Fatalf("expected the minute of the next day within the SLA, got %+v", got)
+	}
+
+	// the time during which the sampling was interrupted is not accounted, and a restarted synchronization counts its records again
+	set(0, 5)
+	r.sample(start.Add(20*time.Minute), synchronizers)
+	next, _ = r.report("2021-01-02")
+	if got := next.Series[0]; got.Records != 15 || got.Sampled != time.Minute {
+		t.Fatalf("expected the interruption not to be sampled, got %+v", got)
+	}
+
+	// the report of the day ended was written as JSON and CSV, and is loaded again after a restart
+	content, err := ioutil.ReadFile(filepath.Join(dir, "sla-2021-01-01.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written SLAReport
+	if err := json.Unmarshal(content, &written); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(written, want) {
+		t.Fatalf("expected the report written\n%+v\ngot\n%+v", want, written)
+	}
+	csv, err := ioutil.ReadFile(filepath.Join(dir, "sla-2021-01-01.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantCSV := "day,series,within_sla_percent,max_lag_seconds,records,gaps,sampled_seconds\n" +
+		"2021-01-01,a,50.000,600.000,20,1,240\n" +
+		"2021-01-01,b,0.000,0.000,0,0,0\n"
+	if string(csv) != wantCSV {
+		t.Fatalf("expected the CSV report\n%s\ngot\n%s", wantCSV, csv)
+	}
+	restarted, err := newReporter(conf, "src", "dst", common.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.load(start.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := restarted.report("2021-01-01"); err != nil || !reflect.DeepEqual(loaded, want) {
+		t.Fatalf("expected the report loaded\n%+v\ngot\n%+v (%v)", want, loaded, err)
+	}
+
+	// the days beyond the retention are forgotten
+	r.write(start.Add(48 * time.Hour))
+	if days := strings.Join(r.reportDays(), ","); days != "2021-01-02" {
+		t.Fatalf("expected the report of the retained day only, got %s", days)
+	}
+	if _, err := r.report("2021-01-01"); err != ErrNoReport {
+		t.Fatalf("expected no report for the day forgotten, got %v", err)
+	}
+}
+
+func TestReportConfig(t *testing.T) {
+	if r, err := newReporter(common.ReportConfig{}, "src", "dst", common.Log); r != nil || err != nil {
+		t.Fatalf("expected the reports to be disabled by default")
+	}
+	for _, conf := range []common.ReportConfig{
+		{Enabled: true, LagSLA: "five minutes"},
+		{Enabled: true, SampleInterval: "0s"},
+		{Enabled: true, Formats: []string{"xml"}},
+	} {
+		if _, err := newReporter(conf, "src", "dst", common.Log); err == nil {
+			t.Fatalf("expected an error for %+v", conf)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linksmart/hds-data-synchronizer/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultInitialBackoff   = time.Second
+	defaultMaxBackoff       = 5 * time.Minute
+	defaultBreakerThreshold = 10
+	defaultBreakerCooldown  = 30 * time.Second
+	// maxBreakerCooldown caps the cooldown, which doubles with every failed probe
+	maxBreakerCooldown = 10 * time.Minute
+)
+
+// backoff computes the delays between the retries of a series. The delay grows exponentially with every attempt,
+// with a random jitter so that the series failing together do not retry in lockstep
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	attempt int
+}
+
+// next returns the delay before the next retry
+func (b *backoff) next() time.Duration {
+	d := b.max
+	if b.attempt < 32 && b.initial<<uint(b.attempt) < b.max {
+		d = b.initial << uint(b.attempt)
+	}
+	b.attempt++
+	// equal jitter: half of the delay is fixed, the other half is random
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// reset is called after a successful attempt
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+type breakerState string
+
+const (
+	breakerClosed   breakerState = "closed"
+	breakerOpen     breakerState = "open"
+	breakerHalfOpen breakerState = "half-open"
+)
+
+// circuitBreaker is shared by all the series using an endpoint. After threshold consecutive failures, the breaker opens and
+// the synchronizers wait instead of retrying. Once the cooldown is over, a single synchronizer is let through to probe the endpoint.
+// The breaker closes if the probe succeeds and opens again, with a doubled cooldown, if it fails.
+type circuitBreaker struct {
+	sync.Mutex
+	endpoint  string
+	threshold int
+	cooldown  time.Duration
+
+	state    breakerState
+	failures int
+	// errors counts all the failed calls, including those not caused by the endpoint
+	errors int64
+	// currentCooldown is the cooldown of the current opening
+	currentCooldown time.Duration
+	openUntil       time.Time
+	// probeStarted is set while a probe is in progress
+	probeStarted time.Time
+	// changed is closed and replaced whenever the state changes
+	changed chan struct{}
+}
+
+func newCircuitBreaker(endpoint string, threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		threshold = defaultBreakerThreshold
+	}
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	return &circuitBreaker{
+		endpoint:  endpoint,
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     breakerClosed,
+		changed:   make(chan struct{}),
+	}
+}
+
+// wait blocks while the breaker is open, or while another caller is probing the endpoint
+func (b *circuitBreaker) wait(ctx context.Context) error {
+	for {
+		b.Lock()
+		var delay time.Duration
+		switch b.state {
+		case breakerClosed:
+			b.Unlock()
+			return nil
+		case breakerOpen:
+			delay = time.Until(b.openUntil)
+			if delay <= 0 {
+				common.Log.Infof("circuit breaker of %s is half-open. probing the endpoint", b.endpoint)
+				b.setState(breakerHalfOpen)
+				b.Unlock()
+				continue
+			}
+		case breakerHalfOpen:
+			// a probe that did not report back within the cooldown is given up
+			if b.probeStarted.IsZero() || time.Since(b.probeStarted) > b.currentCooldown {
+				b.probeStarted = time.Now()
+				b.Unlock()
+				return nil
+			}
+			delay = b.currentCooldown - time.Since(b.probeStarted)
+		}
+		changed := b.changed
+		b.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		case <-time.After(delay):
+		}
+	}
+}
+
+// record reports the outcome of a call to the endpoint. A call failing because of the request still shows that the
+// endpoint is available. Interrupted calls only give up the probe of a half-open breaker
+func (b *circuitBreaker) record(ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		b.release()
+		return
+	}
+	if err != nil {
+		b.Lock()
+		b.errors++
+		b.Unlock()
+	}
+	switch {
+	case err == nil:
+		b.success()
+	case isInterrupted(err):
+		b.release()
+	case isEndpointFailure(err):
+		b.failure()
+	default:
+		b.success()
+	}
+}
+
+// release gives up the probe in progress, so that another caller probes the endpoint
+func (b *circuitBreaker) release() {
+	b.Lock()
+	defer b.Unlock()
+	if b.state == breakerHalfOpen && !b.probeStarted.IsZero() {
+		b.setState(breakerHalfOpen)
+	}
+}
+
+// Errors returns the number of failed calls to the endpoint
+func (b *circuitBreaker) Errors() int64 {
+	b.Lock()
+	defer b.Unlock()
+	return b.errors
+}
+
+func (b *circuitBreaker) success() {
+	b.Lock()
+	defer b.Unlock()
+	b.failures = 0
+	if b.state != breakerClosed {
+		common.Log.Infof("circuit breaker of %s is closed", b.endpoint)
+		b.setState(breakerClosed)
+	}
+}
+
+func (b *circuitBreaker) failure() {
+	b.Lock()
+	defer b.Unlock()
+	switch b.state {
+	case breakerClosed:
+		b.failures++
+		if b.failures >= b.threshold {
+			b.open(b.cooldown)
+		}
+	case breakerHalfOpen:
+		cooldown := 2 * b.currentCooldown
+		if cooldown > maxBreakerCooldown {
+			cooldown = maxBreakerCooldown
+		}
+		b.open(cooldown)
+	}
+}
+
+// open opens the breaker. Must be called with the lock held
+func (b *circuitBreaker) open(cooldown time.Duration) {
+	common.Log.Warnf("circuit breaker of %s is open for %v after %d failures", b.endpoint, cooldown, b.failures)
+	b.currentCooldown = cooldown
+	b.openUntil = time.Now().Add(cooldown)
+	b.setState(breakerOpen)
+}
+
+// setState changes the state and wakes up the waiting callers. Must be called with the lock held
+func (b *circuitBreaker) setState(state breakerState) {
+	b.state = state
+	b.probeStarted = time.Time{}
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// State returns the current state of the breaker
+func (b *circuitBreaker) State() breakerState {
+	b.Lock()
+	defer b.Unlock()
+	return b.state
+}
+
+// nonEndpointCodes are the gRPC codes which are caused by the request rather than by the availability of the endpoint
+var nonEndpointCodes = []codes.Code{
+	codes.Canceled, codes.InvalidArgument, codes.NotFound, codes.AlreadyExists, codes.PermissionDenied,
+	codes.FailedPrecondition, codes.OutOfRange, codes.Unimplemented, codes.Unauthenticated,
+}
+
+// isInterrupted returns true if the call was cancelled before it completed
+func isInterrupted(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return true
+	}
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if st, ok := status.FromError(e); ok {
+			return st.Code() == codes.Canceled
+		}
+	}
+	// the clients wrap some of the errors as text
+	return strings.Contains(err.Error(), "code = "+codes.Canceled.String())
+}
+
+// isEndpointFailure returns true if the error indicates that the endpoint is unavailable or failing
+func isEndpointFailure(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if st, ok := status.FromError(e); ok {
+			for _, code := range nonEndpointCodes {
+				if st.Code() == code {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	// the clients wrap some of the errors as text
+	msg := err.Error()
+	for _, code := range nonEndpointCodes {
+		if strings.Contains(msg, "code = "+code.String()) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,168 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBackoff(t *testing.T) {
+	b := backoff{initial: time.Second, max: 10 * time.Second}
+	// the delays before jitter double up to max
+	for _, d := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		if delay := b.next(); delay < d/2 || delay > d {
+			t.Fatalf("attempt %d: expected a delay within %v-%v, got %v", b.attempt, d/2, d, delay)
+		}
+	}
+	b.reset()
+	if delay := b.next(); delay < time.Second/2 || delay > time.Second {
+		t.Fatalf("expected the initial delay after reset, got %v", delay)
+	}
+	// the shift does not overflow after many attempts
+	b.attempt = 100
+	if delay := b.next(); delay < 5*time.Second || delay > 10*time.Second {
+		t.Fatalf("expected the maximum delay after many attempts, got %v", delay)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	ctx := context.Background()
+	b := newCircuitBreaker("test", 3, 20*time.Millisecond)
+
+	// the failures must be consecutive
+	b.record(ctx, unavailable)
+	b.record(ctx, unavailable)
+	b.record(ctx, nil)
+	b.record(ctx, unavailable)
+	b.record(ctx, unavailable)
+	if b.State() != breakerClosed {
+		t.Fatalf("expected closed below the threshold, got %s", b.State())
+	}
+	b.record(ctx, unavailable)
+	if b.State() != breakerOpen {
+		t.Fatalf("expected open at the threshold, got %s", b.State())
+	}
+	if err := waitFor(b, 5*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected to wait while open, got %v", err)
+	}
+
+	// a single caller probes the endpoint once the cooldown is over
+	if err := waitFor(b, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if b.State() != breakerHalfOpen {
+		t.Fatalf("expected half-open after the cooldown, got %s", b.State())
+	}
+	if err := waitFor(b, 5*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected to wait during the probe, got %v", err)
+	}
+
+	// a failed probe doubles the cooldown
+	b.record(ctx, unavailable)
+	if b.State() != breakerOpen || b.currentCooldown != 40*time.Millisecond {
+		t.Fatalf("expected open for 40ms after the failed probe, got %s for %v", b.State(), b.currentCooldown)
+	}
+
+	// a successful probe closes the breaker and lets the waiting callers through
+	if err := waitFor(b, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// the caller gives up before the probe does
+	waiting := make(chan error, 1)
+	go func() { waiting <- waitFor(b, 30*time.Millisecond) }()
+	time.Sleep(5 * time.Millisecond)
+	b.record(ctx, nil)
+	if err := <-waiting; err != nil {
+		t.Fatalf("expected the waiting caller through once closed, got %v", err)
+	}
+	if b.State() != breakerClosed {
+		t.Fatalf("expected closed after the successful probe, got %s", b.State())
+	}
+	if b.Errors() != 6 {
+		t.Fatalf("expected 6 errors, got %d", b.Errors())
+	}
+}
+
+func TestCircuitBreakerCooldownCapped(t *testing.T) {
+	b := newCircuitBreaker("test", 1, time.Millisecond)
+	b.Lock()
+	b.open(maxBreakerCooldown)
+	b.setState(breakerHalfOpen)
+	b.Unlock()
+	b.record(context.Background(), status.Error(codes.Unavailable, "unavailable"))
+	if b.currentCooldown != maxBreakerCooldown {
+		t.Fatalf("expected the cooldown capped to %v, got %v", maxBreakerCooldown, b.currentCooldown)
+	}
+}
+
+func TestCircuitBreakerIgnoredFailures(t *testing.T) {
+	b := newCircuitBreaker("test", 1, time.Minute)
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, record := range []struct {
+		ctx context.Context
+		err error
+	}{
+		{context.Background(), status.Error(codes.NotFound, "not found")},
+		{context.Background(), fmt.Errorf("query: %w", status.Error(codes.InvalidArgument, "invalid"))},
+		{context.Background(), errors.New("rpc error: code = PermissionDenied desc = denied")},
+		{context.Background(), context.Canceled},
+		{cancelled, status.Error(codes.Unavailable, "unavailable")},
+	} {
+		b.record(record.ctx, record.err)
+		if b.State() != breakerClosed {
+			t.Fatalf("expected %v to be ignored, got %s", record.err, b.State())
+		}
+	}
+	// the errors caused by the requests are counted, but not the interrupted calls
+	if b.Errors() != 4 {
+		t.Fatalf("expected 4 errors, got %d", b.Errors())
+	}
+}
+
+func TestCircuitBreakerProbeResolved(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want breakerState
+	}{
+		{"request error closes", context.Background(), status.Error(codes.NotFound, "not found"), breakerClosed},
+		{"cancelled call releases the probe", context.Background(), fmt.Errorf("query: %w", status.Error(codes.Canceled, "cancelled")), breakerHalfOpen},
+		{"interrupted call releases the probe", cancelled, status.Error(codes.Unavailable, "unavailable"), breakerHalfOpen},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newCircuitBreaker("test", 1, time.Millisecond)
+			b.record(context.Background(), status.Error(codes.Unavailable, "unavailable"))
+			// the probe
+			if err := waitFor(b, time.Second); err != nil {
+				t.Fatal(err)
+			}
+			b.record(test.ctx, test.err)
+			if b.State() != test.want {
+				t.Fatalf("expected %s, got %s", test.want, b.State())
+			}
+			// another caller is let through without waiting for the probe to be given up
+			b.currentCooldown = time.Minute
+			if err := waitFor(b, 50*time.Millisecond); err != nil {
+				t.Fatalf("expected the next caller through, got %v", err)
+			}
+		})
+	}
+}
+
+// waitFor waits for the breaker for at most timeout
+func waitFor(b *circuitBreaker, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return b.wait(ctx)
+}
@@ -0,0 +1,250 @@
+package sync
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	minutesPerDay = 24 * 60
+	// maxScheduleLookAhead bounds the search when windows are chained back to back
+	maxScheduleLookAhead = 8 * 24 * time.Hour
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Schedule is a set of windows in which the synchronization is allowed to run. An empty schedule is always active.
+type Schedule []window
+
+// window is a daily time window, active on selected days of the week
+type window struct {
+	// days on which the window starts
+	days [7]bool
+	// start is the minute of the day at which the window starts
+	start int
+	// length of the window in minutes. A window may extend to the next day
+	length int
+}
+
+// parseSchedule parses a list of windows separated by ';'.
+// Each window has the form "[<days>] <HH:MM>-<HH:MM>" where days is a cron-like day of week field
+// (e.g. "*", "mon-fri", "sat,sun" or "1-5"). Omitting the days means every day.
+// The keyword "always" results in a schedule without restrictions.
+func parseSchedule(spec string) (Schedule, error) {
+	var schedule Schedule
+	for _, part := range strings.Split(spec, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if strings.EqualFold(part, "always") {
+			return nil, nil
+		}
+		w, err := parseWindow(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule window %q: %w", part, err)
+		}
+		schedule = append(schedule, w)
+	}
+	return schedule, nil
+}
+
+func parseWindow(spec string) (w window, err error) {
+	fields := strings.Fields(spec)
+	var daysSpec, timeSpec string
+	switch len(fields) {
+	case 1:
+		daysSpec, timeSpec = "*", fields[0]
+	case 2:
+		daysSpec, timeSpec = fields[0], fields[1]
+	default:
+		return w, fmt.Errorf("expected \"[<days>] <HH:MM>-<HH:MM>\"")
+	}
+
+	w.days, err = parseDays(daysSpec)
+	if err != nil {
+		return w, err
+	}
+
+	bounds := strings.Split(timeSpec, "-")
+	if len(bounds) != 2 {
+		return w, fmt.Errorf("time range should be of the form <HH:MM>-<HH:MM>")
+	}
+	w.start, err = parseClock(bounds[0])
+	if err != nil {
+		return w, err
+	}
+	if w.start == minutesPerDay {
+		return w, fmt.Errorf("window cannot start at 24:00")
+	}
+	end, err := parseClock(bounds[1])
+	if err != nil {
+		return w, err
+	}
+	w.length = end - w.start
+	if w.length <= 0 {
+		// the window ends on the next day
+		w.length += minutesPerDay
+	}
+	return w, nil
+}
+
+func parseDays(spec string) (days [7]bool, err error) {
+	if spec == "*" {
+		for i := range days {
+			days[i] = true
+		}
+		return days, nil
+	}
+	for _, item := range strings.Split(spec, ",") {
+		bounds := strings.Split(item, "-")
+		if len(bounds) > 2 {
+			return days, fmt.Errorf("invalid day range %q", item)
+		}
+		first, err := parseDay(bounds[0])
+		if err != nil {
+			return days, err
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = parseDay(bounds[1])
+			if err != nil {
+				return days, err
+			}
+		}
+		// ranges may wrap around the end of the week, e.g. fri-mon
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func parseDay(s string) (time.Weekday, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if d, ok := weekdays[s]; ok {
+		return d, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > 7 {
+		return 0, fmt.Errorf("invalid day of week %q", s)
+	}
+	// as in cron, both 0 and 7 are Sunday
+	return time.Weekday(n % 7), nil
+}
+
+// parseClock returns the minute of the day corresponding to HH:MM. 24:00 is accepted as the end of the day
+func parseClock(s string) (int, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	h, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid hour in %q", s)
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil || m < 0 || m > 59 {
+		return 0, fmt.Errorf("invalid minute in %q", s)
+	}
+	if h < 0 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid hour in %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// clock returns the time at the minute of the day, which may extend to the next day. The minutes are counted on the wall clock,
+// so that the windows keep their times of day when the offset of the location changes, e.g. with daylight saving time
+func clock(day time.Time, minute int) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), 0, minute, 0, 0, day.Location())
+}
+
+// activeAt returns true if t is within the window, along with the end of the window
+func (w window) activeAt(t time.Time) (bool, time.Time) {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	// the window may have started today or, when it spans midnight, yesterday
+	for d := 0; d <= 1; d++ {
+		day := midnight.AddDate(0, 0, -d)
+		if !w.days[day.Weekday()] {
+			continue
+		}
+		start := clock(day, w.start)
+		end := clock(day, w.start+w.length)
+		if !t.Before(start) && t.Before(end) {
+			return true, end
+		}
+	}
+	return false, time.Time{}
+}
+
+// nextStart returns the earliest start of the window strictly after t
+func (w window) nextStart(t time.Time) (time.Time, bool) {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	for d := 0; d <= 7; d++ {
+		day := midnight.AddDate(0, 0, d)
+		if !w.days[day.Weekday()] {
+			continue
+		}
+		start := clock(day, w.start)
+		if start.After(t) {
+			return start, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// activeUntil returns true if t is within the schedule, along with the time at which the schedule becomes inactive.
+// The returned time is zero when the schedule is unrestricted.
+func (s Schedule) activeUntil(t time.Time) (bool, time.Time) {
+	if len(s) == 0 {
+		return true, time.Time{}
+	}
+	active := false
+	end := t
+	// follow overlapping and adjacent windows to find the actual end
+	for end.Sub(t) < maxScheduleLookAhead {
+		extended := false
+		for _, w := range s {
+			if ok, wEnd := w.activeAt(end); ok && wEnd.After(end) {
+				active = true
+				end = wEnd
+				extended = true
+			}
+		}
+		if !extended {
+			break
+		}
+	}
+	if !active {
+		return false, time.Time{}
+	}
+	return true, end
+}
+
+// nextStart returns the time at which the next window after t starts
+func (s Schedule) nextStart(t time.Time) time.Time {
+	var next time.Time
+	for _, w := range s {
+		if start, ok := w.nextStart(t); ok && (next.IsZero() || start.Before(next)) {
+			next = start
+		}
+	}
+	if next.IsZero() {
+		// no day is selected in any of the windows. Check again tomorrow
+		return t.Add(24 * time.Hour)
+	}
+	return next
+}
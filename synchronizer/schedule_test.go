@@ -0,0 +1,181 @@
+package sync
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestParseSchedule(t *testing.T) {
+	every := [7]bool{true, true, true, true, true, true, true}
+	tests := []struct {
+		spec    string
+		want    Schedule
+		invalid bool
+	}{
+		{spec: "", want: nil},
+		{spec: "always", want: nil},
+		{spec: "10:00-12:00; Always", want: nil},
+		{spec: "08:00-09:30", want: Schedule{{days: every, start: 8 * 60, length: 90}}},
+		{spec: "mon-fri 22:00-06:00", want: Schedule{{days: [7]bool{false, true, true, true, true, true, false}, start: 22 * 60, length: 8 * 60}}},
+		{spec: "fri-mon 10:00-11:00", want: Schedule{{days: [7]bool{true, true, false, false, false, true, true}, start: 10 * 60, length: 60}}},
+		{spec: "0,7 10:00-11:00", want: Schedule{{days: [7]bool{true}, start: 10 * 60, length: 60}}},
+		{spec: "6-1 10:00-11:00", want: Schedule{{days: [7]bool{true, true, false, false, false, false, true}, start: 10 * 60, length: 60}}},
+		{spec: "sat,sun 00:00-24:00", want: Schedule{{days: [7]bool{true, false, false, false, false, false, true}, start: 0, length: 24 * 60}}},
+		{spec: "10:00-10:00", want: Schedule{{days: every, start: 10 * 60, length: 24 * 60}}},
+		{spec: "mon 10:00-11:00; tue 12:00-13:00", want: Schedule{
+			{days: [7]bool{false, true}, start: 10 * 60, length: 60},
+			{days: [7]bool{false, false, true}, start: 12 * 60, length: 60},
+		}},
+		{spec: "24:00-01:00", invalid: true},
+		{spec: "10:00-24:30", invalid: true},
+		{spec: "25:00-01:00", invalid: true},
+		{spec: "10:60-11:00", invalid: true},
+		{spec: "10-11", invalid: true},
+		{spec: "mon 10:00", invalid: true},
+		{spec: "mon tue 10:00-11:00", invalid: true},
+		{spec: "xyz 10:00-11:00", invalid: true},
+		{spec: "8 10:00-11:00", invalid: true},
+		{spec: "mon-tue-wed 10:00-11:00", invalid: true},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			schedule, err := parseSchedule(test.spec)
+			if test.invalid {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", schedule)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(schedule) != len(test.want) {
+				t.Fatalf("expected %v, got %v", test.want, schedule)
+			}
+			for i := range schedule {
+				if schedule[i] != test.want[i] {
+					t.Fatalf("expected %v, got %v", test.want, schedule)
+				}
+			}
+		})
+	}
+}
+
+// 2021-03-01 is a Monday. Central European time switches to summer time on 2021-03-28 at 02:00, and back on 2021-10-31 at 03:00
+func scheduleTime(t *testing.T, location *time.Location, value string) time.Time {
+	ts, err := time.ParseInLocation("2006-01-02 15:04", value, location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+func TestScheduleActiveUntil(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		spec     string
+		location *time.Location
+		at       string
+		active   bool
+		until    string
+	}{
+		{name: "inside a window", spec: "mon-fri 08:00-18:00", at: "2021-03-01 12:00", active: true, until: "2021-03-01 18:00"},
+		{name: "at the start", spec: "mon-fri 08:00-18:00", at: "2021-03-01 08:00", active: true, until: "2021-03-01 18:00"},
+		{name: "at the end", spec: "mon-fri 08:00-18:00", at: "2021-03-01 18:00"},
+		{name: "day not selected", spec: "mon-fri 08:00-18:00", at: "2021-03-06 12:00"},
+		{name: "window crossing midnight, before midnight", spec: "mon-fri 22:00-06:00", at: "2021-03-01 23:00", active: true, until: "2021-03-02 06:00"},
+		{name: "window crossing midnight, after midnight", spec: "mon-fri 22:00-06:00", at: "2021-03-02 01:00", active: true, until: "2021-03-02 06:00"},
+		{name: "window of friday ending on saturday", spec: "mon-fri 22:00-06:00", at: "2021-03-06 05:00", active: true, until: "2021-03-06 06:00"},
+		{name: "window of saturday not selected", spec: "mon-fri 22:00-06:00", at: "2021-03-07 01:00"},
+		{name: "days wrapping around the week", spec: "sat-mon 10:00-11:00", at: "2021-03-07 10:30", active: true, until: "2021-03-07 11:00"},
+		{name: "chained windows", spec: "mon 20:00-24:00; tue 00:00-02:00", at: "2021-03-01 21:00", active: true, until: "2021-03-02 02:00"},
+		{name: "overlapping windows", spec: "10:00-12:00; 11:00-13:00", at: "2021-03-01 10:30", active: true, until: "2021-03-01 13:00"},
+		{name: "whole days chained", spec: "sat,sun 00:00-24:00", at: "2021-03-06 12:00", active: true, until: "2021-03-08 00:00"},
+		{name: "spring forward", spec: "sun 01:00-05:00", location: berlin, at: "2021-03-28 04:00", active: true, until: "2021-03-28 05:00"},
+		{name: "spring forward, after the window", spec: "sun 01:00-05:00", location: berlin, at: "2021-03-28 05:30"},
+		{name: "spring forward, window starting later", spec: "sun 10:00-11:00", location: berlin, at: "2021-03-28 10:30", active: true, until: "2021-03-28 11:00"},
+		{name: "fall back", spec: "sun 10:00-11:00", location: berlin, at: "2021-10-31 10:30", active: true, until: "2021-10-31 11:00"},
+		{name: "fall back, before the window", spec: "sun 10:00-11:00", location: berlin, at: "2021-10-31 09:30"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			location := test.location
+			if location == nil {
+				location = time.UTC
+			}
+			schedule, err := parseSchedule(test.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			active, until := schedule.activeUntil(scheduleTime(t, location, test.at))
+			if active != test.active {
+				t.Fatalf("expected active %v, got %v", test.active, active)
+			}
+			if test.active && !until.Equal(scheduleTime(t, location, test.until)) {
+				t.Fatalf("expected active until %s, got %v", test.until, until.In(location))
+			}
+		})
+	}
+}
+
+func TestScheduleAlwaysActive(t *testing.T) {
+	at := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	active, until := Schedule(nil).activeUntil(at)
+	if !active || !until.IsZero() {
+		t.Fatalf("expected an empty schedule active without end, got %v until %v", active, until)
+	}
+	// windows chained every day are followed up to the look-ahead
+	schedule, err := parseSchedule("00:00-24:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	active, until = schedule.activeUntil(at)
+	if !active || until.Sub(at) < maxScheduleLookAhead {
+		t.Fatalf("expected a continuous schedule active for %v, got %v until %v", maxScheduleLookAhead, active, until)
+	}
+}
+
+func TestScheduleNextStart(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		spec     string
+		location *time.Location
+		at       string
+		want     string
+	}{
+		{name: "later today", spec: "mon-fri 22:00-06:00", at: "2021-03-01 12:00", want: "2021-03-01 22:00"},
+		{name: "inside a window", spec: "mon-fri 22:00-06:00", at: "2021-03-01 23:00", want: "2021-03-02 22:00"},
+		{name: "at the start", spec: "mon-fri 22:00-06:00", at: "2021-03-01 22:00", want: "2021-03-02 22:00"},
+		{name: "over the weekend", spec: "mon-fri 22:00-06:00", at: "2021-03-05 23:00", want: "2021-03-08 22:00"},
+		{name: "next week", spec: "sun 08:00-09:00", at: "2021-03-07 08:30", want: "2021-03-14 08:00"},
+		{name: "earliest window", spec: "mon 10:00-11:00; tue 09:00-10:00", at: "2021-03-01 10:30", want: "2021-03-02 09:00"},
+		{name: "after the weekend", spec: "mon-fri 10:00-11:00", at: "2021-03-06 12:00", want: "2021-03-08 10:00"},
+		{name: "spring forward", spec: "sun 10:00-11:00", location: berlin, at: "2021-03-27 12:00", want: "2021-03-28 10:00"},
+		{name: "fall back", spec: "sun 10:00-11:00", location: berlin, at: "2021-10-30 12:00", want: "2021-10-31 10:00"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			location := test.location
+			if location == nil {
+				location = time.UTC
+			}
+			schedule, err := parseSchedule(test.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			next := schedule.nextStart(scheduleTime(t, location, test.at))
+			if !next.Equal(scheduleTime(t, location, test.want)) {
+				t.Fatalf("expected %s, got %v", test.want, next.In(location))
+			}
+		})
+	}
+}
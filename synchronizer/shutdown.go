@@ -0,0 +1,152 @@
+package sync
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/linksmart/hds-data-synchronizer/common"
+)
+
+// shutdownGrace bounds the wait for the synchronizations to return after they are cancelled
+const shutdownGrace = 5 * time.Second
+
+// ShutdownReport tells what could not be completed when the synchronizations stopped
+type ShutdownReport struct {
+	// Unflushed is the number of records received live but not submitted, by series. The records still at the source are copied
+	// by the backfill after a restart
+	Unflushed map[string]int
+	// Interrupted lists the series whose synchronization was cancelled at the deadline, e.g. in the middle of a migration
+	Interrupted []string
+	// Running lists the series whose synchronization did not return, even after being cancelled
+	Running []string
+}
+
+// Shutdown stops all the synchronizations gracefully. No new work is started, the records received live are submitted and the
+// running migrations complete, within the configured shutdown timeout. The synchronizations still running at the deadline are cancelled.
+// The connections are closed once all the synchronizations returned
+func (c *Controller) Shutdown() ShutdownReport {
+	return c.shutdown(c.shutdownTimeout)
+}
+
+func (c *Controller) shutdown(timeout time.Duration) ShutdownReport {
+	deadline, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	grace, cancelGrace := context.WithTimeout(context.Background(), timeout+shutdownGrace)
+	defer cancelGrace()
+
+	// stop the discovery first, so that the set of synchronizations does not change anymore
+	c.stopOnce.Do(func() { close(c.stopSync) })
+	if !waitContext(grace, c.discovery.Wait) {
+		c.log.Errorf("discovery did not stop")
+	}
+	if !waitContext(grace, c.alerts.wait) {
+		c.log.Errorf("alerting did not stop")
+	}
+	if !waitContext(grace, c.events.wait) {
+		c.log.Errorf("discovery events were not delivered")
+	}
+	if !waitContext(grace, c.reports.wait) {
+		c.log.Errorf("reporting did not stop")
+	}
+	c.updateMutex.Lock()
+	c.mutex.Lock()
+	c.stopping = true
+	c.mutex.Unlock()
+	c.updateMutex.Unlock()
+	synchronizers := c.synchronizers()
+
+	// no new migration is requested once stopping is set and the synchronizations are drained. The pool stays open until the
+	// deadline, so that the backfills still queued complete and the records buffered meanwhile are submitted
+	for _, s := range synchronizers {
+		s.drain()
+	}
+	for _, s := range synchronizers {
+		select {
+		case <-s.done:
+		case <-deadline.Done():
+		}
+	}
+	c.migrations.close()
+
+	report := ShutdownReport{Unflushed: make(map[string]int)}
+	for name, s := range synchronizers {
+		select {
+		case <-s.done:
+		default:
+			report.Interrupted = append(report.Interrupted, name)
+			s.clear()
+		}
+	}
+	for name, s := range synchronizers {
+		select {
+		case <-s.done:
+			if n := s.Unflushed(); n > 0 {
+				report.Unflushed[name] = n
+			}
+		case <-grace.Done():
+			report.Running = append(report.Running, name)
+		}
+	}
+	if !waitContext(grace, c.resyncs.Wait) {
+		c.log.Errorf("resyncs did not stop")
+	}
+	if c.migrations.wait(grace) != nil {
+		c.log.Errorf("migrations did not stop")
+	}
+	sort.Strings(report.Interrupted)
+	sort.Strings(report.Running)
+
+	for _, conn := range []*connection{c.srcConn, c.dstConn} {
+		err := conn.close()
+		if err != nil {
+			c.log.Errorf("error closing the connection to %s: %v", conn.endpoint, err)
+		}
+	}
+	err := c.resources.journal.close()
+	if err != nil {
+		c.log.Errorf("error closing the journal: %v", err)
+	}
+	err = c.events.close()
+	if err != nil {
+		c.log.Errorf("error closing the event log: %v", err)
+	}
+	if c.tracing != nil {
+		// export the spans still buffered
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+		err := c.tracing.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			c.log.Errorf("error flushing the traces: %v", err)
+		}
+	}
+	report.write(c.log)
+	return report
+}
+
+func (r ShutdownReport) write(logger *common.Logger) {
+	for name, n := range r.Unflushed {
+		logger.With("series", name).Warnf("%d records were not submitted", n)
+	}
+	if len(r.Interrupted) > 0 {
+		logger.Warnf("%d synchronizations were interrupted at the deadline: %v", len(r.Interrupted), r.Interrupted)
+	}
+	if len(r.Running) > 0 {
+		logger.Errorf("%d synchronizations did not stop: %v", len(r.Running), r.Running)
+	}
+}
+
+// waitContext calls wait and returns true once it returns, or false if ctx ends first
+func waitContext(ctx context.Context, wait func()) bool {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
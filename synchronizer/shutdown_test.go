@@ -0,0 +1,54 @@
+package sync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/linksmart/hds-data-synchronizer/common"
+)
+
+func TestShutdownCompletesQueuedBackfill(t *testing.T) {
+	c, src, dst := newTestController(t, func(conf *common.Config) {
+		conf.MaxConcurrentBackfills = 1
+	})
+	src.data.serve(testPack("a", 0))
+	dst.data.serve()
+
+	// the only slot of the pool is taken, so that the backfill of the series stays queued
+	release := make(chan struct{})
+	go c.migrations.run(context.Background(), c.destinationURL, &priorityClass{name: "test"}, func() { <-release })
+	waitStats(t, c.migrations, PoolStats{Running: 1})
+	src.registry.add("a")
+	c.runDiscovery(registryState{})
+	waitStats(t, c.migrations, PoolStats{Running: 1, Queued: 1})
+
+	// a record received live is buffered while the backfill waits
+	waitSubscriptions(t, src, [][]string{{"a"}})
+	src.data.store(testPack("a", 10))
+	s := c.synchronizers()["a"]
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.stateMutex.Lock()
+		buffered := s.metrics.buffered
+		s.stateMutex.Unlock()
+		if buffered == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the live record to be buffered, got %d", buffered)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	done := make(chan ShutdownReport)
+	go func() { done <- c.Shutdown() }()
+	// the queued backfill is not dropped by the shutdown, and runs once the slot is free
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	report := <-done
+	if len(report.Unflushed) > 0 || len(report.Interrupted) > 0 || len(report.Running) > 0 {
+		t.Fatalf("expected a complete shutdown, got %+v", report)
+	}
+	waitStored(t, dst, "a", []float64{0, 10})
+}
@@ -0,0 +1,157 @@
+package sync
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/farshidtz/senml/v2"
+	"github.com/linksmart/hds-data-synchronizer/common"
+	"github.com/linksmart/historical-datastore/data"
+)
+
+const (
+	// defaultSkewTolerance is how far in the future the records are accepted when not configured
+	defaultSkewTolerance = time.Minute
+	// heldRecheck bounds the time the held live records wait before being checked again
+	heldRecheck = time.Second
+)
+
+// maxQueryTime is the upper bound of the queries which are not limited by the clock of the host. It is far in the future,
+// while within the range of the SenML times of HDS
+var maxQueryTime = time.Unix(1<<33, 0)
+
+// FuturePolicy decides what happens to the records dated further in the future than the tolerance
+type FuturePolicy string
+
+const (
+	// FutureHold holds the records back until the clock of the host catches up
+	FutureHold FuturePolicy = "hold"
+	// FutureForward copies the records as they are
+	FutureForward FuturePolicy = "forward"
+	// FutureQuarantine keeps the records out of the destination and stores them in the quarantine directory instead
+	FutureQuarantine FuturePolicy = "quarantine"
+)
+
+// skewPolicy is the handling of the records in the future, shared by all the series
+type skewPolicy struct {
+	tolerance time.Duration
+	policy    FuturePolicy
+	// quarantine is set with the quarantine policy
+	quarantine *quarantine
+}
+
+// limit returns the latest time accepted without applying the policy
+func (p *skewPolicy) limit() time.Time {
+	return time.Now().Add(p.tolerance)
+}
+
+// quarantine stores the records in the future of each series. The quarantined records are persisted and never copied
+type quarantine struct {
+	dir string
+	log *common.Logger
+
+	sync.Mutex
+	// times holds the times of the quarantined records by series. Loaded lazily
+	times map[string]map[int64]bool
+}
+
+func newQuarantine(stateDir string, logger *common.Logger) (*quarantine, error) {
+	if stateDir == "" {
+		return nil, fmt.Errorf("the quarantine of records in the future requires a state directory")
+	}
+	q := &quarantine{
+		dir:   filepath.Join(stateDir, "quarantine"),
+		times: make(map[string]map[int64]bool),
+		log:   logger,
+	}
+	err := os.MkdirAll(q.dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("error creating quarantine directory: %w", err)
+	}
+	return q, nil
+}
+
+// contains returns true if the record of the series at t is quarantined
+func (q *quarantine) contains(series string, t time.Time) bool {
+	q.Lock()
+	defer q.Unlock()
+	times, err := q.load(series)
+	if err != nil {
+		q.log.With("series", series).Errorf("%v", err)
+		return false
+	}
+	return times[t.UnixNano()]
+}
+
+// add quarantines the normalized records of the series, unless they are quarantined already
+func (q *quarantine) add(series string, records senml.Pack) error {
+	q.Lock()
+	defer q.Unlock()
+	times, err := q.load(series)
+	if err != nil {
+		return err
+	}
+	var pack senml.Pack
+	for _, r := range records {
+		t := data.FromSenmlTime(r.Time).UnixNano()
+		if !times[t] {
+			times[t] = true
+			pack = append(pack, r)
+		}
+	}
+	if len(pack) == 0 {
+		return nil
+	}
+	q.log.With("series", series).Warnf("quarantined %d records in the future", len(pack))
+	f, err := os.OpenFile(q.file(series), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening quarantine: %w", err)
+	}
+	defer f.Close()
+	// one JSON pack per line
+	b, err := json.Marshal(pack)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if err != nil {
+		return fmt.Errorf("error writing quarantine: %w", err)
+	}
+	return nil
+}
+
+// load reads the quarantined times of the series. Must be called with the lock held
+func (q *quarantine) load(series string) (map[int64]bool, error) {
+	if times, ok := q.times[series]; ok {
+		return times, nil
+	}
+	times := make(map[int64]bool)
+	b, err := ioutil.ReadFile(q.file(series))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading quarantine: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for dec.More() {
+		var pack senml.Pack
+		err = dec.Decode(&pack)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing quarantine: %w", err)
+		}
+		for _, r := range pack {
+			times[data.FromSenmlTime(r.Time).UnixNano()] = true
+		}
+	}
+	q.times[series] = times
+	return times, nil
+}
+
+func (q *quarantine) file(series string) string {
+	return filepath.Join(q.dir, url.PathEscape(series)+".json")
+}
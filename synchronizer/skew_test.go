@@ -0,0 +1,65 @@
+package sync
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/farshidtz/senml/v2"
+	"github.com/linksmart/hds-data-synchronizer/common"
+	"github.com/linksmart/historical-datastore/data"
+)
+
+func TestFuturePolicies(t *testing.T) {
+	for _, policy := range []FuturePolicy{FutureForward, FutureHold, FutureQuarantine} {
+		t.Run(string(policy), func(t *testing.T) {
+			c, src, dst := newTestController(t, func(conf *common.Config) {
+				conf.StateDir = t.TempDir()
+				conf.ClockSkew = common.ClockSkewConfig{Tolerance: "500ms", Policy: string(policy)}
+			})
+			defer c.Shutdown()
+			src.data.serve(testPack("a", 0))
+			dst.data.serve()
+			src.registry.add("a")
+			c.runDiscovery(registryState{})
+			waitStored(t, dst, "a", []float64{0})
+			waitSubscriptions(t, src, [][]string{{"a"}})
+
+			// a record within the tolerance and one beyond it, received live
+			now := float64(time.Now().UnixNano()) / 1e9
+			current, future := 1.0, 2.0
+			futureTime := now + 2
+			src.data.store(senml.Pack{
+				{Name: "a", Time: now, Value: &current},
+				{Name: "a", Time: futureTime, Value: &future},
+			})
+
+			switch policy {
+			case FutureForward:
+				// copied as it is, without waiting for the clock
+				waitStored(t, dst, "a", []float64{0, 1, 2})
+				if time.Now().After(data.FromSenmlTime(futureTime)) {
+					t.Fatalf("expected the record in the future to be copied before its time")
+				}
+			case FutureHold:
+				// held back until the clock is within the tolerance, then copied
+				waitStored(t, dst, "a", []float64{0, 1})
+				waitStored(t, dst, "a", []float64{0, 1, 2})
+				if time.Now().Add(500 * time.Millisecond).Before(data.FromSenmlTime(futureTime)) {
+					t.Fatalf("expected the record in the future to be held until the clock caught up")
+				}
+			case FutureQuarantine:
+				// never copied, even once the clock caught up, and persisted in the quarantine instead
+				waitStored(t, dst, "a", []float64{0, 1})
+				time.Sleep(time.Until(data.FromSenmlTime(futureTime)) + 2*heldRecheck)
+				waitStored(t, dst, "a", []float64{0, 1})
+				if !c.resources.skew.quarantine.contains("a", data.FromSenmlTime(futureTime)) {
+					t.Fatalf("expected the record in the future to be quarantined")
+				}
+				if _, err := os.Stat(c.resources.skew.quarantine.file("a")); err != nil {
+					t.Fatalf("expected the quarantine to be persisted: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,399 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/farshidtz/senml/v2"
+	"github.com/linksmart/hds-data-synchronizer/common"
+	"github.com/linksmart/historical-datastore/data"
+)
+
+const (
+	// defaultStreamBatchSize is the number of series sharing a stream when not configured
+	defaultStreamBatchSize = 500
+	// subscriptionDebounce is the time a new group waits for further series before starting its stream
+	subscriptionDebounce = 500 * time.Millisecond
+	// subscriberBuffer is the number of packs buffered for each subscriber. A subscriber that falls further behind is dropped
+	subscriberBuffer = 100
+	// streamOverlap is the time after a restart of the stream during which the old stream may still deliver records
+	// received by the new one. The records are deduplicated meanwhile
+	streamOverlap = 10 * time.Second
+)
+
+var (
+	// errSubscriptionReplaced and errSubscriberOverflow fail a subscriber for reasons of the synchronizer, rather than of the source
+	errSubscriptionReplaced = errors.New("replaced by a new subscription")
+	errSubscriberOverflow   = errors.New("subscriber buffer overflow")
+)
+
+// subscriptionMux shares a few source subscriptions among all the live synchronizers. The series are assigned to
+// groups of at most batchSize series. Each group has a single Subscribe stream whose records are dispatched by name
+// to the subscribers. A group takes new series only until its stream is started, so that the running streams are not
+// interrupted by the series added later on.
+type subscriptionMux struct {
+	sync.Mutex
+	conn      *connection
+	batchSize int
+	// idleTimeout is the time without any message after which a stream is considered stalled. Disabled when 0
+	idleTimeout time.Duration
+	groups      []*subscriptionGroup
+	log         *common.Logger
+}
+
+// subscriptionGroup is a set of series sharing one subscription stream
+type subscriptionGroup struct {
+	mux     *subscriptionMux
+	members map[string]*subscriber
+	// started is set once the stream of the group is being established. No series join the group afterwards
+	started bool
+	// restart signals that the stream needs to be (re)started
+	restart chan struct{}
+	// stop is closed when the group has no members left and is removed from the mux
+	stop chan struct{}
+	// switching is set while a new stream replaces the old one, and the streams overlap until overlapUntil
+	switching    bool
+	overlapUntil time.Time
+	// generation numbers the streams of the group. Only used by run
+	generation int
+}
+
+// subscriber receives the records of a single series
+type subscriber struct {
+	series string
+	group  *subscriptionGroup
+	// C delivers the packs of the series. It is closed when the subscription fails
+	C chan senml.Pack
+	// ready is closed once a stream including the series is established
+	ready chan struct{}
+	// failed is closed along with C when the subscription fails, and err is set before
+	failed chan struct{}
+	err    error
+	// seen holds the records dispatched while the streams of the group overlap, along with the stream they came from
+	seen map[recordKey]int
+}
+
+// sourceFailed returns true if the subscription failed because of the source
+func (sub *subscriber) sourceFailed() bool {
+	return !errors.Is(sub.err, errSubscriptionReplaced) && !errors.Is(sub.err, errSubscriberOverflow)
+}
+
+// recordKey identifies a resolved record by its name, time and value
+type recordKey struct {
+	name        string
+	time        float64
+	value       float64
+	hasValue    bool
+	stringValue string
+	boolValue   bool
+	hasBool     bool
+	dataValue   string
+	sum         float64
+	hasSum      bool
+}
+
+func newSubscriptionMux(conn *connection, batchSize int, idleTimeout time.Duration) *subscriptionMux {
+	if batchSize <= 0 {
+		batchSize = defaultStreamBatchSize
+	}
+	return &subscriptionMux{conn: conn, batchSize: batchSize, idleTimeout: idleTimeout, log: common.Log.With("pipeline", pipelineLive)}
+}
+
+// subscribe adds the series to a group that is not started yet and waits until the stream of the group is established
+func (m *subscriptionMux) subscribe(ctx context.Context, series string) (*subscriber, error) {
+	sub := &subscriber{
+		series: series,
+		C:      make(chan senml.Pack, subscriberBuffer),
+		ready:  make(chan struct{}),
+		failed: make(chan struct{}),
+	}
+
+	m.Lock()
+	for _, g := range append([]*subscriptionGroup(nil), m.groups...) {
+		if old, ok := g.members[series]; ok {
+			g.fail(old, errSubscriptionReplaced)
+			g.removeIfEmpty()
+		}
+	}
+	var group *subscriptionGroup
+	for _, g := range m.groups {
+		if !g.started && len(g.members) < m.batchSize {
+			group = g
+			break
+		}
+	}
+	if group == nil {
+		group = &subscriptionGroup{
+			mux:     m,
+			members: make(map[string]*subscriber),
+			restart: make(chan struct{}, 1),
+			stop:    make(chan struct{}),
+		}
+		m.groups = append(m.groups, group)
+		group.notify()
+		go group.run()
+	}
+	sub.group = group
+	group.members[series] = sub
+	m.Unlock()
+
+	select {
+	case <-sub.ready:
+		return sub, nil
+	case <-sub.failed:
+		// failed before the stream was established. The packs already in C are not consumed
+		return nil, sub.err
+	case <-ctx.Done():
+		m.unsubscribe(sub)
+		return nil, ctx.Err()
+	}
+}
+
+// unsubscribe removes the subscriber from its group. The stream of the group goes on with the other series
+func (m *subscriptionMux) unsubscribe(sub *subscriber) {
+	m.Lock()
+	defer m.Unlock()
+	group := sub.group
+	if group.members[sub.series] != sub {
+		// already removed
+		return
+	}
+	delete(group.members, sub.series)
+	close(sub.C)
+	group.removeIfEmpty()
+}
+
+// removeGroup stops the stream of an empty group. Must be called with the lock held
+func (m *subscriptionMux) removeGroup(group *subscriptionGroup) {
+	for i, g := range m.groups {
+		if g == group {
+			m.groups = append(m.groups[:i], m.groups[i+1:]...)
+			close(group.stop)
+			return
+		}
+	}
+}
+
+// notify asks the group to (re)start its stream
+func (g *subscriptionGroup) notify() {
+	select {
+	case g.restart <- struct{}{}:
+	default:
+	}
+}
+
+// removeIfEmpty removes the group from the mux once it has no members left. Must be called with the lock held
+func (g *subscriptionGroup) removeIfEmpty() {
+	if len(g.members) == 0 {
+		g.mux.removeGroup(g)
+	}
+}
+
+// fail removes the subscriber from the group and closes its channel. Must be called with the lock held
+func (g *subscriptionGroup) fail(sub *subscriber, err error) {
+	if g.members[sub.series] != sub {
+		return
+	}
+	delete(g.members, sub.series)
+	sub.err = err
+	close(sub.failed)
+	close(sub.C)
+}
+
+// run starts the stream of the group once the first series have joined, and restarts it when it stalls. The new stream
+// is established before the old one is cancelled, so that no records are missed in between. The records received by
+// both streams are dispatched once
+func (g *subscriptionGroup) run() {
+	var cancelStream context.CancelFunc = func() {}
+	defer func() { cancelStream() }()
+	for {
+		select {
+		case <-g.stop:
+			return
+		case <-g.restart:
+		}
+		// collect further series before starting the stream
+		select {
+		case <-g.stop:
+			return
+		case <-time.After(subscriptionDebounce):
+		}
+
+		g.mux.Lock()
+		g.started = true
+		g.switching = g.generation > 0
+		members := make([]*subscriber, 0, len(g.members))
+		names := make([]string, 0, len(g.members))
+		for name, sub := range g.members {
+			members = append(members, sub)
+			names = append(names, name)
+		}
+		g.mux.Unlock()
+		if len(names) == 0 {
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		responseCh, err := g.mux.conn.data().Subscribe(ctx, names...)
+		if err != nil {
+			cancel()
+			g.mux.log.Errorf("error subscribing to %d series at source: %v", len(names), err)
+			g.mux.Lock()
+			g.switching = false
+			g.mux.Unlock()
+			g.failAll(members, err)
+			continue
+		}
+		g.mux.log.Infof("subscribed to %d series at source", len(names))
+		g.generation++
+		cancelStream()
+		cancelStream = cancel
+		g.mux.Lock()
+		if g.switching {
+			g.switching = false
+			g.overlapUntil = time.Now().Add(streamOverlap)
+		}
+		g.mux.Unlock()
+		for _, sub := range members {
+			select {
+			case <-sub.ready:
+			default:
+				close(sub.ready)
+			}
+		}
+		go g.receive(ctx, g.generation, responseCh, members)
+	}
+}
+
+// receive dispatches the records of the stream to the subscribers. A stream without any message for longer than the idle timeout
+// is considered stalled: it is restarted and the connection is checked
+func (g *subscriptionGroup) receive(ctx context.Context, generation int, responseCh chan data.ResponsePack, members []*subscriber) {
+	// idle stays nil when the watchdog is disabled
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if g.mux.idleTimeout > 0 {
+		idleTimer = time.NewTimer(g.mux.idleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	err := fmt.Errorf("subscription stream ended")
+loop:
+	for {
+		select {
+		case response, ok := <-responseCh:
+			if !ok {
+				break loop
+			}
+			if response.Err != nil {
+				err = response.Err
+				break loop
+			}
+			if idleTimer != nil {
+				if !idleTimer.Stop() {
+					<-idleTimer.C
+				}
+				idleTimer.Reset(g.mux.idleTimeout)
+			}
+			g.dispatch(generation, response.Pack)
+		case <-idle:
+			g.mux.log.Warnf("no messages on the subscription stream of %d series for %v. restarting the stream", len(members), g.mux.idleTimeout)
+			g.mux.conn.stalled()
+			g.notify()
+			idleTimer.Reset(g.mux.idleTimeout)
+		}
+	}
+	if ctx.Err() == nil {
+		// the stream was not replaced by a new one
+		g.mux.log.Errorf("error receiving subscription stream of %d series: %v", len(members), err)
+		g.failAll(members, err)
+	}
+	// drain the channel in case the loop was left early
+	for range responseCh {
+	}
+}
+
+// dispatch delivers the records of the pack received by a stream to the subscribers of their series. While the streams
+// are switched, both of them receive the same records: a record already dispatched by the other stream is dropped
+func (g *subscriptionGroup) dispatch(generation int, pack senml.Pack) {
+	packs := splitByName(pack)
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	overlap := g.switching || time.Now().Before(g.overlapUntil)
+	for name, pack := range packs {
+		sub, ok := g.members[name]
+		if !ok {
+			continue
+		}
+		if overlap {
+			pack = sub.unseen(generation, pack)
+			if len(pack) == 0 {
+				continue
+			}
+		} else {
+			sub.seen = nil
+		}
+		select {
+		case sub.C <- pack:
+		default:
+			g.mux.log.With("series", name).Warnf("subscriber is too slow. dropping the subscription")
+			g.fail(sub, errSubscriberOverflow)
+			g.removeIfEmpty()
+		}
+	}
+}
+
+// unseen returns the records of the pack not dispatched by another stream already, and remembers them. Must be called
+// with the lock held
+func (sub *subscriber) unseen(generation int, pack senml.Pack) senml.Pack {
+	if sub.seen == nil {
+		sub.seen = make(map[recordKey]int)
+	}
+	var unseen senml.Pack
+	for _, r := range pack {
+		key := newRecordKey(r)
+		if g, ok := sub.seen[key]; ok && g != generation {
+			continue
+		}
+		sub.seen[key] = generation
+		unseen = append(unseen, r)
+	}
+	return unseen
+}
+
+// failAll fails the given subscribers, if they are still members of the group
+func (g *subscriptionGroup) failAll(members []*subscriber, err error) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	for _, sub := range members {
+		g.fail(sub, err)
+	}
+	g.removeIfEmpty()
+}
+
+// splitByName resolves the pack and splits its records by series name
+func splitByName(pack senml.Pack) map[string]senml.Pack {
+	pack.Normalize()
+	packs := make(map[string]senml.Pack)
+	for _, r := range pack {
+		packs[r.Name] = append(packs[r.Name], r)
+	}
+	return packs
+}
+
+func newRecordKey(r senml.Record) recordKey {
+	key := recordKey{name: r.Name, time: r.Time, stringValue: r.StringValue, dataValue: r.DataValue}
+	if r.Value != nil {
+		key.value, key.hasValue = *r.Value, true
+	}
+	if r.BoolValue != nil {
+		key.boolValue, key.hasBool = *r.BoolValue, true
+	}
+	if r.Sum != nil {
+		key.sum, key.hasSum = *r.Sum, true
+	}
+	return key
+}
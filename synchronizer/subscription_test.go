@@ -0,0 +1,269 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/farshidtz/senml/v2"
+	"github.com/linksmart/hds-data-synchronizer/common"
+)
+
+// newTestGroup returns a mux with a single group whose stream is driven by the test
+func newTestGroup() (*subscriptionMux, *subscriptionGroup) {
+	mux := &subscriptionMux{batchSize: defaultStreamBatchSize, log: common.Log}
+	group := &subscriptionGroup{
+		mux:     mux,
+		members: make(map[string]*subscriber),
+		restart: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	mux.groups = append(mux.groups, group)
+	return mux, group
+}
+
+// testEpoch makes the times of the test records absolute, as SenML resolves small times relative to now
+const testEpoch = 1.6e9
+
+// testPack returns records at the given seconds after testEpoch
+func testPack(series string, times ...float64) senml.Pack {
+	var pack senml.Pack
+	for _, t := range times {
+		v := t
+		pack = append(pack, senml.Record{Name: series, Time: testEpoch + t, Value: &v})
+	}
+	return pack
+}
+
+func packTimes(pack senml.Pack) []float64 {
+	var times []float64
+	for _, r := range pack {
+		times = append(times, r.Time-testEpoch)
+	}
+	return times
+}
+
+// subscribeAsync subscribes in the background and waits until the subscriber joined the group
+func subscribeAsync(t *testing.T, mux *subscriptionMux, group *subscriptionGroup, series string) (*subscriber, chan error) {
+	var sub *subscriber
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		sub, err = mux.subscribe(context.Background(), series)
+		if err == nil && sub == nil {
+			err = errors.New("nil subscriber without error")
+		}
+		done <- err
+	}()
+	var member *subscriber
+	for member == nil {
+		time.Sleep(time.Millisecond)
+		mux.Lock()
+		member = group.members[series]
+		mux.Unlock()
+	}
+	return member, done
+}
+
+func TestSubscribeKeepsPacksReceivedBeforeReady(t *testing.T) {
+	mux, group := newTestGroup()
+	sub, done := subscribeAsync(t, mux, group, "a")
+
+	// packs dispatched before subscribe returns are kept for the subscriber
+	group.dispatch(1, testPack("a", 10))
+	select {
+	case err := <-done:
+		t.Fatalf("subscribe returned before the stream was ready: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(sub.ready)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	pack := <-sub.C
+	if len(pack) != 1 || pack[0].Time != testEpoch+10 {
+		t.Fatalf("expected the pack dispatched before ready, got %v", packTimes(pack))
+	}
+}
+
+func TestSubscribeFails(t *testing.T) {
+	mux, group := newTestGroup()
+	sub, done := subscribeAsync(t, mux, group, "a")
+	group.dispatch(1, testPack("a", 10))
+	mux.Lock()
+	group.fail(sub, errors.New("stream failed"))
+	mux.Unlock()
+	err := <-done
+	if err == nil || err.Error() != "stream failed" {
+		t.Fatalf("expected the error of the stream, got %v", err)
+	}
+}
+
+// dispatchStep is a pack dispatched by the stream of a generation. The values equal the times unless given
+type dispatchStep struct {
+	generation int
+	times      []float64
+	values     []float64
+}
+
+func (d dispatchStep) pack() senml.Pack {
+	pack := testPack("a", d.times...)
+	for i := range d.values {
+		pack[i].Value = &d.values[i]
+	}
+	return pack
+}
+
+func packValues(pack senml.Pack) []float64 {
+	var values []float64
+	for _, r := range pack {
+		values = append(values, *r.Value)
+	}
+	return values
+}
+
+func TestDispatchSwitchingStreams(t *testing.T) {
+	tests := []struct {
+		name string
+		// overlap tells whether the streams are being switched
+		overlap bool
+		// dispatches are the generation of the stream and the records, in order
+		dispatches []dispatchStep
+		// want are the values of the packs received by the subscriber
+		want [][]float64
+	}{
+		{
+			name:       "same stream keeps records out of order",
+			dispatches: []dispatchStep{{generation: 1, times: []float64{10, 11}}, {generation: 1, times: []float64{9}}},
+			want:       [][]float64{{10, 11}, {9}},
+		},
+		{
+			name:       "same stream keeps duplicate records",
+			overlap:    true,
+			dispatches: []dispatchStep{{generation: 1, times: []float64{10}}, {generation: 1, times: []float64{10}}},
+			want:       [][]float64{{10}, {10}},
+		},
+		{
+			name:       "new stream repeats the records of the old one",
+			overlap:    true,
+			dispatches: []dispatchStep{{generation: 1, times: []float64{10, 11}}, {generation: 2, times: []float64{11, 12}}, {generation: 2, times: []float64{13}}},
+			want:       [][]float64{{10, 11}, {12}, {13}},
+		},
+		{
+			name:       "old stream delivers after the new one",
+			overlap:    true,
+			dispatches: []dispatchStep{{generation: 1, times: []float64{10}}, {generation: 2, times: []float64{11, 12}}, {generation: 1, times: []float64{11, 12}}, {generation: 1, times: []float64{13}}},
+			want:       [][]float64{{10}, {11, 12}, {13}},
+		},
+		{
+			name:    "late records older than the latest one are kept",
+			overlap: true,
+			dispatches: []dispatchStep{
+				{generation: 1, times: []float64{10, 12}},
+				{generation: 2, times: []float64{12}},
+				{generation: 2, times: []float64{11}},
+				{generation: 1, times: []float64{11, 9}},
+				{generation: 2, times: []float64{9}},
+			},
+			want: [][]float64{{10, 12}, {11}, {9}},
+		},
+		{
+			name:    "records with the same time and another value are kept",
+			overlap: true,
+			dispatches: []dispatchStep{
+				{generation: 1, times: []float64{10}, values: []float64{1}},
+				{generation: 2, times: []float64{10, 10}, values: []float64{1, 2}},
+				{generation: 1, times: []float64{10}, values: []float64{2}},
+			},
+			want: [][]float64{{1}, {2}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, group := newTestGroup()
+			if test.overlap {
+				group.overlapUntil = time.Now().Add(time.Minute)
+			}
+			sub := &subscriber{series: "a", group: group, C: make(chan senml.Pack, subscriberBuffer), ready: make(chan struct{}), failed: make(chan struct{})}
+			group.members["a"] = sub
+			for _, d := range test.dispatches {
+				group.dispatch(d.generation, d.pack())
+			}
+			close(sub.C)
+			var got [][]float64
+			for pack := range sub.C {
+				got = append(got, packValues(pack))
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("expected %v, got %v", test.want, got)
+			}
+			for i := range got {
+				if len(got[i]) != len(test.want[i]) {
+					t.Fatalf("expected %v, got %v", test.want, got)
+				}
+				for j := range got[i] {
+					if got[i][j] != test.want[i][j] {
+						t.Fatalf("expected %v, got %v", test.want, got)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSubscribeKeepsRunningStreams(t *testing.T) {
+	c, src, _ := newTestController(t, nil)
+	defer c.Shutdown()
+	mux := newSubscriptionMux(c.srcConn, 0, 0)
+
+	a, err := mux.subscribe(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitSubscriptions(t, src, [][]string{{"a"}})
+	// the series added later gets a stream of its own, the running one is kept
+	b, err := mux.subscribe(context.Background(), "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitSubscriptions(t, src, [][]string{{"a"}, {"b"}})
+	src.data.publish(append(testPack("a", 10), testPack("b", 11)...))
+	receivePack(t, a, 10)
+	receivePack(t, b, 11)
+
+	// removing a series does not restart the stream of the others
+	mux.unsubscribe(a)
+	waitSubscriptions(t, src, [][]string{{"b"}})
+	src.data.publish(testPack("b", 12))
+	receivePack(t, b, 12)
+	mux.unsubscribe(b)
+}
+
+// waitSubscriptions waits until the fake HDS has the given subscriptions open
+func waitSubscriptions(t *testing.T, h *fakeHDS, want [][]string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := h.data.subscriptions()
+		if fmt.Sprint(got) == fmt.Sprint(want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected subscriptions %v, got %v", want, got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// receivePack expects a pack of the subscriber with a single record at the given time
+func receivePack(t *testing.T, sub *subscriber, want float64) {
+	select {
+	case pack := <-sub.C:
+		if got := packTimes(pack); len(got) != 1 || got[0] != want {
+			t.Fatalf("expected a record at %v for %s, got %v", want, sub.series, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no records received for %s", sub.series)
+	}
+}
@@ -2,27 +2,42 @@ package sync
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/farshidtz/senml/v2"
+	"github.com/linksmart/hds-data-synchronizer/common"
 	"github.com/linksmart/historical-datastore/data"
 )
 
+// the pipelines of a synchronization, as named in the logs
+const (
+	pipelineLive      = "live"
+	pipelinePeriodic  = "periodic"
+	pipelineMigration = "migration"
+	pipelineResync    = "resync"
+)
+
 type Src struct {
 	// srcLastTS is the time corresponding to the latest record in the source
 	lastTS time.Time
 	// ctx is the context passed to gRPC Calls
-	// client is the connection to the source host
-	client *data.GrpcClient
+	// conn is the connection to the source host
+	conn *connection
+	// breaker is the circuit breaker of the source endpoint
+	breaker *circuitBreaker
 }
 
 type Dst struct {
 	// dstLastTS is the time corresponding to the latest record in the destionation
 	lastTS time.Time
-	// client is the connection to the destination host
-	client *data.GrpcClient
+	// conn is the connection to the destination host
+	conn *connection
+	// breaker is the circuit breaker of the destination endpoint
+	breaker *circuitBreaker
 }
 
 type Synchronizer struct {
@@ -32,6 +47,42 @@ type Synchronizer struct {
 	firstTS time.Time
 	// interval in which the synchronization should happen. when 0, the synchronization will be continuous
 	interval time.Duration
+	// schedule contains the windows in which the synchronization is allowed to run
+	schedule Schedule
+	// class is the priority class of the series
+	class *priorityClass
+	// subscriptions shares the live source subscriptions among all the synchronizers
+	subscriptions *subscriptionMux
+	// migrations groups the migrations of all the synchronizers and runs them in the migration pool
+	migrations *migrationBatcher
+	// chunks splits large backfills into chunks. nil when disabled
+	chunks *chunker
+	// journal records the ranges copied. nil when disabled
+	journal *journal
+	// migrationState tells whether a migration of the series is queued or running
+	migrationState MigrationState
+	// stateMutex guards migrationState
+	stateMutex sync.Mutex
+	// backoff computes the delay before retrying after an error
+	backoff backoff
+	// adaptive adjusts the interval of the periodic synchronization. nil when the interval is fixed
+	adaptive *adaptiveInterval
+	// adaptiveBounds are the configured bounds of the adaptive interval. nil when disabled
+	adaptiveBounds *adaptiveInterval
+	// periodicInterval is the interval after a demotion from live to periodic mode
+	periodicInterval time.Duration
+	// demoteAfter is the number of consecutive subscription failures demoting the live synchronization. Disabled when 0
+	demoteAfter int
+	// subscriptionFailures is the number of consecutive subscription failures
+	subscriptionFailures int
+	// skew is the handling of the records in the future
+	skew *skewPolicy
+	// skewObserved is how far the latest record was ahead of the clock. Guarded by stateMutex
+	skewObserved time.Duration
+	// effectiveInterval is the current interval of the periodic synchronization. Guarded by stateMutex
+	effectiveInterval time.Duration
+	// leftLive is when the synchronization last left the live stage. Guarded by stateMutex
+	leftLive time.Time
 	// src holds the information related to the source series
 	src Src
 	//dst holds the information related to the destination series
@@ -40,190 +91,803 @@ type Synchronizer struct {
 	ctx context.Context
 	// cancel function to cancel any of the running gRPC communication whenever the synchronization needs to be stopped
 	cancel context.CancelFunc
+	// stopCtx ends when the synchronization stops taking new work, at the start of a graceful shutdown. It is a child of ctx
+	stopCtx context.Context
+	// stopWork ends stopCtx, while the work in progress continues
+	stopWork context.CancelFunc
+	// done is closed once the synchronization has returned
+	done chan struct{}
+	// unflushed is the number of records received live but not submitted when the live synchronization returned. Guarded by stateMutex
+	unflushed int
+	// lifecycle is the current stage of the synchronization. Guarded by stateMutex
+	lifecycle LifecycleStatus
+	// metrics holds the counters of the synchronization. Guarded by stateMutex
+	metrics seriesMetrics
+	// lastError is the latest failure of the synchronization. Guarded by stateMutex
+	lastError *SeriesError
+	// pausedExplicitly is set while the synchronization is paused. pauseCh is closed when it is paused, and resumeCh when it is resumed.
+	// Guarded by stateMutex
+	pausedExplicitly bool
+	pauseCh          chan struct{}
+	resumeCh         chan struct{}
+	// log carries the series, the source and the destination. logs adds the pipeline to it
+	log  *common.Logger
+	logs map[string]*common.Logger
 }
 
-func newSynchronization(series string, srcClient *data.GrpcClient, dstClient *data.GrpcClient, interval time.Duration) (s *Synchronizer) {
+// errStopped is returned by the work interrupted by a graceful shutdown
+var errStopped = errors.New("synchronization stopped")
+
+// newSynchronization prepares the synchronization of a discovered series. It runs once started
+func newSynchronization(series string, settings seriesSettings, res *resources) (s *Synchronizer) {
 	zeroTime := time.Time{}
 
 	s = &Synchronizer{
-		series:   series,
-		firstTS:  zeroTime, //TODO: This should come as an argument.
-		interval: interval,
+		series:           series,
+		firstTS:          zeroTime, //TODO: This should come as an argument.
+		schedule:         settings.schedule,
+		class:            settings.class,
+		subscriptions:    res.subscriptions,
+		migrations:       res.migrations,
+		chunks:           res.chunks,
+		journal:          res.journal,
+		migrationState:   MigrationIdle,
+		lifecycle:        LifecycleStatus{Stage: LifecycleDiscovered, Since: time.Now()},
+		backoff:          res.backoff,
+		adaptiveBounds:   res.adaptive,
+		periodicInterval: res.periodicInterval,
+		demoteAfter:      res.demoteAfter,
+		skew:             res.skew,
 		src: Src{
-			lastTS: zeroTime,
-			client: srcClient,
+			lastTS:  zeroTime,
+			conn:    res.srcConn,
+			breaker: res.srcBreaker,
 		},
 		dst: Dst{
-			lastTS: zeroTime,
-			client: dstClient,
+			lastTS:  zeroTime,
+			conn:    res.dstConn,
+			breaker: res.dstBreaker,
 		},
+		log:  res.log.With("series", series),
+		logs: make(map[string]*common.Logger),
+	}
+	for _, pipeline := range []string{pipelineLive, pipelinePeriodic, pipelineMigration, pipelineResync} {
+		s.logs[pipeline] = s.log.With("pipeline", pipeline)
+	}
+	if settings.interval > 0 {
+		s.setPeriodic(settings.interval)
 	}
 	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.stopCtx, s.stopWork = context.WithCancel(s.ctx)
+	s.done = make(chan struct{})
+	s.pauseCh = make(chan struct{})
+	s.resumeCh = make(chan struct{})
+	close(s.resumeCh)
+	return s
+}
 
+// start runs the synchronization, once the series exists at the destination
+func (s *Synchronizer) start() {
 	go s.synchronize()
-	return s
 }
 
-// clear ensures graceful shutdown of the synchronization related to the series
+// MigrationState returns whether a migration of the series is queued or running
+func (s *Synchronizer) MigrationState() MigrationState {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	return s.migrationState
+}
+
+// Interval returns the current interval of the periodic synchronization. It is 0 for a live synchronization
+func (s *Synchronizer) Interval() time.Duration {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	return s.effectiveInterval
+}
+
+// setPeriodic switches the synchronization to periodic mode with the given interval
+func (s *Synchronizer) setPeriodic(interval time.Duration) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.interval = interval
+	s.effectiveInterval = interval
+	if s.adaptiveBounds != nil {
+		// the bounds are widened to include the interval of the series
+		adaptive := *s.adaptiveBounds
+		adaptive.base = interval
+		if interval < adaptive.min {
+			adaptive.min = interval
+		}
+		if interval > adaptive.max {
+			adaptive.max = interval
+		}
+		s.adaptive = &adaptive
+	}
+}
+
+// liveProgress is called when the live synchronization is established
+func (s *Synchronizer) liveProgress() {
+	s.backoff.reset()
+	s.subscriptionFailures = 0
+	s.transition(LifecycleLive)
+}
+
+// adapt adjusts the interval after a successful periodic synchronization, given its duration
+func (s *Synchronizer) adapt(newData bool, duration time.Duration) {
+	if s.adaptive == nil {
+		return
+	}
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	interval := s.adaptive.next(s.effectiveInterval, newData, duration)
+	if interval != s.effectiveInterval {
+		s.logs[pipelinePeriodic].Infof("synchronization interval changed from %v to %v", s.effectiveInterval, interval)
+		s.effectiveInterval = interval
+	}
+}
+
+func (s *Synchronizer) setMigrationState(state MigrationState) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.migrationState = state
+}
+
+// clear stops the synchronization related to the series immediately
 func (s *Synchronizer) clear() {
 	s.cancel()
 }
 
+// drain stops the synchronization from taking new work. The records received live are submitted and the running migration completes,
+// unless the synchronization is cleared meanwhile
+func (s *Synchronizer) drain() {
+	s.stopWork()
+}
+
+// Unflushed returns the number of records received live which were not submitted when the live synchronization returned
+func (s *Synchronizer) Unflushed() int {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	return s.unflushed
+}
+
+func (s *Synchronizer) setUnflushed(n int) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.unflushed = n
+}
+
 func (s *Synchronizer) synchronize() {
-	canceled := false
-	if s.interval == 0 {
-		for !canceled {
-			s.subscribeAndPublish()
-			canceled = sleepContext(s.ctx, time.Second)
+	defer close(s.done)
+	defer func() {
+		s.transition(LifecycleStopped)
+	}()
+	for {
+		if s.stopCtx.Err() != nil || !s.waitForResume() || !s.waitForWindow() || !s.waitForEndpoints() {
+			return
 		}
-	} else {
-		for !canceled {
-			s.periodicSynchronization()
-			canceled = sleepContext(s.ctx, s.interval)
+		// ctx ends along with the current schedule window, when the synchronization is paused or when a connection is rebuilt
+		ctx, cancel := s.windowContext()
+		ctx, cancelPause := s.pauseContext(ctx)
+		ctx, cancelSrc := s.src.conn.context(ctx)
+		ctx, cancelDst := s.dst.conn.context(ctx)
+		var err error
+		if s.interval == 0 {
+			err = s.subscribeAndPublish(ctx)
+		} else {
+			err = s.periodicSynchronization(ctx)
+		}
+		interrupted := ctx.Err() != nil || errors.Is(err, errStopped)
+		cancelDst()
+		cancelSrc()
+		cancelPause()
+		cancel()
+		if s.isPaused() {
+			continue
+		}
+
+		delay := s.Interval()
+		if err != nil && !interrupted {
+			var subErr *subscriptionError
+			if errors.As(err, &subErr) {
+				s.subscriptionFailures++
+				if s.demoteAfter > 0 && s.subscriptionFailures >= s.demoteAfter {
+					s.logs[pipelineLive].Warnf("subscription failed %d times. falling back to periodic synchronization every %v", s.subscriptionFailures, s.periodicInterval)
+					s.setPeriodic(s.periodicInterval)
+					s.backoff.reset()
+					continue
+				}
+			}
+			delay = s.backoff.next()
+			s.logs[s.pipeline()].Errorf("%v. retrying in %v", err, delay)
+			s.failedAttempt(err)
+			s.transition(LifecycleDegraded)
+		} else if s.interval != 0 {
+			s.backoff.reset()
 		}
+		if sleepContext(s.stopCtx, delay) {
+			return
+		}
+	}
+}
+
+// pipeline returns the pipeline of the current mode. It must only be called by the synchronization itself
+func (s *Synchronizer) pipeline() string {
+	if s.interval == 0 {
+		return pipelineLive
 	}
+	return pipelinePeriodic
 }
 
-func (s *Synchronizer) subscribeAndPublish() {
-	// get the latest measurement from source
+// waitForEndpoints blocks while the circuit breaker of the source or the destination is open.
+// It returns false if the synchronization is stopped meanwhile
+func (s *Synchronizer) waitForEndpoints() bool {
+	if s.src.breaker.State() == breakerOpen || s.dst.breaker.State() == breakerOpen {
+		s.transition(LifecycleDegraded)
+	}
+	return s.src.breaker.wait(s.stopCtx) == nil && s.dst.breaker.wait(s.stopCtx) == nil
+}
 
-	var err error
-	s.src.lastTS, err = getLastTime(s.ctx, s.src.client, s.series, time.Time{}, time.Now())
-	if err != nil {
-		log.Printf("%s: failed to get latest measurement at source: %v", s.series, err)
-		return
+// waitForWindow blocks until the schedule allows the synchronization to run. It returns false if the synchronization is stopped meanwhile
+func (s *Synchronizer) waitForWindow() bool {
+	now := time.Now()
+	if active, _ := s.schedule.activeUntil(now); active {
+		return true
+	}
+	next := s.schedule.nextStart(now)
+	s.log.Infof("outside of the schedule. pausing until %v", next)
+	s.transition(LifecyclePaused)
+	if sleepContext(s.stopCtx, time.Until(next)) {
+		return false
+	}
+	s.log.Infof("schedule window started. resuming synchronization")
+	return true
+}
+
+// windowContext returns a context which is cancelled when the current schedule window ends
+func (s *Synchronizer) windowContext() (context.Context, context.CancelFunc) {
+	if active, end := s.schedule.activeUntil(time.Now()); active && !end.IsZero() {
+		return context.WithDeadline(s.ctx, end)
 	}
+	return context.WithCancel(s.ctx)
+}
+
+// paused returns true if the synchronization was interrupted by the end of a schedule window rather than being cleared
+func (s *Synchronizer) paused(ctx context.Context) bool {
+	return errors.Is(ctx.Err(), context.DeadlineExceeded) && s.ctx.Err() == nil
+}
 
-	s.dst.lastTS, err = getLastTime(s.ctx, s.dst.client, s.series, time.Time{}, time.Now())
+func (s *Synchronizer) subscribeAndPublish(ctx context.Context) error {
+	logger := s.logs[pipelineLive]
+	//subscribe to source HDS before getting the latest measurement, so that no records are missed in between
+	sub, err := s.subscriptions.subscribe(ctx, s.series)
+	s.recordSrc(ctx, err)
 	if err != nil {
-		log.Printf("%s: failed to get latest measurement at destination:%v", s.series, err)
-		return
+		return &subscriptionError{fmt.Errorf("error subscribing to source: %w", err)}
 	}
-	//subscribe to source HDS
-	responseCh, err := s.src.client.Subscribe(s.ctx, s.series)
-	log.Printf("Success subscribing to source %s", s.series)
+	defer s.subscriptions.unsubscribe(sub)
+	logger.Infof("subscribed to source")
+
+	err = s.updateLastTimes(ctx)
 	if err != nil {
-		log.Printf("%s: error subscribing to source: %v", s.series, err)
-		return
+		return err
 	}
 
-	backfillDoneCh := make(chan struct{})
-	if s.dst.lastTS.Before(s.src.lastTS) {
-		log.Printf("%s: src and destination time (%v vs %v) do not match. starting migrate", s.series, s.src.lastTS, s.dst.lastTS)
-		go s.backfill(s.dst.lastTS, s.src.lastTS, backfillDoneCh)
-	} else {
-		close(backfillDoneCh)
+	bound, err := s.upperBound(ctx)
+	if err != nil {
+		return err
 	}
-	var buffer senml.Pack
-	for response := range responseCh {
-		if response.Err != nil {
-			log.Printf("%s: error recieving stream: %v", s.series, response.Err)
-			return
+	// buffer holds the records to submit. held contains the records in the future held back by the policy, and recheck ticks while there are any
+	var buffer, held senml.Pack
+	var recheck <-chan time.Time
+	var recheckTicker *time.Ticker
+	defer func() {
+		if recheckTicker != nil {
+			recheckTicker.Stop()
 		}
-		pack := response.Pack
+		s.setUnflushed(len(buffer) + len(held))
+		s.setBuffered(0)
+	}()
+	// accept adds the records of a pack received live to the buffer, unless they are too far in the future
+	accept := func(pack senml.Pack) error {
 		latestInPack := getLatestInPack(pack) // get latest in the pack
-		log.Printf("%s: src latest:%v, dest latest:%v, latestinpack %v", s.series, s.src.lastTS, s.dst.lastTS, latestInPack)
+		logger.Debugf("src latest: %v, dest latest: %v, latest in pack: %v", s.src.lastTS, s.dst.lastTS, latestInPack)
+		s.observeSkew(latestInPack)
+		pack, future := s.splitFuture(pack)
+		if len(future) > 0 {
+			switch s.skew.policy {
+			case FutureQuarantine:
+				err := s.skew.quarantine.add(s.series, future)
+				if err != nil {
+					return err
+				}
+			default:
+				logger.Debugf("holding %d records in the future", len(future))
+				held = append(held, future...)
+				if recheckTicker == nil {
+					recheckTicker = time.NewTicker(heldRecheck)
+					recheck = recheckTicker.C
+				}
+			}
+		}
 		buffer = append(buffer, pack...)
+		return nil
+	}
+
+	// backfillCh delivers the outcome of the backfill. nil when there is no backfill in progress
+	var backfillCh chan backfillResult
+	if s.dst.lastTS.Before(bound) {
+		logger.Infof("src and destination time (%v vs %v) do not match. starting migrate", bound, s.dst.lastTS)
+		backfillCh = make(chan backfillResult, 1)
+		s.transition(LifecycleBackfilling)
+		go s.backfill(ctx, s.dst.lastTS, bound, backfillCh)
+	} else {
+		s.liveProgress()
+	}
+	for {
+		s.setBuffered(len(buffer) + len(held))
 		select {
-		case <-backfillDoneCh:
-			//buffer = append(buffer, pack...)
-			err = s.dst.client.Submit(s.ctx, buffer)
+		case result := <-backfillCh:
+			backfillCh = nil
+			if result.err != nil {
+				return fmt.Errorf("backfill failed: %w", result.err)
+			}
+			s.setDstLast(result.position.ts)
+			s.liveProgress()
+			// submit the records buffered during the backfill, except those it copied
+			err = s.publish(notCopied(buffer, result.position))
 			if err != nil {
-				log.Printf("%s: error copying entries : %v", s.series, err)
-				return
-			} else {
-				log.Printf("%s: migrated SenML pack of len %d", s.series, len(pack))
-				s.dst.lastTS = latestInPack
+				return err
 			}
 			buffer = nil
-
-			s.src.lastTS = latestInPack
-		default:
-			log.Printf("%s: buffering %d records", s.series, len(pack))
+		case pack, ok := <-sub.C:
+			if !ok {
+				if sub.sourceFailed() {
+					s.callFailed(true)
+				}
+				return &subscriptionError{fmt.Errorf("error recieving stream: %w", sub.err)}
+			}
+			err = accept(pack)
+			if err != nil {
+				return err
+			}
+			if backfillCh != nil {
+				logger.Debugf("buffering %d records", len(pack))
+				continue
+			}
+			err = s.publish(buffer)
+			if err != nil {
+				return err
+			}
+			buffer = nil
+		case <-recheck:
+			var released senml.Pack
+			released, held = s.splitFuture(held)
+			if len(held) == 0 {
+				recheckTicker.Stop()
+				recheckTicker, recheck = nil, nil
+			}
+			buffer = append(buffer, released...)
+			if backfillCh != nil || len(released) == 0 {
+				continue
+			}
+			err = s.publish(buffer)
+			if err != nil {
+				return err
+			}
+			buffer = nil
+		case <-s.stopCtx.Done():
+			if s.ctx.Err() != nil {
+				// cleared rather than drained
+				return nil
+			}
+			// take the packs received so far, then submit them once the backfill is done
+			logger.Infof("stopping live synchronization")
+			s.subscriptions.unsubscribe(sub)
+			for pack := range sub.C {
+				err = accept(pack)
+				if err != nil {
+					return err
+				}
+			}
+			if backfillCh != nil {
+				select {
+				case result := <-backfillCh:
+					if result.err != nil {
+						return fmt.Errorf("backfill failed: %w", result.err)
+					}
+					s.setDstLast(result.position.ts)
+					buffer = notCopied(buffer, result.position)
+				case <-ctx.Done():
+					return nil
+				}
+			}
+			err = s.publish(buffer)
+			if err != nil {
+				return err
+			}
+			buffer = nil
+			if len(held) > 0 {
+				logger.Warnf("%d records in the future are not submitted", len(held))
+			}
+			return errStopped
+		case <-ctx.Done():
+			if s.paused(ctx) {
+				logger.Infof("schedule window ended. pausing live synchronization")
+				s.transition(LifecyclePaused)
+			}
+			return nil
 		}
+	}
+}
+
+// publish submits the records received live to the destination
+func (s *Synchronizer) publish(pack senml.Pack) error {
+	if len(pack) == 0 {
+		return nil
+	}
+	ctx, span := startSpan(s.ctx, "Submit", attrSeries.String(s.series), attrEndpoint.String(s.dst.conn.endpoint), attrRecords.Int(len(pack)))
+	err := s.dst.conn.data().Submit(ctx, pack)
+	endSpan(span, err)
+	s.recordDst(s.ctx, err)
+	if err != nil {
+		return fmt.Errorf("error copying entries : %w", err)
+	}
+	latest := getLatestInPack(pack)
+	s.logs[pipelineLive].Debugf("migrated SenML pack of len %d", len(pack))
+	s.journal.recordLive(s.series, pack)
+	s.submitted(pack)
+	s.setSrcLast(latest)
+	s.setDstLast(latest)
+	return nil
+}
 
+func (s *Synchronizer) periodicSynchronization(ctx context.Context) error {
+	started := time.Now()
+	err := s.updateLastTimes(ctx)
+	if err != nil {
+		return err
 	}
 
+	s.logs[pipelinePeriodic].Debugf("src latest: %v, dest latest: %v", s.src.lastTS, s.dst.lastTS)
+	bound, err := s.upperBound(ctx)
+	if err != nil {
+		return err
+	}
+	newData := bound.After(s.dst.lastTS)
+	if newData {
+		// the regular copies of a series in sync do not count as backfills
+		if s.Lifecycle().Stage != LifecycleLive {
+			s.transition(LifecycleBackfilling)
+		}
+		last, err := s.migrate(ctx, s.dst.lastTS, bound)
+		s.setDstLast(last.ts)
+		if err != nil {
+			return err
+		}
+	}
+	if s.paused(ctx) {
+		s.transition(LifecyclePaused)
+	} else {
+		s.transition(LifecycleLive)
+	}
+	// the records written at the source during the synchronization are copied by the next one
+	s.adapt(newData, time.Since(started))
+	return nil
 }
 
-func (s *Synchronizer) periodicSynchronization() {
-	var err error
-	s.src.lastTS, err = getLastTime(s.ctx, s.src.client, s.series, time.Time{}, time.Now())
+// updateLastTimes gets the latest measurements at the source and at the destination. The clock of the host does not limit them,
+// as the clocks of the devices may be ahead
+func (s *Synchronizer) updateLastTimes(ctx context.Context) error {
+	last, err := getLastTime(ctx, s.src.conn, s.series, time.Time{}, maxQueryTime)
+	s.recordSrc(ctx, err)
 	if err != nil {
-		log.Printf("%s: failed to get latest measurement at source: %v", s.series, err)
-		return
+		return fmt.Errorf("failed to get latest measurement at source: %w", err)
 	}
+	s.setSrcLast(last)
 
-	s.dst.lastTS, err = getLastTime(s.ctx, s.dst.client, s.series, time.Time{}, time.Now())
+	last, err = getLastTime(ctx, s.dst.conn, s.series, time.Time{}, maxQueryTime)
+	s.recordDst(ctx, err)
 	if err != nil {
-		log.Printf("%s: failed to get latest measurement at dest: %v", s.series, err)
-		return
+		return fmt.Errorf("failed to get latest measurement at destination: %w", err)
+	}
+	s.setDstLast(last)
+	return nil
+}
+
+// setSrcLast and setDstLast update the latest times. They are only changed by the synchronization goroutine,
+// which may read them without locking
+func (s *Synchronizer) setSrcLast(t time.Time) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.src.lastTS = t
+}
+
+func (s *Synchronizer) setDstLast(t time.Time) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	s.dst.lastTS = t
+}
+
+// upperBound returns the end of the range to copy: the latest record at the source, unless it is further in the future than the tolerance.
+// The records beyond the tolerance are then held back or quarantined, depending on the policy
+func (s *Synchronizer) upperBound(ctx context.Context) (time.Time, error) {
+	s.observeSkew(s.src.lastTS)
+	limit := s.skew.limit()
+	if !s.src.lastTS.After(limit) || s.skew.policy == FutureForward {
+		return s.src.lastTS, nil
+	}
+	if s.skew.policy == FutureQuarantine {
+		pack, err := query(ctx, s.src.conn.data(), []string{s.series}, data.Query{From: limit, To: s.src.lastTS.Add(queryPadding), SortAsc: true})
+		s.recordSrc(ctx, err)
+		if err != nil {
+			return limit, fmt.Errorf("error querying the records in the future: %w", err)
+		}
+		pack.Normalize()
+		_, future := s.splitFuture(pack)
+		err = s.skew.quarantine.add(s.series, future)
+		if err != nil {
+			return limit, err
+		}
 	}
+	return limit, nil
+}
 
-	log.Printf("%s: periodicSync: src latest :%v, dest latest: %v", s.series, s.src.lastTS, s.dst.lastTS)
-	if s.src.lastTS.After(s.dst.lastTS) {
-		s.migrate(s.dst.lastTS, s.src.lastTS)
+// splitFuture splits the normalized records into those within the tolerance and those further in the future.
+// All the records are within the tolerance with the forward policy
+func (s *Synchronizer) splitFuture(pack senml.Pack) (current senml.Pack, future senml.Pack) {
+	if s.skew.policy == FutureForward {
+		return pack, nil
+	}
+	limit := s.skew.limit()
+	for _, r := range pack {
+		if data.FromSenmlTime(r.Time).After(limit) {
+			future = append(future, r)
+		} else {
+			current = append(current, r)
+		}
 	}
+	return current, future
+}
+
+// observeSkew records how far the latest record of the series is ahead of the clock of the host
+func (s *Synchronizer) observeSkew(latest time.Time) {
+	skew := time.Until(latest)
+	if skew < 0 {
+		skew = 0
+	}
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	if skew > s.skew.tolerance && s.skewObserved <= s.skew.tolerance {
+		s.log.Warnf("records are %v ahead of the clock. applying the %s policy", skew.Round(time.Second), s.skew.policy)
+	}
+	s.skewObserved = skew
+}
 
+// Skew returns how far the latest record of the series was ahead of the clock of the host when last observed
+func (s *Synchronizer) Skew() time.Duration {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	return s.skewObserved
 }
 
-func getLastTime(ctx context.Context, client *data.GrpcClient, series string, from time.Time, to time.Time) (time.Time, error) {
-	pack, err := client.Query(ctx, []string{series}, data.Query{From: from, To: to, Limit: 1, SortAsc: false})
+func getLastTime(ctx context.Context, conn *connection, series string, from time.Time, to time.Time) (time.Time, error) {
+	ctx, span := startSpan(ctx, "getLastTime", attrSeries.String(series), attrEndpoint.String(conn.endpoint))
+	pack, err := query(ctx, conn.data(), []string{series}, data.Query{From: from, To: to, Limit: 1, SortAsc: false})
+	endSpan(span, err)
 	if err != nil {
-		return time.Time{}, fmt.Errorf("series:%s, error:%s", series, err)
+		return time.Time{}, fmt.Errorf("series:%s, error:%w", series, err)
 	}
 	if len(pack) != 1 {
 		return from, nil
 	}
-	return data.FromSenmlTime(pack[0].Time), err
+	pack.Normalize()
+	return data.FromSenmlTime(pack[0].Time), nil
 }
 
-func (s *Synchronizer) backfill(from time.Time, to time.Time, backfillDoneCh chan struct{}) {
-	defer close(backfillDoneCh)
-	s.migrate(from, to)
+// subscriptionError is a failure of the live subscription, as opposed to the failures of the queries and submissions
+type subscriptionError struct {
+	err error
 }
-func (s *Synchronizer) migrate(from time.Time, to time.Time) {
-	adjustment := time.Microsecond
-	from = from.Add(adjustment)
-	to = to.Add(adjustment) //add little delay to `to` inorder to avoid missing the latest measurements because of floating point errors
 
-	log.Printf("%s: starting migrate from %v to %v", s.series, from, to)
-	ctx := s.ctx
-	destStream, err := s.dst.client.CreateSubmitStream(ctx)
-	if err != nil {
-		log.Printf("%s: error getting the stream: %v", s.series, err)
+func (e *subscriptionError) Error() string {
+	return e.err.Error()
+}
+
+func (e *subscriptionError) Unwrap() error {
+	return e.err
+}
+
+// backfillResult is the outcome of a backfill running along with the live synchronization
+type backfillResult struct {
+	// position is the end of the copy
+	position cursor
+	err      error
+}
+
+func (s *Synchronizer) backfill(ctx context.Context, from time.Time, to time.Time, backfillCh chan backfillResult) {
+	position, err := s.migrate(ctx, from, to)
+	backfillCh <- backfillResult{position: position, err: err}
+}
+
+// notCopied returns the records received live which are after the position of the backfill. The records are sorted by time,
+// as the position skips the records at its time in order
+func notCopied(pack senml.Pack, position cursor) senml.Pack {
+	sort.SliceStable(pack, func(i, j int) bool { return pack[i].Time < pack[j].Time })
+	var rest senml.Pack
+	for _, r := range pack {
+		if !position.skip(data.FromSenmlTime(r.Time)) {
+			rest = append(rest, r)
+		}
 	}
+	return rest
+}
+
+// migrate copies the records in the range (from, to] and waits for it to complete. Large ranges are split into chunks,
+// other ranges are copied along with the migrations of other series. It returns the position of the copy, whose time is the latest
+// record at the destination
+func (s *Synchronizer) migrate(ctx context.Context, from time.Time, to time.Time) (cursor, error) {
+	s.setMigrationState(MigrationQueued)
+	defer s.setMigrationState(MigrationIdle)
+	s.migrationStarted(from, to)
 
-	defer s.dst.client.CloseSubmitStream(destStream)
-	//get last time from Src HDS
-	q := data.Query{
-		Denormalize: data.DenormMaskName | data.DenormMaskTime | data.DenormMaskUnit,
-		SortAsc:     true,
-		From:        from,
-		To:          to, //add a second to to to avoid missing the latest measurements because of floating point errors
+	// the records at from which already reached the destination are skipped
+	start := cursor{ts: from}
+	if !from.IsZero() {
+		seen, err := countAt(ctx, s.dst.conn.data(), s.series, from)
+		s.recordDst(ctx, err)
+		if err != nil {
+			return start, fmt.Errorf("error getting the position at destination: %w", err)
+		}
+		start.seen = seen
 	}
-	sourceChannel, err := s.src.client.QueryStream(ctx, []string{s.series}, q)
-	if err != nil {
-		log.Printf("%s: error querying the source: %v", s.series, err)
+	return s.copyFrom(ctx, start, to)
+}
+
+// resync copies the records from from up to to again, beside the synchronization. The records copied twice are replaced at the destination
+func (s *Synchronizer) resync(from time.Time, to time.Time) {
+	logger := s.logs[pipelineResync]
+	logger.Infof("starting resync from %v to %v", from, to)
+	copied := s.journal.newRange()
+	result := s.migrations.migrate(s.stopCtx, s.series, s.class, cursor{ts: from}, to, func() {}, func(pack senml.Pack) {
+		s.migrated(pack)
+		copied.add(pack)
+	}, s.callFailed)
+	if result.err != nil {
+		if result.count > 0 {
+			s.journal.record(s.series, JournalResync, from, result.lastTS, copied, false)
+		}
+		err := fmt.Errorf("resync aborted after %d entries: %w", result.count, result.err)
+		logger.Errorf("%v", err)
+		s.failed(err)
 		return
 	}
-	totalSynced := 0
-	for response := range sourceChannel {
-		if response.Err != nil {
-			log.Printf("%s: migrate aborted: error recieving stream : %v", s.series, response.Err)
-			break
-		}
-		err = s.dst.client.SubmitToStream(destStream, response.Pack)
+	s.journal.record(s.series, JournalResync, from, to, copied, true)
+	logger.Infof("resynced %d entries", result.count)
+}
+
+// copyFrom copies the records after the cursor up to to
+func (s *Synchronizer) copyFrom(ctx context.Context, from cursor, to time.Time) (cursor, error) {
+	if s.chunks != nil {
+		plan, err := s.chunks.plan(ctx, s.src.conn.data(), s.series, from, to)
+		s.recordSrc(ctx, err)
 		if err != nil {
-			log.Printf("%s: migrate aborted: error submitting stream %s: %v", s.series, err)
-			break
+			return from, fmt.Errorf("error planning the chunks of migrate: %w", err)
+		}
+		if plan != nil {
+			err = s.copyChunks(ctx, plan)
+			if err != nil || !plan.end().Before(to) {
+				return cursor{ts: plan.end(), seen: seenAll}, err
+			}
+			// the plan was resumed from an earlier run. Continue with the rest of the range
+			if plan.end().After(from.ts) {
+				from = cursor{ts: plan.end(), seen: seenAll}
+			}
+			return s.copyFrom(ctx, from, to)
 		}
-		s.dst.lastTS = getLatestInPack(response.Pack)
-		totalSynced += len(response.Pack)
+	}
 
+	logger := s.logs[pipelineMigration]
+	logger.Infof("starting migrate from %v to %v", from.ts, to)
+	copied := s.journal.newRange()
+	result := s.migrations.migrate(ctx, s.series, s.class, from, to, func() {
+		s.setMigrationState(MigrationRunning)
+	}, func(pack senml.Pack) {
+		s.migrated(pack)
+		copied.add(pack)
+	}, s.callFailed)
+	position := cursor{ts: result.lastTS, seen: result.seen}
+	if result.err != nil {
+		if result.count > 0 {
+			s.journal.record(s.series, JournalMigration, from.ts, result.lastTS, copied, false)
+		}
+		if s.paused(ctx) {
+			logger.Infof("schedule window ended. paused migrate after %d entries", result.count)
+			return position, nil
+		}
+		return position, fmt.Errorf("migrate aborted after %d entries: %w", result.count, result.err)
 	}
-	log.Printf("%s: migrated %d entries. dest latest: %v", s.series, totalSynced, s.dst.lastTS)
+	s.journal.record(s.series, JournalMigration, from.ts, to, copied, true)
+	logger.Infof("migrated %d entries. dest latest: %v", result.count, result.lastTS)
+	return position, nil
+}
 
+// copyChunks copies the unfinished chunks of the plan concurrently. It returns an error if any of the chunks is not done
+func (s *Synchronizer) copyChunks(ctx context.Context, plan *chunkPlan) error {
+	logger := s.logs[pipelineMigration]
+	logger.Infof("starting migrate of %d chunks from %v to %v", len(plan.Chunks), plan.Chunks[0].From, plan.end())
+	var (
+		wg        sync.WaitGroup
+		mutex     sync.Mutex
+		total     int
+		failed    bool
+		skipped   bool
+		semaphore = make(chan struct{}, s.chunks.parallelism)
+	)
+	for i, ch := range plan.Chunks {
+		if ch.Done {
+			continue
+		}
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+		case <-s.stopCtx.Done():
+		}
+		mutex.Lock()
+		stop := failed || ctx.Err() != nil || s.stopCtx.Err() != nil
+		mutex.Unlock()
+		if stop {
+			skipped = true
+			break
+		}
+		wg.Add(1)
+		go func(i int, ch chunk) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			copied := s.journal.newRange()
+			result := s.migrations.copyRange(ctx, s.series, s.class, cursor{ts: ch.From, seen: ch.Seen}, ch.To, func() {
+				s.setMigrationState(MigrationRunning)
+			}, func(pack senml.Pack) {
+				s.migrated(pack)
+				copied.add(pack)
+			}, s.callFailed)
+			mutex.Lock()
+			defer mutex.Unlock()
+			total += result.count
+			if result.err != nil {
+				if result.count > 0 {
+					s.journal.record(s.series, JournalMigration, ch.From, result.lastTS, copied, false)
+				}
+				logger.Warnf("migrate of chunk %d (%v to %v) aborted: %v", i, ch.From, ch.To, result.err)
+				failed = true
+				// keep the progress, so that the chunk is resumed from there
+				if result.lastTS.After(ch.From) || result.seen != ch.Seen {
+					err := s.chunks.advance(plan, i, cursor{ts: result.lastTS, seen: result.seen})
+					if err != nil {
+						logger.Errorf("error saving the progress of chunk %d: %v", i, err)
+					}
+				}
+				return
+			}
+			s.journal.record(s.series, JournalMigration, ch.From, ch.To, copied, true)
+			err := s.chunks.markDone(plan, i)
+			if err != nil {
+				logger.Errorf("error saving the progress of chunk %d: %v", i, err)
+			}
+		}(i, ch)
+	}
+	wg.Wait()
+	if failed || skipped {
+		logger.Infof("migrated %d entries in chunks. the remaining chunks are resumed later", total)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if s.stopCtx.Err() != nil {
+			return errStopped
+		}
+		return fmt.Errorf("migrate of chunks aborted")
+	}
+	logger.Infof("migrated %d entries in %d chunks. dest latest: %v", total, len(plan.Chunks), plan.end())
+	return nil
 }
 
 func getLatestInPack(pack senml.Pack) time.Time {
@@ -0,0 +1,94 @@
+package sync
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/farshidtz/senml/v2"
+	"github.com/linksmart/hds-data-synchronizer/common"
+	"github.com/linksmart/historical-datastore/data"
+)
+
+func TestNotCopied(t *testing.T) {
+	at := func(seconds float64, seen int) cursor {
+		return cursor{ts: data.FromSenmlTime(testEpoch + seconds), seen: seen}
+	}
+	tests := []struct {
+		name     string
+		buffer   []float64
+		position cursor
+		want     []float64
+	}{
+		{
+			name:     "records up to the end of the backfill",
+			buffer:   []float64{12, 10, 11},
+			position: at(11, 1),
+			want:     []float64{12},
+		},
+		{
+			name:     "records at the end not copied by the backfill",
+			buffer:   []float64{11, 11, 12},
+			position: at(11, 1),
+			want:     []float64{11, 12},
+		},
+		{
+			name:     "backfill ended before the records",
+			buffer:   []float64{12, 13},
+			position: at(11, seenAll),
+			want:     []float64{12, 13},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := packTimes(notCopied(testPack("a", test.buffer...), test.position))
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestPeriodicBoundaryRecordsCopiedOnce(t *testing.T) {
+	c, src, dst := newTestController(t, func(conf *common.Config) {
+		conf.PeriodicInterval = "50ms"
+		conf.Series = []common.SeriesConfig{{Match: "*", Mode: "periodic"}}
+	})
+	defer c.Shutdown()
+	// records within the same second, and several records at the same time
+	records := func(points ...[2]float64) senml.Pack {
+		var pack senml.Pack
+		for _, p := range points {
+			v := p[1]
+			pack = append(pack, senml.Record{Name: "a", Time: testEpoch + p[0], Value: &v})
+		}
+		return pack
+	}
+	src.data.serve(records([2]float64{10.25, 1}, [2]float64{10.25, 2}, [2]float64{10.75, 3}))
+	dst.data.serve()
+	src.registry.add("a")
+	c.runDiscovery(registryState{})
+	waitStored(t, dst, "a", []float64{1, 2, 3})
+
+	// more records at the time of the latest one copied, and after it within the same second
+	src.data.store(records([2]float64{10.75, 4}, [2]float64{10.9, 5}))
+	waitStored(t, dst, "a", []float64{1, 2, 3, 4, 5})
+	// the following synchronizations copy nothing more
+	time.Sleep(200 * time.Millisecond)
+	waitStored(t, dst, "a", []float64{1, 2, 3, 4, 5})
+}
+
+// waitStored waits until the fake HDS stores exactly the given values of the series, in order of time
+func waitStored(t *testing.T, h *fakeHDS, series string, want []float64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := packValues(h.data.stored(series))
+		if reflect.DeepEqual(got, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the values %v for %s, got %v", want, series, got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
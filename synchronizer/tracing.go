@@ -0,0 +1,164 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/linksmart/hds-data-synchronizer/common"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// the exporters of the traces
+const (
+	TracingOTLPGRPC = "otlp-grpc"
+	TracingOTLPHTTP = "otlp-http"
+	TracingStdout   = "stdout"
+)
+
+const defaultTracingServiceName = "hds-data-synchronizer"
+
+// the attributes of the spans
+const (
+	attrSeries   = attribute.Key("hds.series")
+	attrEndpoint = attribute.Key("hds.endpoint")
+	attrRecords  = attribute.Key("hds.records")
+	attrPage     = attribute.Key("hds.page")
+)
+
+// tracer returns the tracer of the spans of the calls to the HDS instances. It is taken from the provider installed last,
+// since a tracer obtained before would keep delegating to the first provider. It does nothing until tracing is set up
+func tracer() trace.Tracer {
+	return otel.Tracer("github.com/linksmart/hds-data-synchronizer/synchronizer")
+}
+
+// setupTracing installs the tracer provider exporting the spans and the propagator of the trace context. It returns nil when disabled
+func setupTracing(conf common.TracingConfig, source, destination string) (*sdktrace.TracerProvider, error) {
+	if conf.Exporter == "" {
+		return nil, nil
+	}
+	if conf.SampleRatio < 0 || conf.SampleRatio > 1 {
+		return nil, fmt.Errorf("tracing sample ratio should be between 0 and 1")
+	}
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch conf.Exporter {
+	case TracingOTLPGRPC:
+		var opts []otlptracegrpc.Option
+		if conf.Endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(conf.Endpoint))
+		}
+		if conf.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(context.Background(), opts...)
+	case TracingOTLPHTTP:
+		var opts []otlptracehttp.Option
+		if conf.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(conf.Endpoint))
+		}
+		if conf.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	case TracingStdout:
+		exporter, err = stdouttrace.New()
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %s", conf.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating the %s exporter: %w", conf.Exporter, err)
+	}
+	ratio := conf.SampleRatio
+	if ratio == 0 {
+		ratio = 1
+	}
+	serviceName := conf.ServiceName
+	if serviceName == "" {
+		serviceName = defaultTracingServiceName
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String(serviceName),
+			attribute.String("hds.source", source),
+			attribute.String("hds.destination", destination),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider, nil
+}
+
+// startSpan starts the span of a call to an HDS instance
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// endSpan records the error of the call, if any, and ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracingInterceptors propagate the trace context to the HDS instances in the gRPC metadata.
+// The registry client of HDS does not pass a context, so that only the data calls are propagated
+func tracingInterceptors() []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithUnaryInterceptor(func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			return invoker(injectTraceContext(ctx), method, req, reply, cc, opts...)
+		}),
+		grpc.WithStreamInterceptor(func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			return streamer(injectTraceContext(ctx), desc, cc, method, opts...)
+		}),
+	}
+}
+
+func injectTraceContext(ctx context.Context) context.Context {
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, metadataCarrier(md))
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// metadataCarrier adapts the gRPC metadata to the propagators
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	values := metadata.MD(c).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,138 @@
+package sync
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/linksmart/hds-data-synchronizer/common"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	c, src, dst := newTestController(t, func(conf *common.Config) {
+		conf.Tracing = common.TracingConfig{Exporter: TracingStdout}
+	})
+	defer c.Shutdown()
+	// the spans are recorded by a provider installed after the one of the controller
+	recorder := installSpanRecorder(t)
+
+	src.data.serve(testPack("a", 0, 1))
+	dst.data.serve()
+	src.registry.add("a")
+	c.runDiscovery(registryState{})
+	waitStored(t, dst, "a", []float64{0, 1})
+	waitSubscriptions(t, src, [][]string{{"a"}})
+	src.data.publish(testPack("a", 2))
+	waitStored(t, dst, "a", []float64{0, 1, 2})
+
+	// the calls of the migration and of the live synchronization are traced with the series
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.SpanContext().SpanID().String()] = span
+	}
+	for _, name := range []string{"getLastTime", "migrate", "QueryStream", "SubmitToStream", "Submit"} {
+		span, ok := findSpan(recorder.Ended(), name)
+		if !ok {
+			t.Fatalf("expected a %s span", name)
+		}
+		if series := spanSeries(span); len(series) != 1 || series[0] != "a" {
+			t.Fatalf("expected the %s span of series a, got %v", name, series)
+		}
+	}
+	if span, ok := findSpan(recorder.Ended(), "registry.GetMany"); !ok || span.SpanKind() != trace.SpanKindClient {
+		t.Fatalf("expected a client span of the registry calls")
+	}
+
+	// the HDS instances receive the trace context of the spans of the calls
+	for _, called := range []struct {
+		hds    *fakeHDS
+		method string
+	}{{src, "/data.Data/Query"}, {dst, "/data.Data/Submit"}} {
+		parents := called.hds.receivedTraceParents(called.method)
+		if len(parents) == 0 {
+			t.Fatalf("expected the trace context in the metadata of %s", called.method)
+		}
+		for _, parent := range parents {
+			fields := strings.Split(parent, "-")
+			if len(fields) != 4 {
+				t.Fatalf("invalid trace context %s", parent)
+			}
+			span, ok := spans[fields[2]]
+			if !ok || span.SpanContext().TraceID().String() != fields[1] {
+				t.Fatalf("expected the trace context %s of %s to be of a span of the calls", parent, called.method)
+			}
+		}
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	c, src, dst := newTestController(t, nil)
+	defer c.Shutdown()
+	if c.tracing != nil {
+		t.Fatalf("expected tracing to be disabled by default")
+	}
+	installSpanRecorder(t)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	src.data.serve(testPack("a", 0))
+	dst.data.serve()
+	src.registry.add("a")
+	c.runDiscovery(registryState{})
+	waitStored(t, dst, "a", []float64{0})
+	for _, h := range []*fakeHDS{src, dst} {
+		for _, method := range []string{"/data.Data/Query", "/data.Data/Submit"} {
+			if parents := h.receivedTraceParents(method); len(parents) != 0 {
+				t.Fatalf("expected no trace context in the metadata of %s, got %v", method, parents)
+			}
+		}
+	}
+}
+
+func TestSetupTracingErrors(t *testing.T) {
+	for _, conf := range []common.TracingConfig{
+		{Exporter: "zipkin"},
+		{Exporter: TracingStdout, SampleRatio: 1.5},
+	} {
+		if _, err := setupTracing(conf, "src", "dst"); err == nil {
+			t.Fatalf("expected an error for %+v", conf)
+		}
+	}
+}
+
+// installSpanRecorder installs a tracer provider recording the spans until the end of the test
+func installSpanRecorder(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() {
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	})
+	return recorder
+}
+
+// spanSeries returns the series attribute of the span
+func spanSeries(span sdktrace.ReadOnlySpan) []string {
+	for _, attr := range span.Attributes() {
+		if attr.Key == attrSeries {
+			if values := attr.Value.AsStringSlice(); values != nil {
+				return values
+			}
+			return []string{attr.Value.AsString()}
+		}
+	}
+	return nil
+}
+
+// findSpan returns the first span of the name
+func findSpan(spans []sdktrace.ReadOnlySpan, name string) (sdktrace.ReadOnlySpan, bool) {
+	for _, span := range spans {
+		if span.Name() == name {
+			return span, true
+		}
+	}
+	return nil, false
+}